@@ -0,0 +1,35 @@
+package main
+
+import (
+	"time"
+)
+
+// Clock is what the watcher, the monitor and the engine use to tell and wait for time, so tests can drive it with
+// `test_helpers.FakeClock`.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	// AfterFunc calls f after the duration and returns a function that cancels the call.
+	AfterFunc(d time.Duration, f func()) (stop func() bool)
+}
+
+type RealClock struct{}
+
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+func (RealClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (RealClock) AfterFunc(d time.Duration, f func()) func() bool {
+	return time.AfterFunc(d, f).Stop
+}
+
+func orRealClock(clock Clock) Clock {
+	if clock == nil {
+		return RealClock{}
+	}
+	return clock
+}
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// The subcommands that are run instead of the daemon when the first argument matches, e.g. `git-notes release <repo>`.
+var commands = map[string]func(args []string) error{
+	"release": releaseCommand,
+	"retry":   retryCommand,
+	"crypt":   cryptCommand,
+	"metered": meteredCommand,
+	"history": historyCommand,
+	"log":     logCommand,
+	"status":  statusCommand,
+	"restore": restoreCommand,
+	"service": serviceCommand,
+	"relay":   relayCommand,
+	"serve":   serveCommand,
+	"web":     webCommand,
+	"search":  searchCommand,
+	"mode":    modeCommand,
+
+	"confirm-deletions": confirmDeletionsCommand,
+}
+
+// parseCommandArgs parses the flags wherever they are, e.g. `git-notes history <repo> --since 2h`, and returns the
+// positional arguments.
+func parseCommandArgs(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		err := flags.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func releaseCommand(args []string) error {
+	ctx := context.Background()
+	if len(args) != 1 {
+		return fmt.Errorf("usage: git-notes release <repo>")
+	}
+
+	path := expandPath(args[0])
+	err := ReleasePush(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("The push of %s is released. It will be pushed on the next sync.\n", path)
+	return nil
+}
+
+func retryCommand(args []string) error {
+	ctx := context.Background()
+	if len(args) != 1 {
+		return fmt.Errorf("usage: git-notes retry <repo>")
+	}
+
+	path := expandPath(args[0])
+	err := RetryAuth(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("The remote operations of %s are resumed. They will be retried on the next sync.\n", path)
+	return nil
+}
+
+func confirmDeletionsCommand(args []string) error {
+	ctx := context.Background()
+	if len(args) != 1 {
+		return fmt.Errorf("usage: git-notes confirm-deletions <repo>")
+	}
+
+	path := expandPath(args[0])
+	deleted, err := ConfirmDeletions(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range deleted {
+		fmt.Println(file)
+	}
+	fmt.Printf("The deletion of %d files in %s is confirmed. It will be committed on the next sync.\n", len(deleted), path)
+	return nil
+}
+
+func meteredCommand(args []string) error {
+	ctx := context.Background()
+	if len(args) < 1 || len(args) > 2 || (args[0] != "on" && args[0] != "off" && args[0] != "status") {
+		return fmt.Errorf("usage: git-notes metered on|off|status [repo]")
+	}
+
+	path := ""
+	target := "this machine"
+	if len(args) == 2 {
+		path = expandPath(args[1])
+		target = path
+	}
+
+	if args[0] == "status" {
+		metered, err := IsMachineMetered()
+		if path != "" {
+			metered, err = IsMetered(ctx, path)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Metered: %v\n", metered)
+		return nil
+	}
+
+	err := SetMetered(ctx, path, args[0] == "on")
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("The connection of %s is flagged as metered: %v\n", target, args[0] == "on")
+	return nil
+}
+
+func historyCommand(args []string) error {
+	ctx := context.Background()
+	flags := flag.NewFlagSet("history", flag.ContinueOnError)
+	since := flags.String("since", "", "Only show the entries after this time, e.g. `2021-06-07 12:00` or `2h`")
+	until := flags.String("until", "", "Only show the entries before this time")
+	asJson := flags.Bool("json", false, "Print the entries as JSON lines")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: git-notes history <repo> [--since <time>] [--until <time>] [--json]")
+		flags.PrintDefaults()
+	}
+
+	positional, err := parseCommandArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		flags.Usage()
+		return fmt.Errorf("usage: git-notes history <repo> [--since <time>] [--until <time>] [--json]")
+	}
+
+	now := time.Now()
+	var sinceTime, untilTime time.Time
+	if *since != "" {
+		sinceTime, err = ParseTime(*since, now)
+		if err != nil {
+			return err
+		}
+	}
+	if *until != "" {
+		untilTime, err = ParseTime(*until, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	entries, err := ReadJournal(ctx, expandPath(positional[0]), sinceTime, untilTime)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if *asJson {
+			line, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(line))
+		} else {
+			fmt.Println(entry)
+		}
+	}
+	return nil
+}
+
+// statusCommand prints the last state that the daemon recorded, and the machines that made the latest local and
+// remote commits.
+func statusCommand(args []string) error {
+	ctx := context.Background()
+	if len(args) != 1 {
+		return fmt.Errorf("usage: git-notes status <repo>")
+	}
+	path := expandPath(args[0])
+
+	last, failure, err := LastSync(ctx, path)
+	if err != nil {
+		return err
+	}
+	state := "unknown, no sync is recorded"
+	if last.To != "" {
+		state = fmt.Sprintf("%s (%s)", last.To, last.Time.Local().Format("2006-01-02 15:04:05"))
+	}
+	fmt.Printf("State: %s\n", state)
+	mode, err := ReadModeOverride(ctx, path)
+	if err != nil {
+		return err
+	}
+	if mode != "" {
+		fmt.Printf("Mode: %s, set by git-notes mode\n", mode)
+	}
+	if failure.Message != "" {
+		fmt.Printf("Last error: %s\n", failure.Message)
+	}
+
+	local, err := ReadCommitInfo(ctx, path, "HEAD")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Last commit: %s\n", local)
+
+	branch, err := GetBranch(ctx, path)
+	if err != nil {
+		return err
+	}
+	remote, err := ReadCommitInfo(ctx, path, fmt.Sprintf("origin/%s", branch))
+	if err == nil {
+		fmt.Printf("Last remote commit: %s\n", remote)
+	}
+	return nil
+}
+
+// modeCommand overrides the mode of the config. The daemon picks it up on the next sync.
+func modeCommand(args []string) error {
+	ctx := context.Background()
+	usage := fmt.Errorf("usage: git-notes mode <repo> [active | paused | commit-only | pull-only | mirror | config]")
+	if len(args) != 1 && len(args) != 2 {
+		return usage
+	}
+	path := expandPath(args[0])
+
+	if len(args) == 1 {
+		mode, err := ReadModeOverride(ctx, path)
+		if err != nil {
+			return err
+		}
+		if mode == "" {
+			fmt.Printf("The mode of %s comes from the config.\n", path)
+		} else {
+			fmt.Printf("The mode of %s is %s.\n", path, mode)
+		}
+		return nil
+	}
+
+	mode := args[1]
+	if mode == "config" {
+		mode = ""
+	}
+	err := SetModeOverride(ctx, path, mode)
+	if err != nil {
+		return err
+	}
+	if mode == "" {
+		fmt.Printf("The mode of %s comes from the config again.\n", path)
+	} else {
+		fmt.Printf("The mode of %s is %s until `git-notes mode %s config`.\n", path, mode, args[0])
+	}
+	return nil
+}
+
+func logCommand(args []string) error {
+	ctx := context.Background()
+	if len(args) != 2 {
+		return fmt.Errorf("usage: git-notes log <repo> <path>")
+	}
+
+	versions, err := FileLog(ctx, expandPath(args[0]), args[1])
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return fmt.Errorf("%s has no versions", args[1])
+	}
+
+	for _, version := range versions {
+		fmt.Println(version)
+	}
+	return nil
+}
+
+func restoreCommand(args []string) error {
+	ctx := context.Background()
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	at := flags.String("at", "", "The time of the version to restore, e.g. `2021-06-07 12:00` or `2h`")
+	configFile := flags.String("config", "", "The config file, whose hooks check the restored version. Without one, only the secrets are checked")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: git-notes restore <repo> <path> --at <time> [--config <config-file>]")
+		flags.PrintDefaults()
+	}
+
+	positional, err := parseCommandArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 2 || *at == "" {
+		flags.Usage()
+		return fmt.Errorf("usage: git-notes restore <repo> <path> --at <time> [--config <config-file>]")
+	}
+
+	atTime, err := ParseTime(*at, time.Now())
+	if err != nil {
+		return err
+	}
+
+	path := expandPath(positional[0])
+	config := &Config{Repos: []string{path}, Settings: map[string]RepoConfig{path: {Hooks: HooksConfig{Secrets: true}}}}
+	if *configFile != "" {
+		config, err = (&FileConfigReader{}).Read(*configFile)
+		if err != nil {
+			return err
+		}
+	}
+	git := NewGoGit(nil, nil, nil)
+	git.Configure(config)
+	version, err := git.RestoreFile(ctx, path, positional[1], atTime)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Restored %s to the version of %s from %s (%s). It will be pushed on the next sync.\n", positional[1], version.Time.Local().Format("2006-01-02 15:04:05"), version.Host, version.Sha[:8])
+	return nil
+}
+
+func serviceCommand(args []string) error {
+	usage := fmt.Errorf("usage: git-notes service install <config-file> | uninstall | status [--system] [--dry-run]")
+	flags := flag.NewFlagSet("service", flag.ContinueOnError)
+	system := flags.Bool("system", false, "Use a system unit that runs as the current user instead of a user unit")
+	dryRun := flags.Bool("dry-run", false, "Print the unit and the systemctl commands instead of running them")
+	unitDir := flags.String("unit-dir", "", "Write the unit to this directory instead of the one of systemd")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+
+	positional, err := parseCommandArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) == 0 || (positional[0] == "install") != (len(positional) == 2) || len(positional) > 2 {
+		flags.Usage()
+		return usage
+	}
+
+	configPath := ""
+	if len(positional) == 2 {
+		configPath = positional[1]
+	}
+	options, err := NewServiceOptions(configPath, *system)
+	if err != nil {
+		return err
+	}
+	options.UnitDir = *unitDir
+
+	switch positional[0] {
+	case "install":
+		return InstallService(options, SystemctlCmd{}, *dryRun, os.Stdout)
+	case "uninstall":
+		return UninstallService(options, SystemctlCmd{}, *dryRun, os.Stdout)
+	case "status":
+		return ServiceStatus(options, SystemctlCmd{}, os.Stdout)
+	}
+	flags.Usage()
+	return usage
+}
+
+func relayCommand(args []string) error {
+	ctx := context.Background()
+	usage := fmt.Errorf("usage: git-notes relay serve --listen <address> [--token <token>] | channel <repo>")
+	flags := flag.NewFlagSet("relay", flag.ContinueOnError)
+	listen := flags.String("listen", "", "The address to listen on, e.g. `0.0.0.0:8288`")
+	token := flags.String("token", os.Getenv("GIT_NOTES_RELAY_TOKEN"), "The token that the machines send. Defaults to $GIT_NOTES_RELAY_TOKEN")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+
+	positional, err := parseCommandArgs(flags, args)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(positional) == 1 && positional[0] == "serve" && *listen != "":
+		err = ServeRelay(*listen, *token)
+		if err != nil {
+			return err
+		}
+		select {}
+	case len(positional) == 2 && positional[0] == "channel":
+		channel, err := repoRelayChannel(ctx, expandPath(positional[1]))
+		if err != nil {
+			return err
+		}
+		fmt.Println(channel)
+		return nil
+	}
+	flags.Usage()
+	return usage
+}
+
+func serveCommand(args []string) error {
+	usage := fmt.Errorf("usage: git-notes serve <dir> --listen <address> [--token <token>] [--create]")
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	listen := flags.String("listen", "", "The address to listen on, e.g. `0.0.0.0:8300`")
+	token := flags.String("token", os.Getenv("GIT_NOTES_SERVE_TOKEN"), "The token that the machines send. Defaults to $GIT_NOTES_SERVE_TOKEN")
+	create := flags.Bool("create", false, "Create the bare repos that the machines ask for")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+
+	positional, err := parseCommandArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 || *listen == "" {
+		flags.Usage()
+		return usage
+	}
+
+	server, err := NewRepoServer(expandPath(positional[0]), *token, *create)
+	if err != nil {
+		return err
+	}
+	return ServeRepos(*listen, server)
+}
+
+func webCommand(args []string) error {
+	usage := fmt.Errorf("usage: git-notes web <config-file> [--listen <address>]")
+	flags := flag.NewFlagSet("web", flag.ContinueOnError)
+	listen := flags.String("listen", "127.0.0.1:8301", "The address to listen on. Anyone who can reach it can read the notes")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+
+	positional, err := parseCommandArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		flags.Usage()
+		return usage
+	}
+
+	config, err := (&FileConfigReader{}).Read(positional[0])
+	if err != nil {
+		return fmt.Errorf("unable to read the config file. Err: %v", err)
+	}
+	return ServeWeb(*listen, NewWebServer(config.Repos))
+}
+
+func searchCommand(args []string) error {
+	ctx := context.Background()
+	usage := fmt.Errorf("usage: git-notes search <config-file> <words...> [--path <glob>] [--repo <name>] [--limit <count>] [--json]")
+	flags := flag.NewFlagSet("search", flag.ContinueOnError)
+	pathFilter := flags.String("path", "", "Only search the files that match the glob, e.g. `*.md`, or that are in the directory, e.g. `work/`")
+	repoFilter := flags.String("repo", "", "Only search the repos whose path contains this")
+	limit := flags.Int("limit", defaultSearchLimit, "The number of results")
+	asJson := flags.Bool("json", false, "Print the results as JSON lines")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+
+	positional, err := parseCommandArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) < 2 {
+		flags.Usage()
+		return usage
+	}
+
+	config, err := (&FileConfigReader{}).Read(positional[0])
+	if err != nil {
+		return fmt.Errorf("unable to read the config file. Err: %v", err)
+	}
+	query := ParseSearchQuery(strings.Join(positional[1:], " "))
+	if *pathFilter != "" {
+		query.Paths = append(query.Paths, *pathFilter)
+	}
+	if *repoFilter != "" {
+		query.Repos = append(query.Repos, expandPath(*repoFilter))
+	}
+	query.Limit = *limit
+
+	results, err := Search(ctx, config.Repos, query)
+	if err != nil {
+		return err
+	}
+	for _, result := range results {
+		if *asJson {
+			line, err := json.Marshal(result)
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(line))
+		} else {
+			fmt.Println(result)
+		}
+	}
+	return nil
+}
+
+// cryptCommand implements the filter, diff and merge drivers of the encrypted-repo mode. Git runs them in the root of
+// the repo. See SetupEncryption.
+func cryptCommand(args []string) error {
+	ctx := context.Background()
+	usage := fmt.Errorf("usage: git-notes crypt keygen <key-file> | clean | smudge | textconv <file> | merge <base> <current> <other> [marker-size]")
+	if len(args) == 0 {
+		return usage
+	}
+
+	switch args[0] {
+	case "keygen":
+		if len(args) != 2 {
+			return usage
+		}
+		return GenerateKey(expandPath(args[1]))
+	case "clean", "smudge":
+		c, err := loadCipher(ctx, ".")
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+
+		if args[0] == "clean" {
+			_, err = os.Stdout.Write(c.Encrypt(data))
+			return err
+		}
+		plaintext, err := c.Decrypt(data)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(plaintext)
+		return err
+	case "textconv":
+		if len(args) != 2 {
+			return usage
+		}
+		c, err := loadCipher(ctx, ".")
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(args[1])
+		if err != nil {
+			return err
+		}
+		plaintext, err := c.Decrypt(data)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(plaintext)
+		return err
+	case "merge":
+		if len(args) != 4 && len(args) != 5 {
+			return usage
+		}
+		markerSize := ""
+		if len(args) == 5 {
+			markerSize = args[4]
+		}
+		conflicted, err := MergeEncrypted(ctx, ".", args[1], args[2], args[3], markerSize)
+		if err != nil {
+			return err
+		}
+		if conflicted {
+			return fmt.Errorf("the plaintext merge has conflicts")
+		}
+		return nil
+	default:
+		return usage
+	}
+}
@@ -2,11 +2,168 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	Repos []string `json:"Repos"`
+	Repos    []string              `json:"Repos" yaml:"repos" toml:"repos"`
+	Settings map[string]RepoConfig `json:"Settings" yaml:"settings" toml:"settings"`
+	Timeouts TimeoutsConfig        `json:"Timeouts" yaml:"timeouts" toml:"timeouts"`
+	Health   HealthConfig          `json:"Health" yaml:"health" toml:"health"`
+	Relay    RelayConfig           `json:"Relay" yaml:"relay" toml:"relay"`
+	Peers    PeersConfig           `json:"Peers" yaml:"peers" toml:"peers"`
+}
+
+// TimeoutsConfig limits how long a subprocess can run before it's killed. The durations are written like `30s` or
+// `5m`.
+type TimeoutsConfig struct {
+	// Local is for the commands that don't talk to the remote, e.g. `git add`, `git commit` and the hooks. It
+	// defaults to 2m.
+	Local string `json:"Local" yaml:"local" toml:"local"`
+	// Remote is for the fetches, the pushes and the LFS uploads. It defaults to 10m.
+	Remote string `json:"Remote" yaml:"remote" toml:"remote"`
+}
+
+// Parse returns the timeouts, or the defaults for the ones that aren't set.
+func (t TimeoutsConfig) Parse() (local time.Duration, remote time.Duration, err error) {
+	local, remote = defaultLocalTimeout, defaultRemoteTimeout
+	for _, timeout := range []struct {
+		value  string
+		result *time.Duration
+	}{{t.Local, &local}, {t.Remote, &remote}} {
+		if timeout.value == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(timeout.value)
+		if err != nil || parsed <= 0 {
+			return 0, 0, fmt.Errorf("invalid timeout: %s", timeout.value)
+		}
+		*timeout.result = parsed
+	}
+	return local, remote, nil
+}
+
+// RepoConfig holds the settings of one repo. It is keyed by the repo path in `Config.Settings`, and repos without
+// an entry use the zero value.
+type RepoConfig struct {
+	// Mode is `active` (default), `paused`, `commit-only`, `pull-only` or `mirror`. `git-notes mode <repo> <mode>`
+	// overrides it.
+	Mode        string            `json:"Mode" yaml:"mode" toml:"mode"`
+	Hooks       HooksConfig       `json:"Hooks" yaml:"hooks" toml:"hooks"`
+	Encryption  EncryptionConfig  `json:"Encryption" yaml:"encryption" toml:"encryption"`
+	LargeFiles  LargeFilesConfig  `json:"LargeFiles" yaml:"largeFiles" toml:"largeFiles"`
+	Schedule    ScheduleConfig    `json:"Schedule" yaml:"schedule" toml:"schedule"`
+	Deletions   DeletionsConfig   `json:"Deletions" yaml:"deletions" toml:"deletions"`
+	Signing     SigningConfig     `json:"Signing" yaml:"signing" toml:"signing"`
+	Credentials CredentialsConfig `json:"Credentials" yaml:"credentials" toml:"credentials"`
+	// Submodules syncs the submodules first: their changes are committed and pushed in them, and then their new
+	// commits are committed in the repo.
+	Submodules bool `json:"Submodules" yaml:"submodules" toml:"submodules"`
+}
+
+// HooksConfig configures the checks that run on the staged files between `Add()` and `Commit()`.
+type HooksConfig struct {
+	// Secrets enables the built-in secret detectors.
+	Secrets bool `json:"Secrets" yaml:"secrets" toml:"secrets"`
+	// Commands are run in the repo with the staged file appended as the last argument. A non-zero exit is a hit.
+	Commands []string `json:"Commands" yaml:"commands" toml:"commands"`
+	// OnHit is either `block` (default), which leaves the file out of the commit, or `hold-push`, which commits the
+	// file but holds the push until `git-notes release <repo>` is run.
+	OnHit string `json:"OnHit" yaml:"onHit" toml:"onHit"`
+	// Notify is run with the message appended as the last argument when a hit is found, e.g. `notify-send git-notes`.
+	Notify string `json:"Notify" yaml:"notify" toml:"notify"`
+}
+
+// EncryptionConfig enables the encrypted-repo mode when either the key file or the key command is set.
+type EncryptionConfig struct {
+	// KeyFile holds the key in base64 or raw bytes. `git-notes crypt keygen <file>` makes one.
+	KeyFile string `json:"KeyFile" yaml:"keyFile" toml:"keyFile"`
+	// KeyCommand prints the key, e.g. `pass show git-notes`.
+	KeyCommand string `json:"KeyCommand" yaml:"keyCommand" toml:"keyCommand"`
+}
+
+func (e EncryptionConfig) Enabled() bool {
+	return e.KeyFile != "" || e.KeyCommand != ""
+}
+
+// LargeFilesConfig routes files through Git LFS.
+type LargeFilesConfig struct {
+	// Patterns are gitattributes patterns, e.g. `*.pdf`.
+	Patterns []string `json:"Patterns" yaml:"patterns" toml:"patterns"`
+	// Threshold is a size like `5MB`. Files above it are routed through Git LFS too.
+	Threshold string `json:"Threshold" yaml:"threshold" toml:"threshold"`
+}
+
+func (l LargeFilesConfig) Enabled() bool {
+	return len(l.Patterns) > 0 || l.Threshold != ""
+}
+
+// ScheduleConfig limits when the remote operations happen. The windows are written like `Mon-Fri 09:00-18:00`.
+// See Window.
+type ScheduleConfig struct {
+	// RemoteWindows are when fetches, merges and pushes are allowed. Without any, they are allowed at any time.
+	RemoteWindows []string `json:"RemoteWindows" yaml:"remoteWindows" toml:"remoteWindows"`
+	// QuietHours are when only local commits happen.
+	QuietHours []string `json:"QuietHours" yaml:"quietHours" toml:"quietHours"`
+	// UnmeteredWindows are when pushes are allowed even though the connection is flagged as metered with
+	// `git-notes metered on`.
+	UnmeteredWindows []string `json:"UnmeteredWindows" yaml:"unmeteredWindows" toml:"unmeteredWindows"`
+}
+
+// DeletionsConfig limits how many tracked files can be deleted in one commit before git-notes asks for a
+// confirmation with `git-notes confirm-deletions <repo>`. Zero uses the default, and a negative value disables the
+// limit.
+type DeletionsConfig struct {
+	// MaxFiles is the number of deleted files above which a confirmation is needed. It defaults to 20.
+	MaxFiles int `json:"MaxFiles" yaml:"maxFiles" toml:"maxFiles"`
+	// MaxPercent is the percentage of the tracked files above which a confirmation is needed. It defaults to 50.
+	MaxPercent int `json:"MaxPercent" yaml:"maxPercent" toml:"maxPercent"`
+}
+
+// SigningConfig signs the commits of git-notes. The format and the key default to `gpg.format` and `user.signingkey`
+// of the repo.
+type SigningConfig struct {
+	Enabled bool `json:"Enabled" yaml:"enabled" toml:"enabled"`
+	// Format is `openpgp`, `ssh` or `x509`.
+	Format string `json:"Format" yaml:"format" toml:"format"`
+	// Key is the GPG key id, or the path of the SSH public key.
+	Key string `json:"Key" yaml:"key" toml:"key"`
+}
+
+// CredentialsConfig picks the credentials of the fetches and pushes. git runs without prompts either way.
+type CredentialsConfig struct {
+	// SSHKey is the private key for SSH remotes.
+	SSHKey string `json:"SSHKey" yaml:"sshKey" toml:"sshKey"`
+	// Helper replaces the credential helpers for HTTPS remotes, e.g. `store --file ~/.git-notes-credentials`.
+	Helper string `json:"Helper" yaml:"helper" toml:"helper"`
+}
+
+// RepoSettings returns the settings of the repo. A submodule, which isn't a repo of the config itself, has the
+// settings of the innermost repo that contains it.
+func (c *Config) RepoSettings(path string) RepoConfig {
+	if c == nil {
+		return RepoConfig{}
+	}
+	if settings, ok := c.Settings[path]; ok {
+		return settings
+	}
+	outer := ""
+	for _, repo := range c.Repos {
+		if repo == path {
+			return RepoConfig{}
+		}
+		if strings.HasPrefix(path, repo+string(filepath.Separator)) && len(repo) > len(outer) {
+			outer = repo
+		}
+	}
+	return c.Settings[outer]
 }
 
 type ConfigReader interface {
@@ -18,6 +175,7 @@ type JsonConfigReader struct {}
 func (c *JsonConfigReader) Read(path string) (*Config, error) {
 	file, err := os.Open(path)
 	if err != nil {  return nil, err }
+	defer file.Close()
 
 	decoder := json.NewDecoder(file)
 
@@ -25,5 +183,188 @@ func (c *JsonConfigReader) Read(path string) (*Config, error) {
 	err = decoder.Decode(&config)
 	if err != nil {  return nil, err }
 
-	return &config, nil
+	return prepareConfig(&config)
+}
+
+type YamlConfigReader struct{}
+
+func (c *YamlConfigReader) Read(path string) (*Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var config Config
+	err = yaml.NewDecoder(file).Decode(&config)
+	if err != nil {
+		return nil, err
+	}
+
+	return prepareConfig(&config)
+}
+
+type TomlConfigReader struct{}
+
+func (c *TomlConfigReader) Read(path string) (*Config, error) {
+	var config Config
+	_, err := toml.DecodeFile(path, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	return prepareConfig(&config)
+}
+
+// FileConfigReader picks the reader from the extension of the config file. Unknown extensions are read as JSON,
+// which is the original format. A trailing `.example` is ignored, so `git-notes.yaml.example` is read as YAML.
+type FileConfigReader struct{}
+
+func (c *FileConfigReader) Read(path string) (*Config, error) {
+	return readerFor(path).Read(path)
+}
+
+func readerFor(path string) ConfigReader {
+	ext := strings.ToLower(filepath.Ext(strings.TrimSuffix(path, ".example")))
+
+	switch ext {
+	case ".yaml", ".yml":
+		return &YamlConfigReader{}
+	case ".toml":
+		return &TomlConfigReader{}
+	default:
+		return &JsonConfigReader{}
+	}
+}
+
+func prepareConfig(config *Config) (*Config, error) {
+	for i, repo := range config.Repos {
+		config.Repos[i] = expandPath(repo)
+	}
+
+	if config.Settings != nil {
+		settings := map[string]RepoConfig{}
+		for repo, repoConfig := range config.Settings {
+			if repoConfig.Encryption.KeyFile != "" {
+				repoConfig.Encryption.KeyFile = expandPath(repoConfig.Encryption.KeyFile)
+			}
+			if repoConfig.Credentials.SSHKey != "" {
+				repoConfig.Credentials.SSHKey = expandPath(repoConfig.Credentials.SSHKey)
+			}
+			if repoConfig.Signing.Format == "ssh" && repoConfig.Signing.Key != "" {
+				repoConfig.Signing.Key = expandPath(repoConfig.Signing.Key)
+			}
+			settings[expandPath(repo)] = repoConfig
+		}
+		config.Settings = settings
+	}
+
+	err := validateConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func validateConfig(config *Config) error {
+	if len(config.Repos) == 0 {
+		return fmt.Errorf("no repos are configured")
+	}
+
+	seen := map[string]bool{}
+	for i, repo := range config.Repos {
+		if strings.TrimSpace(repo) == "" {
+			return fmt.Errorf("the repo at index %d has an empty path", i)
+		}
+		if seen[repo] {
+			return fmt.Errorf("the repo %s is listed more than once", repo)
+		}
+		seen[repo] = true
+	}
+
+	_, _, err := config.Timeouts.Parse()
+	if err != nil {
+		return err
+	}
+	_, err = config.Health.ParseThreshold(config.Timeouts)
+	if err != nil {
+		return err
+	}
+	err = config.Relay.Validate()
+	if err != nil {
+		return err
+	}
+	err = config.Peers.Validate()
+	if err != nil {
+		return err
+	}
+
+	for repo, repoConfig := range config.Settings {
+		if !seen[repo] {
+			return fmt.Errorf("the settings of %s are given, but it is not in repos", repo)
+		}
+		err := validateRepoConfig(repoConfig)
+		if err != nil {
+			return fmt.Errorf("the settings of %s are invalid. Err: %v", repo, err)
+		}
+	}
+
+	return nil
+}
+
+func validateRepoConfig(repoConfig RepoConfig) error {
+	err := validateMode(repoConfig.Mode)
+	if err != nil {
+		return err
+	}
+
+	switch repoConfig.Hooks.OnHit {
+	case "", OnHitBlock, OnHitHoldPush:
+	default:
+		return fmt.Errorf("unknown onHit: %s", repoConfig.Hooks.OnHit)
+	}
+
+	if repoConfig.Encryption.KeyFile != "" && repoConfig.Encryption.KeyCommand != "" {
+		return fmt.Errorf("only one of keyFile and keyCommand can be set")
+	}
+
+	if repoConfig.LargeFiles.Threshold != "" {
+		_, err := ParseSize(repoConfig.LargeFiles.Threshold)
+		if err != nil {
+			return err
+		}
+	}
+	err = validateSchedule(repoConfig.Schedule)
+	if err != nil {
+		return err
+	}
+
+	switch repoConfig.Signing.Format {
+	case "", "openpgp", "ssh", "x509":
+	default:
+		return fmt.Errorf("unknown signing format: %s", repoConfig.Signing.Format)
+	}
+
+	if repoConfig.Deletions.MaxPercent > 100 {
+		return fmt.Errorf("maxPercent can't be above 100")
+	}
+
+	if repoConfig.LargeFiles.Enabled() && repoConfig.Encryption.Enabled() {
+		// Both need the filter attribute of the files.
+		return fmt.Errorf("large files can't be routed through Git LFS in an encrypted repo")
+	}
+
+	return nil
+}
+
+// expandPath expands a leading `~` to the home directory and `$VAR`/`${VAR}` to environment variables.
+func expandPath(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		home, err := os.UserHomeDir()
+		if err == nil {
+			path = home + strings.TrimPrefix(path, "~")
+		}
+	}
+
+	return os.ExpandEnv(path)
 }
@@ -1,10 +1,17 @@
 package main
 
 import (
-	"github.com/stretchr/testify/assert"
+	"git-notes/internal/test_helpers"
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
+var exampleRepos = []string{"/Users/tanin/projects/personal-notes", "/Users/tanin/projects/another-personal-notes"}
+
 func TestJsonConfigReader_Read(t *testing.T) {
 	reader := JsonConfigReader{}
 	config, err := reader.Read("./git-notes.json.example")
@@ -12,3 +19,149 @@ func TestJsonConfigReader_Read(t *testing.T) {
 
 	assert.Equal(t, []string{"/Users/tanin/projects/personal-notes", "/Users/tanin/projects/another-personal-notes"}, config.Repos)
 }
+
+func TestYamlConfigReader_Read(t *testing.T) {
+	reader := YamlConfigReader{}
+	config, err := reader.Read("./git-notes.yaml.example")
+	assert.NoError(t, err)
+
+	assert.Equal(t, exampleRepos, config.Repos)
+}
+
+func TestTomlConfigReader_Read(t *testing.T) {
+	reader := TomlConfigReader{}
+	config, err := reader.Read("./git-notes.toml.example")
+	assert.NoError(t, err)
+
+	assert.Equal(t, exampleRepos, config.Repos)
+}
+
+func TestFileConfigReader_Read(t *testing.T) {
+	reader := FileConfigReader{}
+
+	for _, path := range []string{"./git-notes.json.example", "./git-notes.yaml.example", "./git-notes.toml.example"} {
+		config, err := reader.Read(path)
+		assert.NoError(t, err)
+		assert.Equal(t, exampleRepos, config.Repos)
+	}
+}
+
+func TestReaderFor(t *testing.T) {
+	assert.IsType(t, &JsonConfigReader{}, readerFor("git-notes.json"))
+	assert.IsType(t, &JsonConfigReader{}, readerFor("git-notes"))
+	assert.IsType(t, &YamlConfigReader{}, readerFor("git-notes.yaml"))
+	assert.IsType(t, &YamlConfigReader{}, readerFor("git-notes.YML"))
+	assert.IsType(t, &TomlConfigReader{}, readerFor("git-notes.toml"))
+	assert.IsType(t, &TomlConfigReader{}, readerFor("git-notes.toml.example"))
+}
+
+func TestConfigReader_ExpandPaths(t *testing.T) {
+	configDir, err := ioutil.TempDir("", "git-notes-config-dir")
+	assert.NoError(t, err)
+	defer test_helpers.CleanupRepo(configDir)
+
+	home, err := os.UserHomeDir()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Setenv("GIT_NOTES_TEST_DIR", "/some/dir"))
+	defer os.Unsetenv("GIT_NOTES_TEST_DIR")
+
+	test_helpers.WriteFile(t, configDir, "git-notes.yaml", "repos:\n  - ~/notes\n  - $GIT_NOTES_TEST_DIR/notes\n  - ${HOME}/other\n")
+
+	reader := FileConfigReader{}
+	config, err := reader.Read(configDir + "/git-notes.yaml")
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{home + "/notes", "/some/dir/notes", home + "/other"}, config.Repos)
+}
+
+func TestConfigReader_Validate(t *testing.T) {
+	configDir, err := ioutil.TempDir("", "git-notes-config-dir")
+	assert.NoError(t, err)
+	defer test_helpers.CleanupRepo(configDir)
+
+	test_helpers.WriteFile(t, configDir, "empty.json", `{ "repos": [] }`)
+	test_helpers.WriteFile(t, configDir, "empty.yaml", "repos: []\n")
+	test_helpers.WriteFile(t, configDir, "empty.toml", "repos = []\n")
+	test_helpers.WriteFile(t, configDir, "blank.json", `{ "repos": [ "/notes", " " ] }`)
+	test_helpers.WriteFile(t, configDir, "blank.yaml", "repos:\n  - /notes\n  - ' '\n")
+	test_helpers.WriteFile(t, configDir, "blank.toml", "repos = [ \"/notes\", \" \" ]\n")
+	test_helpers.WriteFile(t, configDir, "duplicate.json", `{ "repos": [ "/notes", "/notes" ] }`)
+	test_helpers.WriteFile(t, configDir, "timeouts.json", `{ "repos": [ "/notes" ], "timeouts": { "remote": "soon" } }`)
+	test_helpers.WriteFile(t, configDir, "duplicate.yaml", "repos:\n  - /notes\n  - /notes\n")
+	test_helpers.WriteFile(t, configDir, "duplicate.toml", "repos = [ \"/notes\", \"/notes\" ]\n")
+
+	reader := FileConfigReader{}
+	for _, ext := range []string{"json", "yaml", "toml"} {
+		_, err = reader.Read(configDir + "/empty." + ext)
+		assert.EqualError(t, err, "no repos are configured")
+
+		_, err = reader.Read(configDir + "/blank." + ext)
+		assert.EqualError(t, err, "the repo at index 1 has an empty path")
+
+		_, err = reader.Read(configDir + "/duplicate." + ext)
+		assert.EqualError(t, err, "the repo /notes is listed more than once")
+	}
+
+	_, err = reader.Read(configDir + "/timeouts.json")
+	assert.EqualError(t, err, "invalid timeout: soon")
+}
+
+func TestTimeoutsConfig_Parse(t *testing.T) {
+	local, remote, err := TimeoutsConfig{}.Parse()
+	assert.NoError(t, err)
+	assert.Equal(t, defaultLocalTimeout, local)
+	assert.Equal(t, defaultRemoteTimeout, remote)
+
+	local, remote, err = TimeoutsConfig{Local: "30s", Remote: "1h"}.Parse()
+	assert.NoError(t, err)
+	assert.Equal(t, 30*time.Second, local)
+	assert.Equal(t, time.Hour, remote)
+
+	_, _, err = TimeoutsConfig{Local: "-1s"}.Parse()
+	assert.EqualError(t, err, "invalid timeout: -1s")
+}
+
+func TestConfigReader_Settings(t *testing.T) {
+	configDir, err := ioutil.TempDir("", "git-notes-config-dir")
+	assert.NoError(t, err)
+	defer test_helpers.CleanupRepo(configDir)
+
+	home, err := os.UserHomeDir()
+	assert.NoError(t, err)
+
+	test_helpers.WriteFile(t, configDir, "git-notes.yaml", "repos:\n  - ~/notes\n  - /other\nsettings:\n  ~/notes:\n    hooks:\n      secrets: true\n      onHit: hold-push\n")
+	test_helpers.WriteFile(t, configDir, "git-notes.toml", "repos = [ \"~/notes\", \"/other\" ]\n[settings.\"~/notes\".hooks]\nsecrets = true\nonHit = \"hold-push\"\n")
+	test_helpers.WriteFile(t, configDir, "git-notes.json", `{ "repos": [ "~/notes", "/other" ], "settings": { "~/notes": { "hooks": { "secrets": true, "onHit": "hold-push" } } } }`)
+	test_helpers.WriteFile(t, configDir, "unknown.json", `{ "repos": [ "/notes" ], "settings": { "/other": {} } }`)
+	test_helpers.WriteFile(t, configDir, "invalid.json", `{ "repos": [ "/notes" ], "settings": { "/notes": { "hooks": { "onHit": "explode" } } } }`)
+	test_helpers.WriteFile(t, configDir, "signing.json", `{ "repos": [ "/notes" ], "settings": { "/notes": { "signing": { "enabled": true, "format": "pgp" } } } }`)
+	test_helpers.WriteFile(t, configDir, "deletions.json", `{ "repos": [ "/notes" ], "settings": { "/notes": { "deletions": { "maxPercent": 150 } } } }`)
+	test_helpers.WriteFile(t, configDir, "mode.json", `{ "repos": [ "/notes" ], "settings": { "/notes": { "mode": "sleeping" } } }`)
+
+	reader := FileConfigReader{}
+	for _, ext := range []string{"json", "yaml", "toml"} {
+		config, err := reader.Read(configDir + "/git-notes." + ext)
+		assert.NoError(t, err)
+
+		assert.Equal(t, HooksConfig{Secrets: true, OnHit: OnHitHoldPush}, config.RepoSettings(home+"/notes").Hooks)
+		assert.Equal(t, RepoConfig{}, config.RepoSettings("/other"))
+		// A submodule has the settings of its repo.
+		assert.Equal(t, HooksConfig{Secrets: true, OnHit: OnHitHoldPush}, config.RepoSettings(home+"/notes/team").Hooks)
+		assert.Equal(t, RepoConfig{}, config.RepoSettings(home+"/notes-old"))
+	}
+
+	_, err = reader.Read(configDir + "/unknown.json")
+	assert.EqualError(t, err, "the settings of /other are given, but it is not in repos")
+
+	_, err = reader.Read(configDir + "/invalid.json")
+	assert.EqualError(t, err, "the settings of /notes are invalid. Err: unknown onHit: explode")
+
+	_, err = reader.Read(configDir + "/signing.json")
+	assert.EqualError(t, err, "the settings of /notes are invalid. Err: unknown signing format: pgp")
+
+	_, err = reader.Read(configDir + "/deletions.json")
+	assert.EqualError(t, err, "the settings of /notes are invalid. Err: maxPercent can't be above 100")
+
+	_, err = reader.Read(configDir + "/mode.json")
+	assert.EqualError(t, err, "the settings of /notes are invalid. Err: unknown mode: sleeping")
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"git-notes/internal/test_helpers"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// syncTracker tells the scenario when a sync of the monitor has finished.
+type syncTracker struct {
+	Git
+	done chan error
+}
+
+func (s *syncTracker) SyncContext(ctx context.Context, path string) error {
+	err := s.Git.SyncContext(ctx, path)
+	s.done <- err
+	return err
+}
+
+type machine struct {
+	path    string
+	git     *syncTracker
+	watcher *MockWatcher
+	monitor *GitRepoMonitor
+}
+
+// startMachines runs a real GitRepoMonitor on every clone. The syncs are triggered either through the watcher
+// channel or by advancing the clock past the scheduled update.
+func startMachines(machines test_helpers.Machines, clock *test_helpers.FakeClock) []*machine {
+	var started []*machine
+	for _, clone := range machines.Clones {
+		m := &machine{
+			path:    clone,
+			git:     &syncTracker{Git: &GitCmd{clock: clock}, done: make(chan error, 100)},
+			watcher: &MockWatcher{},
+			monitor: &GitRepoMonitor{scheduledUpdateInterval: 5 * time.Minute, clock: clock},
+		}
+		m.monitor.StartMonitoring(clone, m.watcher, m.git)
+		<-m.git.done
+
+		started = append(started, m)
+	}
+	return started
+}
+
+// stopMachines ends the monitors, so their goroutines and scheduled updates don't outlive the scenario.
+func stopMachines(started []*machine) {
+	for _, m := range started {
+		m.monitor.Stop()
+	}
+}
+
+// The scenarios are the same on every run, unless GIT_NOTES_SCENARIO_SEED picks another seed, or `random` for a new
+// one on every run.
+const defaultScenarioSeed = 20210607
+
+func scenarioSeed(t *testing.T) int64 {
+	switch value := os.Getenv("GIT_NOTES_SCENARIO_SEED"); value {
+	case "":
+		return defaultScenarioSeed
+	case "random":
+		return time.Now().UnixNano()
+	default:
+		seed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			t.Fatalf("invalid GIT_NOTES_SCENARIO_SEED: %s", value)
+		}
+		return seed
+	}
+}
+
+// runScenario makes every machine edit its clone and sync at the same time, round after round. It then lets the
+// scheduled updates run until the clones converge.
+func runScenario(t *testing.T, machineCount int, rounds int, stepsPerRound int) {
+	machines := test_helpers.SetupMachines(machineCount, 2)
+	defer test_helpers.CleanupMachines(machines)
+
+	seed := scenarioSeed(t)
+	t.Logf("Scenario seed: %d. Rerun it with GIT_NOTES_SCENARIO_SEED=%d", seed, seed)
+
+	scenario := test_helpers.NewScenario(machines, seed)
+	clock := test_helpers.NewFakeClock(time.Now())
+	started := startMachines(machines, clock)
+	defer stopMachines(started)
+
+	for round := 0; round < rounds; round++ {
+		var wait sync.WaitGroup
+		for i, m := range started {
+			wait.Add(1)
+			go func(i int, m *machine) {
+				defer wait.Done()
+				for step := 0; step < stepsPerRound; step++ {
+					scenario.Step(t, i)
+				}
+				m.watcher.channel <- m.path
+				<-m.git.done
+			}(i, m)
+		}
+		wait.Wait()
+	}
+
+	converged, reason := test_helpers.Converged(machines)
+	for attempt := 0; attempt < 3*machineCount && !converged; attempt++ {
+		clock.Advance(5 * time.Minute)
+		for _, m := range started {
+			<-m.git.done
+		}
+		converged, reason = test_helpers.Converged(machines)
+	}
+
+	if !assert.True(t, converged, reason) {
+		return
+	}
+	for _, m := range started {
+		scenario.AssertNoLostEdits(t, m.path)
+	}
+}
+
+func TestConvergence_TwoMachines(t *testing.T) {
+	runScenario(t, 2, 6, 3)
+}
+
+func TestConvergence_ManyMachines(t *testing.T) {
+	runScenario(t, 4, 5, 2)
+}
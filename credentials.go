@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const authFailedName = "auth-failed"
+
+// The output of git, ssh and the Git hosts when the credentials are missing or wrong.
+var authFailures = []string{
+	"permission denied (publickey",
+	"host key verification failed",
+	"authentication failed",
+	"could not read username",
+	"could not read password",
+	"terminal prompts disabled",
+	"access denied",
+	"invalid username or password",
+	"the requested url returned error: 401",
+	"the requested url returned error: 403",
+}
+
+// AuthError is returned when the remote rejects the credentials. Retrying doesn't help until they're fixed.
+type AuthError struct {
+	Output string
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("the remote rejected the credentials: %s", strings.TrimSpace(e.Output))
+}
+
+func isAuthFailure(output string) bool {
+	output = strings.ToLower(output)
+	for _, failure := range authFailures {
+		if strings.Contains(output, failure) {
+			return true
+		}
+	}
+	return false
+}
+
+// sshCommand runs ssh in batch mode, so it fails instead of asking for a passphrase or a password.
+func sshCommand(ctx context.Context, path string, credentials CredentialsConfig) string {
+	command := os.Getenv("GIT_SSH_COMMAND")
+	if command == "" {
+		configured, err := runCmdStdout(ctx, path, "git", "config", "core.sshCommand")
+		command = strings.TrimSpace(configured)
+		if err != nil || command == "" {
+			command = "ssh"
+		}
+	}
+
+	command += " -o BatchMode=yes"
+	if credentials.SSHKey != "" {
+		command += " -i " + shellQuote(credentials.SSHKey) + " -o IdentitiesOnly=yes"
+	}
+	return command
+}
+
+// runRemoteCmd runs a git command that talks to the remote without any prompt. A rejection of the credentials is
+// returned as an AuthError.
+func runRemoteCmd(ctx context.Context, path string, credentials CredentialsConfig, args ...string) (string, error) {
+	if credentials.Helper != "" {
+		// The empty helper drops the helpers of the user and system config.
+		args = append([]string{"-c", "credential.helper=", "-c", "credential.helper=" + credentials.Helper}, args...)
+	}
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = path
+	cmd.Env = append(os.Environ(),
+		"GIT_TERMINAL_PROMPT=0",
+		"GCM_INTERACTIVE=never",
+		"GIT_SSH_COMMAND="+sshCommand(ctx, path, credentials),
+	)
+
+	out, err := combinedOutputTimeout(ctx, cmd, remoteTimeout(ctx))
+	if err != nil && !IsTimeout(err) && isAuthFailure(string(out)) {
+		return string(out), &AuthError{Output: string(out)}
+	}
+	return string(out), err
+}
+
+// SetAuthFailed stops the remote operations of the repo until `git-notes retry <repo>` is run.
+func SetAuthFailed(ctx context.Context, path string, authErr *AuthError, at time.Time) error {
+	log.Printf("Stopping the remote operations of %s. Err: %v", path, authErr)
+	return writeStateFile(ctx, path, authFailedName, fmt.Sprintf("%s\n%s", at.Format(time.RFC3339), authErr.Output))
+}
+
+func IsAuthFailed(ctx context.Context, path string) (bool, error) {
+	return stateFileExists(ctx, path, authFailedName)
+}
+
+func RetryAuth(ctx context.Context, path string) error {
+	failed, err := IsAuthFailed(ctx, path)
+	if err != nil {
+		return err
+	}
+	if !failed {
+		return fmt.Errorf("the credentials of %s didn't fail", path)
+	}
+	return removeStateFile(ctx, path, authFailedName)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"git-notes/internal/test_helpers"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rejectingSsh makes the repo use an ssh that records its environment and arguments, and rejects every key.
+func rejectingSsh(t *testing.T, path string) (string, func()) {
+	dir, err := ioutil.TempDir("", "git-notes-ssh")
+	assert.NoError(t, err)
+
+	calls := filepath.Join(dir, "calls")
+	script := filepath.Join(dir, "ssh")
+	content := fmt.Sprintf("#!/bin/sh\necho \"$GIT_TERMINAL_PROMPT $*\" >> %s\necho 'git@example.com: Permission denied (publickey).' >&2\nexit 255\n", calls)
+	assert.NoError(t, ioutil.WriteFile(script, []byte(content), 0755))
+
+	test_helpers.PerformCmd(t, path, "git", "config", "core.sshCommand", script)
+	return calls, func() { _ = os.RemoveAll(dir) }
+}
+
+func sshCalls(t *testing.T, calls string) []string {
+	content, err := ioutil.ReadFile(calls)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	assert.NoError(t, err)
+	return strings.Split(strings.TrimSpace(string(content)), "\n")
+}
+
+func TestIsAuthFailure(t *testing.T) {
+	assert.True(t, isAuthFailure("git@github.com: Permission denied (publickey)."))
+	assert.True(t, isAuthFailure("fatal: could not read Username for 'https://github.com': terminal prompts disabled"))
+	assert.True(t, isAuthFailure("fatal: Authentication failed for 'https://gitlab.com/notes.git/'"))
+	assert.False(t, isAuthFailure("fatal: unable to access 'https://github.com/': Could not resolve host: github.com"))
+}
+
+func TestSshCommand(t *testing.T) {
+	path := test_helpers.SetupGitRepo("credentials", false)
+	defer test_helpers.CleanupRepo(path)
+
+	assert.Equal(t, "ssh -o BatchMode=yes", sshCommand(context.Background(), path, CredentialsConfig{}))
+	assert.Equal(t, "ssh -o BatchMode=yes -i '/keys/notes key' -o IdentitiesOnly=yes", sshCommand(context.Background(), path, CredentialsConfig{SSHKey: "/keys/notes key"}))
+
+	test_helpers.PerformCmd(t, path, "git", "config", "core.sshCommand", "ssh -p 2222")
+	assert.Equal(t, "ssh -p 2222 -o BatchMode=yes", sshCommand(context.Background(), path, CredentialsConfig{}))
+}
+
+func TestCredentials_FetchRejected(t *testing.T) {
+	path := test_helpers.SetupGitRepo("credentials", false)
+	defer test_helpers.CleanupRepo(path)
+	calls, cleanupSsh := rejectingSsh(t, path)
+	defer cleanupSsh()
+	test_helpers.PerformCmd(t, path, "git", "remote", "add", "origin", "ssh://git@example.com/notes.git")
+	git := gitWithSettings(RepoConfig{Credentials: CredentialsConfig{SSHKey: "/keys/notes"}}, path)
+
+	test_helpers.WriteFile(t, path, "test.md", "TestContent")
+	assert.NoError(t, git.Sync(path))
+
+	// The change is committed locally, and git ran without prompts.
+	assertState(t, path, AuthFailed)
+	assert.NotEmpty(t, head(context.Background(), path))
+	if assert.Len(t, sshCalls(t, calls), 1) {
+		assert.True(t, strings.HasPrefix(sshCalls(t, calls)[0], "0 -o BatchMode=yes -i /keys/notes -o IdentitiesOnly=yes"))
+	}
+
+	// Nothing is retried until the credentials are fixed.
+	test_helpers.WriteFile(t, path, "test.md", "TestContent2")
+	assert.NoError(t, git.Sync(path))
+	assert.Len(t, sshCalls(t, calls), 1)
+	assertState(t, path, AuthFailed)
+
+	assert.NoError(t, RetryAuth(context.Background(), path))
+	assert.Error(t, RetryAuth(context.Background(), path))
+	assert.NoError(t, git.Sync(path))
+	assert.Len(t, sshCalls(t, calls), 2)
+}
+
+func TestCredentials_PushRejected(t *testing.T) {
+	repos := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(repos)
+	_, cleanupSsh := rejectingSsh(t, repos.Local)
+	defer cleanupSsh()
+	test_helpers.PerformCmd(t, repos.Local, "git", "remote", "set-url", "--push", "origin", "ssh://git@example.com/notes.git")
+	git := &GitCmd{}
+
+	test_helpers.WriteFile(t, repos.Local, "test.md", "TestContent")
+	assert.NoError(t, git.Sync(repos.Local))
+
+	assertState(t, repos.Local, AuthFailed)
+	assert.Empty(t, remoteFiles(t, repos))
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Encrypted blobs start with this header, followed by the HMAC-SHA256 of the plaintext and the AES-256-CTR
+// ciphertext. The HMAC doubles as the IV, so the same plaintext always gives the same blob and unchanged files
+// never produce new blobs.
+const encryptedHeader = "\x00GITNOTES-ENC1\x00"
+
+const (
+	cryptDriver = "git-notes"
+	tagSize     = sha256.Size
+)
+
+// The attributes live in `.git/info/attributes`, so they are never committed and cover `.gitattributes` too.
+const cryptAttributes = "* filter=" + cryptDriver + " diff=" + cryptDriver + " merge=" + cryptDriver + "\n"
+
+// encryptionSetting marks the repos that SetupEncryption set up, so TeardownEncryption only undoes its own setup.
+const encryptionSetting = cryptDriver + ".encryption"
+
+type Cipher struct {
+	encKey []byte
+	macKey []byte
+}
+
+func NewCipher(secret []byte) (*Cipher, error) {
+	if len(secret) < 16 {
+		return nil, fmt.Errorf("the key is too short. It needs at least 16 bytes")
+	}
+
+	return &Cipher{
+		encKey: deriveKey(secret, "git-notes encryption"),
+		macKey: deriveKey(secret, "git-notes authentication"),
+	}, nil
+}
+
+func deriveKey(secret []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encryptedHeader))
+}
+
+func (c *Cipher) Encrypt(plaintext []byte) []byte {
+	if IsEncrypted(plaintext) {
+		return plaintext
+	}
+
+	tag := c.tag(plaintext)
+	out := make([]byte, len(encryptedHeader)+tagSize+len(plaintext))
+	copy(out, encryptedHeader)
+	copy(out[len(encryptedHeader):], tag)
+	c.stream(tag).XORKeyStream(out[len(encryptedHeader)+tagSize:], plaintext)
+	return out
+}
+
+// Decrypt returns data that isn't encrypted as it is, so files committed before the encryption was enabled can
+// still be read.
+func (c *Cipher) Decrypt(data []byte) ([]byte, error) {
+	if !IsEncrypted(data) {
+		return data, nil
+	}
+	if len(data) < len(encryptedHeader)+tagSize {
+		return nil, fmt.Errorf("the encrypted data is truncated")
+	}
+
+	tag := data[len(encryptedHeader) : len(encryptedHeader)+tagSize]
+	ciphertext := data[len(encryptedHeader)+tagSize:]
+	plaintext := make([]byte, len(ciphertext))
+	c.stream(tag).XORKeyStream(plaintext, ciphertext)
+
+	if !hmac.Equal(tag, c.tag(plaintext)) {
+		return nil, fmt.Errorf("unable to decrypt. The key is wrong or the data is corrupted")
+	}
+	return plaintext, nil
+}
+
+func (c *Cipher) tag(plaintext []byte) []byte {
+	mac := hmac.New(sha256.New, c.macKey)
+	mac.Write(plaintext)
+	return mac.Sum(nil)
+}
+
+func (c *Cipher) stream(tag []byte) cipher.Stream {
+	block, err := aes.NewCipher(c.encKey)
+	if err != nil {
+		// The derived key always has a valid size.
+		panic(err)
+	}
+	return cipher.NewCTR(block, tag[:aes.BlockSize])
+}
+
+// GenerateKey writes a new random key to the file. It refuses to overwrite an existing key.
+func GenerateKey(file string) error {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = out.WriteString(base64.StdEncoding.EncodeToString(key) + "\n")
+	return err
+}
+
+// LoadKey reads the key of the repo from the key file or the key command in its git config. A key file holds
+// either base64 or raw bytes. A key command, e.g. `pass show git-notes`, prints the key.
+func LoadKey(ctx context.Context, path string) ([]byte, error) {
+	keyFile, _ := runCmdStdout(ctx, path, "git", "config", "--get", cryptDriver+".keyFile")
+	keyCommand, _ := runCmdStdout(ctx, path, "git", "config", "--get", cryptDriver+".keyCommand")
+
+	var key []byte
+	var err error
+	if keyFile = strings.TrimSpace(keyFile); keyFile != "" {
+		key, err = ioutil.ReadFile(expandPath(keyFile))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the key file. Err: %v", err)
+		}
+	} else if keyCommand = strings.TrimSpace(keyCommand); keyCommand != "" {
+		cmd := exec.Command("sh", "-c", keyCommand)
+		cmd.Dir = path
+		cmd.Stderr = os.Stderr
+		key, err = outputTimeout(ctx, cmd, localTimeout(ctx))
+		if err != nil {
+			return nil, fmt.Errorf("unable to get the key from `%s`. Err: %v", keyCommand, err)
+		}
+	} else {
+		return nil, fmt.Errorf("neither %s.keyFile nor %s.keyCommand is configured in %s", cryptDriver, cryptDriver, path)
+	}
+
+	key = bytes.TrimSpace(key)
+	if decoded, err := base64.StdEncoding.DecodeString(string(key)); err == nil {
+		return decoded, nil
+	}
+	return key, nil
+}
+
+func loadCipher(ctx context.Context, path string) (*Cipher, error) {
+	key, err := LoadKey(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return NewCipher(key)
+}
+
+// SetupEncryption configures the filter, diff and merge drivers that run `git-notes crypt`. The working tree stays
+// plaintext, the blobs are encrypted, and merges happen on the plaintext. When the encryption is enabled for the
+// first time, the encrypted files in the working tree (e.g. of a fresh clone) are decrypted and the plaintext files
+// are staged to be encrypted.
+func SetupEncryption(ctx context.Context, path string, encryption EncryptionConfig) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	command := shellQuote(exe) + " crypt"
+
+	for _, setting := range cryptSettings(command, encryption) {
+		if setting[1] == "" {
+			_, _ = runCmd(ctx, path, "git", "config", "--unset", setting[0])
+			continue
+		}
+		out, err := runCmd(ctx, path, "git", "config", setting[0], setting[1])
+		if err != nil {
+			return fmt.Errorf("unable to set %s. Err: %v, %s", setting[0], err, out)
+		}
+	}
+
+	attributesPath, existing, err := readInfoAttributes(ctx, path)
+	if err != nil {
+		return err
+	}
+	if strings.Contains(string(existing), cryptAttributes) {
+		return nil
+	}
+
+	// Check the key before anything is encrypted with it.
+	c, err := loadCipher(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(attributesPath), 0755)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(attributesPath, append(existing, []byte(cryptAttributes)...), 0644)
+	if err != nil {
+		return err
+	}
+
+	err = decryptWorkingTree(ctx, path, c)
+	if err != nil {
+		return err
+	}
+
+	out, err := runCmd(ctx, path, "git", "add", "--renormalize", ".")
+	if err != nil {
+		return fmt.Errorf("unable to encrypt the existing files. Err: %v, %s", err, out)
+	}
+	return nil
+}
+
+// TeardownEncryption undoes SetupEncryption once the encryption is removed from the config. The files are staged in
+// plaintext, so the next sync commits them in plaintext.
+func TeardownEncryption(ctx context.Context, path string) error {
+	_, err := runCmdStdout(ctx, path, "git", "config", "--get", encryptionSetting)
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		// Encryption was never set up.
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read %s. Err: %v", encryptionSetting, err)
+	}
+
+	// The files that were checked out without the filter are still encrypted. Without the key, they stay so.
+	c, err := loadCipher(ctx, path)
+	if err == nil {
+		err = decryptWorkingTree(ctx, path, c)
+	}
+	if err != nil {
+		log.Printf("Unable to decrypt the working tree of %s. Err: %v", path, err)
+	}
+
+	attributesPath, existing, err := readInfoAttributes(ctx, path)
+	if err != nil {
+		return err
+	}
+	if strings.Contains(string(existing), cryptAttributes) {
+		err = ioutil.WriteFile(attributesPath, []byte(strings.Replace(string(existing), cryptAttributes, "", 1)), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	out, err := runCmd(ctx, path, "git", "add", "--renormalize", ".")
+	if err != nil {
+		return fmt.Errorf("unable to decrypt the existing files. Err: %v, %s", err, out)
+	}
+
+	for _, setting := range cryptSettings("", EncryptionConfig{}) {
+		out, err := runCmd(ctx, path, "git", "config", "--unset", setting[0])
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 5 {
+			// It's not set.
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unable to unset %s. Err: %v, %s", setting[0], err, out)
+		}
+	}
+	return nil
+}
+
+// cryptSettings returns the git settings of the encryption, with the command of git-notes.
+func cryptSettings(command string, encryption EncryptionConfig) [][]string {
+	return [][]string{
+		{"filter." + cryptDriver + ".clean", command + " clean"},
+		{"filter." + cryptDriver + ".smudge", command + " smudge"},
+		{"filter." + cryptDriver + ".required", "true"},
+		{"diff." + cryptDriver + ".textconv", command + " textconv"},
+		{"merge." + cryptDriver + ".name", "git-notes plaintext merge"},
+		{"merge." + cryptDriver + ".driver", command + " merge %O %A %B %L"},
+		{cryptDriver + ".keyFile", encryption.KeyFile},
+		{cryptDriver + ".keyCommand", encryption.KeyCommand},
+		{encryptionSetting, "true"},
+	}
+}
+
+// readInfoAttributes returns the path and the content of `.git/info/attributes`, which might not exist.
+func readInfoAttributes(ctx context.Context, path string) (string, []byte, error) {
+	attributesPath, err := runCmdStdout(ctx, path, "git", "rev-parse", "--git-path", "info/attributes")
+	if err != nil {
+		return "", nil, err
+	}
+	attributesPath = strings.TrimSpace(attributesPath)
+	if !filepath.IsAbs(attributesPath) {
+		attributesPath = filepath.Join(path, attributesPath)
+	}
+
+	existing, err := ioutil.ReadFile(attributesPath)
+	if err != nil && !os.IsNotExist(err) {
+		return "", nil, err
+	}
+	return attributesPath, existing, nil
+}
+
+func decryptWorkingTree(ctx context.Context, path string, c *Cipher) error {
+	out, err := runCmdStdout(ctx, path, "git", "ls-files", "-z")
+	if err != nil {
+		return err
+	}
+
+	for _, file := range splitNul(out) {
+		fullPath := filepath.Join(path, file)
+		data, err := ioutil.ReadFile(fullPath)
+		if err != nil || !IsEncrypted(data) {
+			continue
+		}
+
+		plaintext, err := c.Decrypt(data)
+		if err != nil {
+			return fmt.Errorf("unable to decrypt %s. Err: %v", file, err)
+		}
+		err = ioutil.WriteFile(fullPath, plaintext, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MergeEncrypted is the merge driver. It gets the blobs as they are stored, merges their plaintext with
+// `git merge-file`, and writes the encrypted result to `current`. It returns true when there are conflicts.
+func MergeEncrypted(ctx context.Context, path string, base string, current string, other string, markerSize string) (bool, error) {
+	c, err := loadCipher(ctx, path)
+	if err != nil {
+		return false, err
+	}
+
+	dir, err := ioutil.TempDir("", "git-notes-merge")
+	if err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(dir)
+
+	var plainFiles []string
+	for i, file := range []string{current, base, other} {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return false, err
+		}
+		plaintext, err := c.Decrypt(data)
+		if err != nil {
+			return false, err
+		}
+
+		plainFile := filepath.Join(dir, fmt.Sprintf("%d", i))
+		err = ioutil.WriteFile(plainFile, plaintext, 0600)
+		if err != nil {
+			return false, err
+		}
+		plainFiles = append(plainFiles, plainFile)
+	}
+
+	args := []string{"merge-file", "-p", "-L", "HEAD", "-L", "base", "-L", "origin"}
+	if markerSize != "" {
+		args = append(args, "--marker-size="+markerSize)
+	}
+	cmd := exec.Command("git", append(args, plainFiles...)...)
+	cmd.Dir = path
+	cmd.Stderr = os.Stderr
+	merged, err := outputTimeout(ctx, cmd, localTimeout(ctx))
+
+	conflicted := false
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() > 0 && exitErr.ExitCode() < 128 {
+		// The exit code is the number of conflicts, and negative on errors.
+		conflicted = true
+	} else if err != nil {
+		return false, fmt.Errorf("unable to merge. Err: %v", err)
+	}
+
+	return conflicted, ioutil.WriteFile(current, c.Encrypt(merged), 0644)
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"git-notes/internal/test_helpers"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func setupKey(t *testing.T) (string, func()) {
+	keyDir, err := ioutil.TempDir("", "git-notes-key")
+	assert.NoError(t, err)
+
+	keyFile := filepath.Join(keyDir, "key")
+	assert.NoError(t, GenerateKey(keyFile))
+	assert.Error(t, GenerateKey(keyFile))
+
+	return keyFile, func() { test_helpers.CleanupRepo(keyDir) }
+}
+
+func cloneRepo(t *testing.T, remote string) string {
+	dir, err := ioutil.TempDir("", "git_test_clone")
+	assert.NoError(t, err)
+	test_helpers.PerformCmd(t, dir, "git", "clone", "-q", remote, "clone")
+	return filepath.Join(dir, "clone")
+}
+
+func remoteBlob(t *testing.T, repos test_helpers.Repos, file string) string {
+	branch := test_helpers.GetLocalBranch(repos.Local)
+	content, err := runCmdStdout(context.Background(), repos.Remote, "git", "show", fmt.Sprintf("%s:%s", branch, file))
+	assert.NoError(t, err)
+	return content
+}
+
+func TestCipher(t *testing.T) {
+	c, err := NewCipher([]byte("0123456789abcdef"))
+	assert.NoError(t, err)
+
+	encrypted := c.Encrypt([]byte("My notes"))
+	assert.True(t, IsEncrypted(encrypted))
+	assert.NotContains(t, string(encrypted), "My notes")
+	assert.Equal(t, encrypted, c.Encrypt([]byte("My notes")))
+	assert.NotEqual(t, encrypted, c.Encrypt([]byte("My notes2")))
+	assert.Equal(t, encrypted, c.Encrypt(encrypted))
+
+	decrypted, err := c.Decrypt(encrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, "My notes", string(decrypted))
+
+	plaintext, err := c.Decrypt([]byte("Not encrypted"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Not encrypted", string(plaintext))
+
+	other, err := NewCipher([]byte("fedcba9876543210"))
+	assert.NoError(t, err)
+	_, err = other.Decrypt(encrypted)
+	assert.EqualError(t, err, "unable to decrypt. The key is wrong or the data is corrupted")
+
+	_, err = NewCipher([]byte("short"))
+	assert.Error(t, err)
+}
+
+func TestEncryption_Sync(t *testing.T) {
+	repos := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(repos)
+	keyFile, cleanupKey := setupKey(t)
+	defer cleanupKey()
+
+	git := gitWithSettings(RepoConfig{Encryption: EncryptionConfig{KeyFile: keyFile}}, repos.Local)
+
+	test_helpers.WriteFile(t, repos.Local, "test.md", "Secret notes")
+	assert.NoError(t, git.Sync(repos.Local))
+	assertState(t, repos.Local, Sync)
+
+	blob := remoteBlob(t, repos, "test.md")
+	assert.True(t, IsEncrypted([]byte(blob)))
+	assert.NotContains(t, blob, "Secret notes")
+
+	content, err := ioutil.ReadFile(filepath.Join(repos.Local, "test.md"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Secret notes", string(content))
+
+	// Another machine with the same key sees the plaintext.
+	clone := cloneRepo(t, repos.Remote)
+	defer test_helpers.CleanupRepo(filepath.Dir(clone))
+
+	cloneGit := gitWithSettings(RepoConfig{Encryption: EncryptionConfig{KeyFile: keyFile}}, clone)
+	assert.NoError(t, cloneGit.Sync(clone))
+	assertState(t, clone, Sync)
+
+	content, err = ioutil.ReadFile(filepath.Join(clone, "test.md"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Secret notes", string(content))
+
+	// Unchanged files don't produce new blobs.
+	before, err := runCmdStdout(context.Background(), repos.Local, "git", "rev-parse", "HEAD:test.md")
+	assert.NoError(t, err)
+	test_helpers.WriteFile(t, repos.Local, "other.md", "Other notes")
+	assert.NoError(t, git.Sync(repos.Local))
+	after, err := runCmdStdout(context.Background(), repos.Local, "git", "rev-parse", "HEAD:test.md")
+	assert.NoError(t, err)
+	assert.Equal(t, before, after)
+}
+
+func TestEncryption_Disabled(t *testing.T) {
+	repos := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(repos)
+	keyFile, cleanupKey := setupKey(t)
+	defer cleanupKey()
+
+	git := gitWithSettings(RepoConfig{Encryption: EncryptionConfig{KeyFile: keyFile}}, repos.Local)
+	test_helpers.WriteFile(t, repos.Local, "test.md", "Secret notes")
+	assert.NoError(t, git.Sync(repos.Local))
+	assert.True(t, IsEncrypted([]byte(remoteBlob(t, repos, "test.md"))))
+
+	// Once the encryption is removed, the files are committed in plaintext.
+	git = gitWithSettings(RepoConfig{}, repos.Local)
+	assert.NoError(t, git.Sync(repos.Local))
+	assertState(t, repos.Local, Sync)
+	assert.Equal(t, "Secret notes", remoteBlob(t, repos, "test.md"))
+
+	_, existing, err := readInfoAttributes(context.Background(), repos.Local)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(existing), cryptAttributes)
+	for _, setting := range []string{"filter." + cryptDriver + ".clean", cryptDriver + ".keyFile", encryptionSetting} {
+		_, err := runCmdStdout(context.Background(), repos.Local, "git", "config", "--get", setting)
+		assert.Error(t, err, setting)
+	}
+
+	// The new files aren't encrypted either.
+	test_helpers.WriteFile(t, repos.Local, "other.md", "Other notes")
+	assert.NoError(t, git.Sync(repos.Local))
+	assert.Equal(t, "Other notes", remoteBlob(t, repos, "other.md"))
+}
+
+func TestEncryption_EncryptExistingFiles(t *testing.T) {
+	repos := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(repos)
+	keyFile, cleanupKey := setupKey(t)
+	defer cleanupKey()
+
+	test_helpers.WriteFile(t, repos.Local, "test.md", "Plain notes")
+	performSync(t, repos.Local)
+	assert.Equal(t, "Plain notes", remoteBlob(t, repos, "test.md"))
+
+	git := gitWithSettings(RepoConfig{Encryption: EncryptionConfig{KeyFile: keyFile}}, repos.Local)
+	assert.NoError(t, git.Sync(repos.Local))
+	assertState(t, repos.Local, Sync)
+
+	assert.True(t, IsEncrypted([]byte(remoteBlob(t, repos, "test.md"))))
+}
+
+func TestEncryption_ConflictOnPlaintext(t *testing.T) {
+	repos := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(repos)
+	keyFile, cleanupKey := setupKey(t)
+	defer cleanupKey()
+
+	git := gitWithSettings(RepoConfig{Encryption: EncryptionConfig{KeyFile: keyFile}}, repos.Local)
+	test_helpers.WriteFile(t, repos.Local, "test.md", "Line 1\nLine 2\nLine 3\n")
+	assert.NoError(t, git.Sync(repos.Local))
+
+	clone := cloneRepo(t, repos.Remote)
+	defer test_helpers.CleanupRepo(filepath.Dir(clone))
+	cloneGit := gitWithSettings(RepoConfig{Encryption: EncryptionConfig{KeyFile: keyFile}}, clone)
+	assert.NoError(t, cloneGit.Sync(clone))
+
+	test_helpers.WriteFile(t, clone, "test.md", "Line 1\nLine 2 from the clone\nLine 3\n")
+	test_helpers.WriteFile(t, clone, "clone.md", "From the clone")
+	assert.NoError(t, cloneGit.Sync(clone))
+
+	test_helpers.WriteFile(t, repos.Local, "test.md", "Line 1\nLine 2 from local\nLine 3\n")
+	assert.NoError(t, git.Sync(repos.Local))
+	assertState(t, repos.Local, Sync)
+
+	content, err := ioutil.ReadFile(filepath.Join(repos.Local, "test.md"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "<<<<<<<")
+	assert.Contains(t, string(content), "Line 2 from the clone")
+	assert.Contains(t, string(content), "Line 2 from local")
+	assert.True(t, strings.HasPrefix(string(content), "Line 1\n"))
+
+	content, err = ioutil.ReadFile(filepath.Join(repos.Local, "clone.md"))
+	assert.NoError(t, err)
+	assert.Equal(t, "From the clone", string(content))
+
+	assert.True(t, IsEncrypted([]byte(remoteBlob(t, repos, "test.md"))))
+	assert.True(t, IsEncrypted([]byte(remoteBlob(t, repos, "clone.md"))))
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	defaultMaxDeletedFiles   = 20
+	defaultMaxDeletedPercent = 50
+	// The percentage only counts from this many deleted files, so deleting a note from a small repo goes through.
+	minDeletedFilesForPercent = 5
+
+	deletionHoldName       = "deletion-hold.json"
+	deletionsConfirmedName = "deletions-confirmed.json"
+)
+
+// Exceeded returns true when deleting that many of the tracked files needs a confirmation.
+func (d DeletionsConfig) Exceeded(deleted int, tracked int) bool {
+	maxFiles := d.MaxFiles
+	if maxFiles == 0 {
+		maxFiles = defaultMaxDeletedFiles
+	}
+	maxPercent := d.MaxPercent
+	if maxPercent == 0 {
+		maxPercent = defaultMaxDeletedPercent
+	}
+
+	if maxFiles > 0 && deleted > maxFiles {
+		return true
+	}
+	return maxPercent > 0 && tracked > 0 && deleted >= minDeletedFilesForPercent && deleted*100 > maxPercent*tracked
+}
+
+// stagedDeletions lists the deleted files in the index. Renamed files aren't deletions.
+func stagedDeletions(ctx context.Context, path string) ([]string, error) {
+	out, err := runCmdStdout(ctx, path, "git", "diff", "--cached", "-M", "--name-only", "--diff-filter=D", "-z")
+	if err != nil {
+		return nil, fmt.Errorf("unable to list the staged deletions. Err: %v", err)
+	}
+	return splitNul(out), nil
+}
+
+func trackedFileCount(ctx context.Context, path string) (int, error) {
+	_, err := runCmd(ctx, path, "git", "rev-parse", "--verify", "-q", "HEAD")
+	if err != nil {
+		// Nothing is tracked before the first commit.
+		return 0, nil
+	}
+
+	out, err := runCmdStdout(ctx, path, "git", "ls-tree", "-r", "-z", "--name-only", "HEAD")
+	if err != nil {
+		return 0, fmt.Errorf("unable to list the tracked files. Err: %v", err)
+	}
+	return len(splitNul(out)), nil
+}
+
+func readFileList(ctx context.Context, path string, name string) ([]string, error) {
+	content, err := readStateFile(ctx, path, name)
+	if err != nil || content == "" {
+		return nil, err
+	}
+
+	var files []string
+	err = json.Unmarshal([]byte(content), &files)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s. Err: %v", name, err)
+	}
+	return files, nil
+}
+
+func writeFileList(ctx context.Context, path string, name string, files []string) error {
+	content, err := json.MarshalIndent(files, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeStateFile(ctx, path, name, string(content))
+}
+
+// merging returns true while a merge waits to be concluded.
+func merging(ctx context.Context, path string) bool {
+	_, err := runCmd(ctx, path, "git", "rev-parse", "--verify", "-q", "MERGE_HEAD")
+	return err == nil
+}
+
+// mergedDeletions returns the deleted files that the merged branch deleted too, while a merge is in progress. They
+// were confirmed on the machine that deleted them.
+func mergedDeletions(ctx context.Context, path string, deleted []string) (map[string]bool, error) {
+	merged := map[string]bool{}
+	if !merging(ctx, path) {
+		return merged, nil
+	}
+
+	args := append([]string{"ls-tree", "-r", "-z", "--name-only", "MERGE_HEAD", "--"}, deleted...)
+	out, err := runCmdStdout(ctx, path, "git", args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list the merged files. Err: %v", err)
+	}
+	kept := map[string]bool{}
+	for _, file := range splitNul(out) {
+		kept[file] = true
+	}
+	for _, file := range deleted {
+		if !kept[file] {
+			merged[file] = true
+		}
+	}
+	return merged, nil
+}
+
+// CheckDeletions is run on the staged changes before they are committed. When too many files are deleted, it unstages
+// everything, holds the deletions until they're confirmed, and returns the deleted files. The deletions that were
+// already confirmed don't count, and neither do the ones that a merge brings in.
+func CheckDeletions(ctx context.Context, path string, deletions DeletionsConfig) ([]string, error) {
+	deleted, err := stagedDeletions(ctx, path)
+	if err != nil || len(deleted) == 0 {
+		return nil, err
+	}
+	merged, err := mergedDeletions(ctx, path, deleted)
+	if err != nil {
+		return nil, err
+	}
+	if len(merged) > 0 {
+		var local []string
+		for _, file := range deleted {
+			if !merged[file] {
+				local = append(local, file)
+			}
+		}
+		deleted = local
+	}
+
+	confirmed, err := readFileList(ctx, path, deletionsConfirmedName)
+	if err != nil {
+		return nil, err
+	}
+	isConfirmed := map[string]bool{}
+	for _, file := range confirmed {
+		isConfirmed[file] = true
+	}
+
+	var unconfirmed []string
+	for _, file := range deleted {
+		if !isConfirmed[file] {
+			unconfirmed = append(unconfirmed, file)
+		}
+	}
+
+	tracked, err := trackedFileCount(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if !deletions.Exceeded(len(unconfirmed), tracked) {
+		return nil, nil
+	}
+	if merging(ctx, path) {
+		// Unstaging would drop the merge.
+		return nil, fmt.Errorf("the merge in %s deletes %d files that the merged branch still has. Conclude the "+
+			"merge by hand", path, len(unconfirmed))
+	}
+
+	_, err = runCmd(ctx, path, "git", "reset", "-q")
+	if err != nil {
+		return nil, fmt.Errorf("unable to unstage the changes. Err: %v", err)
+	}
+	err = writeFileList(ctx, path, deletionHoldName, deleted)
+	if err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+// IsDeletionHeld returns true while the held deletions wait for a confirmation. The hold is dropped once the deleted
+// files are back.
+func IsDeletionHeld(ctx context.Context, path string) (bool, error) {
+	held, err := stateFileExists(ctx, path, deletionHoldName)
+	if err != nil || !held {
+		return false, err
+	}
+
+	out, err := runCmdStdout(ctx, path, "git", "ls-files", "--deleted", "-z")
+	if err != nil {
+		return false, fmt.Errorf("unable to list the deleted files. Err: %v", err)
+	}
+	if len(splitNul(out)) > 0 {
+		return true, nil
+	}
+
+	return false, removeStateFile(ctx, path, deletionHoldName)
+}
+
+func HeldDeletions(ctx context.Context, path string) ([]string, error) {
+	return readFileList(ctx, path, deletionHoldName)
+}
+
+// ConfirmDeletions lets the next sync commit the held deletions, and returns them.
+func ConfirmDeletions(ctx context.Context, path string) ([]string, error) {
+	held, err := HeldDeletions(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if len(held) == 0 {
+		return nil, fmt.Errorf("no deletions of %s are waiting for a confirmation", path)
+	}
+
+	err = writeFileList(ctx, path, deletionsConfirmedName, held)
+	if err != nil {
+		return nil, err
+	}
+	return held, removeStateFile(ctx, path, deletionHoldName)
+}
+
+func deletionHoldMessage(path string, deleted []string) string {
+	shown := deleted
+	if len(shown) > 5 {
+		shown = shown[:5]
+	}
+
+	message := fmt.Sprintf("Not committing the deletion of %d files in %s (%s", len(deleted), path, strings.Join(shown, ", "))
+	if len(shown) < len(deleted) {
+		message += ", ..."
+	}
+	return message + "). Run `git-notes confirm-deletions " + path + "` to commit them."
+}
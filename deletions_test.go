@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"git-notes/internal/test_helpers"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// syncedNotes commits and pushes the notes `note-0.md`...`note-<count-1>.md`.
+func syncedNotes(t *testing.T, repos test_helpers.Repos, git *GitCmd, count int) {
+	for i := 0; i < count; i++ {
+		test_helpers.WriteFile(t, repos.Local, fmt.Sprintf("note-%d.md", i), fmt.Sprintf("Note %d", i))
+	}
+	assert.NoError(t, git.Sync(repos.Local))
+	assert.Len(t, remoteFiles(t, repos), count)
+}
+
+func deleteNotes(t *testing.T, path string, count int) {
+	for i := 0; i < count; i++ {
+		assert.NoError(t, os.Remove(filepath.Join(path, fmt.Sprintf("note-%d.md", i))))
+	}
+}
+
+func TestDeletionsConfig_Exceeded(t *testing.T) {
+	assert.False(t, DeletionsConfig{}.Exceeded(1, 1))
+	assert.False(t, DeletionsConfig{}.Exceeded(4, 4))
+	assert.True(t, DeletionsConfig{}.Exceeded(5, 9))
+	assert.False(t, DeletionsConfig{}.Exceeded(5, 10))
+	assert.True(t, DeletionsConfig{}.Exceeded(21, 1000))
+
+	assert.True(t, DeletionsConfig{MaxFiles: 2}.Exceeded(3, 1000))
+	assert.False(t, DeletionsConfig{MaxFiles: -1, MaxPercent: -1}.Exceeded(1000, 1000))
+	assert.True(t, DeletionsConfig{MaxPercent: 10}.Exceeded(6, 50))
+}
+
+func TestDeletions_NeedsConfirmation(t *testing.T) {
+	repos := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(repos)
+	git := &GitCmd{}
+
+	syncedNotes(t, repos, git, 10)
+	deleteNotes(t, repos.Local, 8)
+
+	assert.NoError(t, git.Sync(repos.Local))
+
+	state, err := git.GetState(repos.Local)
+	assert.NoError(t, err)
+	assert.Equal(t, NeedsConfirmation, state)
+	assert.Len(t, remoteFiles(t, repos), 10)
+
+	held, err := HeldDeletions(context.Background(), repos.Local)
+	assert.NoError(t, err)
+	assert.Len(t, held, 8)
+
+	confirmed, err := ConfirmDeletions(context.Background(), repos.Local)
+	assert.NoError(t, err)
+	assert.Equal(t, held, confirmed)
+	_, err = ConfirmDeletions(context.Background(), repos.Local)
+	assert.Error(t, err)
+
+	assert.NoError(t, git.Sync(repos.Local))
+	assert.Equal(t, []string{"note-8.md", "note-9.md"}, remoteFiles(t, repos))
+
+	// The confirmation is used up by the commit.
+	exists, err := stateFileExists(context.Background(), repos.Local, deletionsConfirmedName)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestDeletions_RestoredFiles(t *testing.T) {
+	repos := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(repos)
+	git := &GitCmd{}
+
+	syncedNotes(t, repos, git, 10)
+	deleteNotes(t, repos.Local, 8)
+	assert.NoError(t, git.Sync(repos.Local))
+
+	// The files come back, e.g. the mount is fixed.
+	test_helpers.PerformCmd(t, repos.Local, "git", "checkout", "--", ".")
+
+	state, err := git.GetState(repos.Local)
+	assert.NoError(t, err)
+	assert.Equal(t, Sync, state)
+
+	exists, err := stateFileExists(context.Background(), repos.Local, deletionHoldName)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestDeletions_Configured(t *testing.T) {
+	repos := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(repos)
+	git := gitWithSettings(RepoConfig{Deletions: DeletionsConfig{MaxFiles: -1, MaxPercent: -1}}, repos.Local)
+
+	syncedNotes(t, repos, git, 10)
+	deleteNotes(t, repos.Local, 8)
+
+	assert.NoError(t, git.Sync(repos.Local))
+	assert.Equal(t, []string{"note-8.md", "note-9.md"}, remoteFiles(t, repos))
+}
+
+func TestDeletions_Rename(t *testing.T) {
+	repos := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(repos)
+	git := &GitCmd{}
+
+	syncedNotes(t, repos, git, 10)
+
+	// Moving every note into a directory isn't a deletion.
+	assert.NoError(t, os.Mkdir(filepath.Join(repos.Local, "archive"), 0755))
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("note-%d.md", i)
+		assert.NoError(t, os.Rename(filepath.Join(repos.Local, name), filepath.Join(repos.Local, "archive", name)))
+	}
+
+	assert.NoError(t, git.Sync(repos.Local))
+
+	state, err := git.GetState(repos.Local)
+	assert.NoError(t, err)
+	assert.Equal(t, Sync, state)
+	assert.Len(t, remoteFiles(t, repos), 10)
+}
+
+func TestDeletions_ConfirmedOnAnotherMachine(t *testing.T) {
+	machines := test_helpers.SetupMachines(2, 0)
+	defer test_helpers.CleanupMachines(machines)
+	desktop, laptop := machines.Clones[0], machines.Clones[1]
+	git := &GitCmd{}
+
+	syncedNotes(t, test_helpers.Repos{Local: desktop, Remote: machines.Remote}, git, 10)
+	assert.NoError(t, git.Sync(laptop))
+
+	// The laptop diverges while the desktop deletes most of the notes.
+	test_helpers.WriteFile(t, laptop, "laptop.md", "Laptop")
+	test_helpers.PerformCmd(t, laptop, "git", "add", "laptop.md")
+	test_helpers.PerformCmd(t, laptop, "git", "commit", "-q", "-m", "By hand")
+
+	deleteNotes(t, desktop, 8)
+	assert.NoError(t, git.Sync(desktop))
+	_, err := ConfirmDeletions(context.Background(), desktop)
+	assert.NoError(t, err)
+	assert.NoError(t, git.Sync(desktop))
+
+	// The merge brings the confirmed deletions in.
+	assert.NoError(t, git.Sync(laptop))
+	assertState(t, laptop, Sync)
+	assert.Equal(t, []string{"laptop.md", "note-8.md", "note-9.md"}, remoteFiles(t, test_helpers.Repos{Local: laptop, Remote: machines.Remote}))
+	assert.Equal(t, "", gitOutput(t, laptop, "status", "--porcelain"))
+	_, err = os.Stat(filepath.Join(laptop, "note-0.md"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -16,91 +17,411 @@ const (
 	Ahead     State = "ahead"
 	OutOfSync State = "out-of-sync"
 	Sync      State = "sync"
+	// Held means the local branch is ahead, but a hook has held the push.
+	Held State = "held"
+	// Deferred means the schedule doesn't allow the remote operations that are needed at the moment.
+	Deferred State = "deferred"
+	// Unsigned means the local branch is ahead, but some of the commits aren't signed although signing is enabled.
+	Unsigned State = "unsigned"
+	// AuthFailed means the remote rejected the credentials. Only local commits happen until `git-notes retry
+	// <repo>` is run.
+	AuthFailed State = "auth-failed"
+	// NeedsConfirmation means too many files are deleted, and they aren't committed until `git-notes
+	// confirm-deletions <repo>` is run.
+	NeedsConfirmation State = "needs-confirmation"
+	// Offline means the remote can't be reached, and the local branch is ahead. The peers keep the repo in sync
+	// meanwhile.
+	Offline State = "offline"
+	// Paused means the mode of the repo leaves it alone.
+	Paused State = "paused"
+	// Restricted means the mode of the repo doesn't allow the operation that's needed, e.g. pushing a commit-only
+	// repo.
+	Restricted State = "restricted"
 )
 
 type State string
 
 type Git interface {
+	Configure(config *Config)
 	GetCurrentBranch(path string) (string, error)
 	IsDirty(path string) (bool, error)
 	GetState(path string) (State, error)
 	Sync(path string) error
+	// SyncContext is Sync with a context. Cancelling it kills the git commands of the sync.
+	SyncContext(ctx context.Context, path string) error
 	Update(path string) error
 }
 
 type GitCmd struct {
+	config *Config
+	clock  Clock
+	relay  *Relay
+	peers  *Peers
+	// locks locks the submodules. The monitor locks the repos.
+	locks *Locks
+}
+
+func (g *GitCmd) Configure(config *Config) {
+	g.config = config
+	g.relay.Configure(config.Relay)
+	g.peers.Configure(config.Peers, config.Repos)
 }
 
 func (g *GitCmd) Sync(path string) error {
-	state, err := g.GetState(path)
+	return g.SyncContext(context.Background(), path)
+}
+
+// SyncContext is Sync with a context. Cancelling it kills the git commands of the sync.
+func (g *GitCmd) SyncContext(ctx context.Context, path string) error {
+	ctx = g.withTimeouts(ctx)
+	_, err := g.sync(ctx, path)
+	if err != nil {
+		g.record(ctx, path, JournalEntry{Event: JournalError, Message: err.Error()})
+	}
+	return err
+}
+
+// withTimeouts applies the timeouts of the config to the git commands that run with the context.
+func (g *GitCmd) withTimeouts(ctx context.Context) context.Context {
+	if g.config == nil {
+		return ctx
+	}
+	return WithTimeouts(ctx, g.config.Timeouts)
+}
+
+// sync returns the state that the repo is left in.
+func (g *GitCmd) sync(ctx context.Context, path string) (State, error) {
+	err := g.prepare(ctx, path)
+	if err != nil {
+		return Error, fmt.Errorf("preparing the repo failed. Err: %w", err)
+	}
+	if g.config.RepoSettings(path).Submodules {
+		err = g.syncSubmodules(ctx, path)
+		if err != nil {
+			return Error, err
+		}
+	}
+
+	state, err := g.getState(ctx, path)
 	log.Printf("Starting state: %s", state)
 	if err != nil {
-		return fmt.Errorf("performing GetState() failed. Err: %v", err)
+		return Error, fmt.Errorf("performing GetState() failed. Err: %w", err)
 	}
+	g.record(ctx, path, JournalEntry{Event: JournalStart, To: state})
 
 	for {
-		if state == Sync {
-			return nil
+		if state == Sync || state == Held || state == Deferred || state == NeedsConfirmation || state == Unsigned ||
+			state == AuthFailed || state == Offline || state == Paused || state == Restricted {
+			return state, nil
 		}
 
-		err = g.Update(path)
+		err = g.update(ctx, path)
 		if err != nil {
-			return fmt.Errorf("performing Update() failed. Err: %v", err)
+			return Error, fmt.Errorf("performing Update() failed. Err: %w", err)
 		}
-		nextState, err := g.GetState(path)
+		nextState, err := g.getState(ctx, path)
 		if err != nil {
-			return fmt.Errorf("performing GetState() failed. Err: %v", err)
+			return Error, fmt.Errorf("performing GetState() failed. Err: %w", err)
 		}
 		log.Printf("Next state: %s", nextState)
+		g.record(ctx, path, JournalEntry{Event: JournalTransition, From: state, To: nextState})
 
 		if state == nextState {
-			return fmt.Errorf("state doesn't change. Something is wrong")
+			return Error, fmt.Errorf("state doesn't change. Something is wrong")
 		}
 
 		state = nextState
 	}
 }
 
-func runCmd(path string, command string, args ...string) (string, error) {
+// record appends the entry to the journal of the repo. Failing to do so doesn't fail the sync.
+func (g *GitCmd) record(ctx context.Context, path string, entry JournalEntry) {
+	entry.Time = orRealClock(g.clock).Now()
+	err := AppendJournal(ctx, path, entry)
+	if err != nil {
+		log.Printf("Unable to write the journal of %s. Err: %v", path, err)
+	}
+}
+
+// index updates the search index of the repo. It doesn't fail the sync, and the search catches up anyway.
+func (g *GitCmd) index(ctx context.Context, path string) {
+	_, err := UpdateSearchIndex(ctx, path)
+	if err != nil {
+		log.Printf("Unable to update the search index of %s. Err: %v", path, err)
+	}
+}
+
+// head returns the sha of HEAD, or an empty string when there's no commit.
+func head(ctx context.Context, path string) string {
+	out, err := runCmdStdout(ctx, path, "git", "rev-parse", "HEAD")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(out)
+}
+
+// prepare applies the settings that live in the git config of the repo.
+func (g *GitCmd) prepare(ctx context.Context, path string) error {
+	err := ExcludeNestedWorktrees(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	settings := g.config.RepoSettings(path)
+	if settings.Signing.Enabled {
+		err := SetupSigning(ctx, path, settings.Signing)
+		if err != nil {
+			return err
+		}
+	} else {
+		err := TeardownSigning(ctx, path)
+		if err != nil {
+			return err
+		}
+	}
+	if settings.Encryption.Enabled() {
+		return SetupEncryption(ctx, path, settings.Encryption)
+	}
+	err = TeardownEncryption(ctx, path)
+	if err != nil {
+		return err
+	}
+	if settings.LargeFiles.Enabled() {
+		return SetupLargeFiles(ctx, path)
+	}
+	return nil
+}
+
+// allowedNow returns whether the schedule of the repo allows the remote operations, and the pushes in particular.
+func (g *GitCmd) allowedNow(ctx context.Context, path string) (remote bool, push bool, err error) {
+	metered, err := IsMetered(ctx, path)
+	if err != nil {
+		return false, false, err
+	}
+
+	remote, push = g.config.RepoSettings(path).Schedule.Allows(orRealClock(g.clock).Now(), metered)
+	return remote, push, nil
+}
+
+func runCmd(ctx context.Context, path string, command string, args ...string) (string, error) {
+	cmd := exec.Command(command, args...)
+	cmd.Dir = path
+
+	out, err := combinedOutputTimeout(ctx, cmd, localTimeout(ctx))
+	return string(out), err
+}
+
+// runCmdStdout is like runCmd but leaves stderr out of the output, which is needed when the output is parsed.
+func runCmdStdout(ctx context.Context, path string, command string, args ...string) (string, error) {
 	cmd := exec.Command(command, args...)
 	cmd.Dir = path
 
-	out, err := cmd.CombinedOutput()
+	out, err := outputTimeout(ctx, cmd, localTimeout(ctx))
 	return string(out), err
 }
 
+func splitNul(out string) []string {
+	var items []string
+	for _, item := range strings.Split(out, "\x00") {
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func (g *GitCmd) GetCurrentBranch(path string) (string, error) {
-	return GetBranch(path)
+	return GetBranch(g.withTimeouts(context.Background()), path)
 }
 
 func (g *GitCmd) IsDirty(path string) (bool, error) {
-	out, err := runCmd(path, "git", "status", "--porcelain")
+	return g.isDirty(g.withTimeouts(context.Background()), path)
+}
+
+func (g *GitCmd) isDirty(ctx context.Context, path string) (bool, error) {
+	files, err := ChangedFiles(ctx, path)
+	if err != nil {
+		return false, err
+	}
+
+	blocked, err := ReadBlockedFiles(ctx, path)
 	if err != nil {
-		return false, fmt.Errorf("unable to get status. Error: %v", err)
+		return false, err
 	}
 
-	dirty := strings.TrimSpace(string(out)) != ""
-	return dirty, nil
+	for _, file := range files {
+		if !blocked.IsStillBlocked(path, file) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ChangedFiles lists the changed files in the working tree and the index, including every untracked file. A submodule
+// is only changed when it points at another commit, since its own changes are committed in its own sync.
+func ChangedFiles(ctx context.Context, path string) ([]string, error) {
+	out, err := runCmdStdout(ctx, path, "git", "status", "--porcelain", "--untracked-files=all",
+		"--ignore-submodules=dirty", "-z")
+	if err != nil {
+		return nil, fmt.Errorf("unable to get status. Error: %w", err)
+	}
+
+	var files []string
+	entries := splitNul(out)
+	for i := 0; i < len(entries); i++ {
+		entry := entries[i]
+		if len(entry) < 4 {
+			continue
+		}
+		files = append(files, entry[3:])
+
+		// Renames and copies are followed by the original path.
+		if entry[0] == 'R' || entry[0] == 'C' {
+			i++
+		}
+	}
+	return files, nil
 }
 
 func (g *GitCmd) GetState(path string) (State, error) {
+	return g.getState(g.withTimeouts(context.Background()), path)
+}
+
+func (g *GitCmd) getState(ctx context.Context, path string) (State, error) {
 	log.Printf("Computing the state of %s", path)
 
-	dirty, err := g.IsDirty(path)
+	mode, err := g.mode(ctx, path)
 	if err != nil {
-		return Error, fmt.Errorf("unable to get dirty status. Error: %v", err)
+		return Error, err
+	}
+	if mode == ModePaused {
+		return Paused, nil
+	}
+
+	dirty := false
+	// The local changes of a pull-only repo are never committed.
+	if mode != ModePullOnly {
+		dirty, err = g.isDirty(ctx, path)
+		if err != nil {
+			return Error, fmt.Errorf("unable to get dirty status. Error: %w", err)
+		}
+	}
+	// This also drops the hold once the deleted files are back.
+	held, err := IsDeletionHeld(ctx, path)
+	if err != nil {
+		return Error, err
+	}
+	if dirty && held {
+		return NeedsConfirmation, nil
 	}
 	if dirty {
 		return Dirty, nil
 	} else {
-		branch, err := g.GetCurrentBranch(path)
+		branch, err := GetBranch(ctx, path)
 		if err != nil {
-			return Error, fmt.Errorf("unable to get current branch. Error: %v", err)
+			return Error, fmt.Errorf("unable to get current branch. Error: %w", err)
 		}
-		state, err := GetStateAgainstRemote(path, branch)
+		remote, push, err := g.allowedNow(ctx, path)
 		if err != nil {
 			return Error, err
 		}
+		if mode == ModeCommitOnly {
+			remote, push = false, false
+		}
+
+		authFailed, err := IsAuthFailed(ctx, path)
+		if err != nil {
+			return Error, err
+		}
+		if authFailed {
+			return AuthFailed, nil
+		}
+
+		var state State
+		offline := false
+		if remote {
+			state, err = GetStateAgainstRemote(ctx, path, branch, g.config.RepoSettings(path).Credentials)
+			if authErr, ok := err.(*AuthError); ok {
+				return AuthFailed, SetAuthFailed(ctx, path, authErr, orRealClock(g.clock).Now())
+			}
+			if err != nil && !IsTimeout(err) && g.peers.Enabled() {
+				log.Printf("Syncing %s with the peers only. Err: %v", path, err)
+				state, err = GetStateAgainstTrackingBranch(ctx, path, branch)
+				offline = true
+			}
+		} else {
+			state, err = GetStateAgainstTrackingBranch(ctx, path, branch)
+		}
+		if err != nil {
+			return Error, err
+		}
+
+		// The peers are only fetched while the remote can't be reached. Each of them can take up to peerTimeout.
+		if offline && (state == Sync || state == Ahead) {
+			peer, err := g.peers.Fetch(ctx, path, branch)
+			if err != nil {
+				return Error, err
+			}
+			if peer != "" && mode == ModePullOnly {
+				return g.pullOnlyState(ctx, path, branch, OutOfSync, remote)
+			}
+			if peer != "" {
+				return OutOfSync, nil
+			}
+		}
+
+		if mode == ModePullOnly {
+			return g.pullOnlyState(ctx, path, branch, state, remote)
+		}
+		if mode == ModeMirror {
+			return g.mirrorState(path, state, remote), nil
+		}
+		if mode == ModeCommitOnly && state != Sync {
+			return Restricted, nil
+		} else if mode == ModeCommitOnly {
+			// Nothing is uploaded.
+			return Sync, nil
+		}
+
+		if state == Sync && g.config.RepoSettings(path).LargeFiles.Enabled() {
+			verified, err := IsLargeFilesVerified(ctx, path)
+			if err != nil {
+				return Error, err
+			}
+			if !verified {
+				// Pushing uploads the missing LFS objects.
+				state = Ahead
+			}
+		}
+
+		if state == Ahead {
+			held, err := IsPushHeld(ctx, path)
+			if err != nil {
+				return Error, err
+			}
+			if held {
+				return Held, nil
+			}
+		}
+
+		if state == Ahead && g.config.RepoSettings(path).Signing.Enabled {
+			unsigned, err := UnsignedCommits(ctx, path)
+			if err != nil {
+				return Error, err
+			}
+			if len(unsigned) > 0 {
+				log.Printf("Not pushing %s, because %d commits aren't signed", path, len(unsigned))
+				return Unsigned, nil
+			}
+		}
+
+		if (state != Sync && !remote) || (state == Ahead && !push) {
+			log.Printf("The schedule defers the remote operations of %s", path)
+			return Deferred, nil
+		}
+		if state == Ahead && offline {
+			return Offline, nil
+		}
 		return state, nil
 	}
 }
@@ -154,105 +475,334 @@ func ParseStatusBranch(status string, branch string) (State, error) {
 	return Error, fmt.Errorf("unable to parse status: %v", status)
 }
 
-func GetStateAgainstRemote(path string, branch string) (State, error) {
-	_, err := runCmd(path, "git", "fetch")
+func GetStateAgainstRemote(ctx context.Context, path string, branch string, credentials CredentialsConfig) (State, error) {
+	out, err := runRemoteCmd(ctx, path, credentials, "fetch")
+	if _, ok := err.(*AuthError); ok {
+		return Error, err
+	}
 	if err != nil {
-		return Error, fmt.Errorf("unable to fetch. Error: %v", err)
+		return Error, fmt.Errorf("unable to fetch. Error: %w, %s", err, out)
 	}
 
-	status, err := runCmd(path, "git", "status", "--branch", "--porcelain")
+	return GetStateAgainstTrackingBranch(ctx, path, branch)
+}
+
+// GetStateAgainstTrackingBranch is like GetStateAgainstRemote, but compares against the last fetch.
+func GetStateAgainstTrackingBranch(ctx context.Context, path string, branch string) (State, error) {
+	status, err := runCmd(ctx, path, "git", "status", "--branch", "--porcelain")
 	if err != nil {
-		return Error, fmt.Errorf("unable to fetch. Error: %v", err)
+		return Error, fmt.Errorf("unable to fetch. Error: %w", err)
 	}
 
 	return ParseStatusBranch(status, branch)
 }
 
 func (g *GitCmd) Update(path string) error {
-	state, err := g.GetState(path)
+	return g.update(g.withTimeouts(context.Background()), path)
+}
+
+func (g *GitCmd) update(ctx context.Context, path string) error {
+	state, err := g.getState(ctx, path)
+
+	if err != nil {
+		return err
+	}
 
+	mode, err := g.mode(ctx, path)
 	if err != nil {
 		return err
 	}
 
+	// GetState() only returns the states whose operation the mode allows.
 	switch state {
 	case Error:
 	case Dirty:
-		err = AddAndCommit(path)
+		if mode == ModeMirror {
+			err = g.ResetMirror(ctx, path)
+		} else {
+			err = g.AddAndCommit(ctx, path)
+		}
 	case Ahead:
-		err = Push(path)
+		err = g.Push(ctx, path)
 	case OutOfSync:
-		err = Merge(path)
+		switch mode {
+		case ModePullOnly:
+			err = g.FastForward(ctx, path)
+		case ModeMirror:
+			err = g.ResetMirror(ctx, path)
+		default:
+			err = g.Merge(ctx, path)
+		}
 	case Sync:
+	case Held:
+	case Deferred:
+	case NeedsConfirmation:
+	case Unsigned:
+	case AuthFailed:
+	case Offline:
+	case Paused:
+	case Restricted:
 	}
 
 	return err
 }
 
-func GetBranch(path string) (string, error) {
+func GetBranch(ctx context.Context, path string) (string, error) {
 	cmd := exec.Command("git", "symbolic-ref", "HEAD")
 	cmd.Dir = path
 
-	out, err := cmd.CombinedOutput()
+	out, err := combinedOutputTimeout(ctx, cmd, localTimeout(ctx))
 	if err != nil {
 		return "", err
 	}
 	return strings.TrimPrefix(strings.TrimSpace(string(out)), "refs/heads/"), nil
 }
 
-func AddAndCommit(path string) error {
-	err := Add(path)
+func (g *GitCmd) AddAndCommit(ctx context.Context, path string) error {
+	settings := g.config.RepoSettings(path)
+
+	err := TrackLargeFiles(ctx, path, settings.LargeFiles)
+	if err != nil {
+		return err
+	}
+
+	err = Add(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := CheckDeletions(ctx, path, settings.Deletions)
 	if err != nil {
 		return err
 	}
-	return Commit(path)
+	if len(deleted) > 0 {
+		notify(ctx, settings.Hooks, deletionHoldMessage(path, deleted))
+		g.record(ctx, path, JournalEntry{Event: JournalDeletionHold, Files: deleted})
+		return nil
+	}
+
+	committed, err := g.commitChecked(ctx, path, fmt.Sprintf("Commited at %v", orRealClock(g.clock).Now()))
+	if err != nil || !committed {
+		return err
+	}
+	return removeStateFile(ctx, path, deletionsConfirmedName)
 }
 
-func Merge(path string) error {
-	branch, err := GetBranch(path)
+// commitChecked runs the hooks on the staged files, and commits the ones that pass them. With files, only those are
+// committed. It returns false when there's nothing left to commit.
+func (g *GitCmd) commitChecked(ctx context.Context, path string, message string, files ...string) (bool, error) {
+	settings := g.config.RepoSettings(path)
+	err := RunHooks(ctx, path, settings.Hooks)
+	if err != nil {
+		return false, err
+	}
+
+	// The hooks might have unstaged every change.
+	if len(files) == 0 {
+		needed, err := NeedsCommit(ctx, path)
+		if err != nil || !needed {
+			return false, err
+		}
+	} else if _, err := runCmd(ctx, path, "git", append([]string{"diff", "--cached", "--quiet", "--"}, files...)...); err == nil {
+		return false, nil
+	}
+
+	out, err := runCmdStdout(ctx, path, "git", append([]string{"diff", "--cached", "--name-only", "-z", "--"}, files...)...)
+	if err != nil {
+		return false, fmt.Errorf("unable to list the staged files. Err: %v", err)
+	}
+
+	err = CommitFiles(ctx, path, message, files...)
+	if err != nil && settings.Signing.Enabled && !IsTimeout(err) && signingFailed(err.Error()) {
+		return false, fmt.Errorf("unable to sign the commit. Is the signing agent available? Err: %v", err)
+	}
+	if err != nil {
+		return false, err
+	}
+	g.record(ctx, path, JournalEntry{Event: JournalCommit, Sha: head(ctx, path), Files: splitNul(out)})
+	g.index(ctx, path)
+	return true, nil
+}
+
+// NeedsCommit returns true when there are staged changes or a merge to conclude.
+func NeedsCommit(ctx context.Context, path string) (bool, error) {
+	_, err := runCmd(ctx, path, "git", "rev-parse", "--verify", "-q", "MERGE_HEAD")
+	if err == nil {
+		return true, nil
+	}
+
+	_, err = runCmd(ctx, path, "git", "diff", "--cached", "--quiet")
+	if err == nil {
+		return false, nil
+	}
+	if _, ok := err.(*exec.ExitError); ok {
+		return true, nil
+	}
+	return false, fmt.Errorf("unable to check the staged changes. Err: %v", err)
+}
+
+func (g *GitCmd) Merge(ctx context.Context, path string) error {
+	branch, err := GetBranch(ctx, path)
+	if err != nil {
+		return err
+	}
+	upstream, err := g.mergeSource(ctx, path, branch)
 	if err != nil {
 		return err
 	}
+	merged, _ := runCmdStdout(ctx, path, "git", "rev-parse", upstream)
+	before := head(ctx, path)
 
+	err = Merge(ctx, path, upstream)
+	if err != nil {
+		return err
+	}
+	settings := g.config.RepoSettings(path)
+	if settings.Submodules {
+		// The merge might add submodules, which are checked out first.
+		_, err = runCmd(ctx, path, "git", "diff", "--quiet", before, "--", ".gitmodules")
+		if _, ok := err.(*exec.ExitError); ok {
+			err = initSubmodules(ctx, path, settings.Credentials)
+		}
+		if err != nil {
+			return err
+		}
+		// The merge moves the pointers of the submodules. They catch up before the pointers are committed.
+		err = g.syncSubmodules(ctx, path)
+		if err != nil {
+			return err
+		}
+	}
+
+	out, err := runCmdStdout(ctx, path, "git", "diff", "--name-only", "--diff-filter=U", "-z")
+	if err != nil {
+		return fmt.Errorf("unable to list the conflicts. Err: %v", err)
+	}
+	conflicts := splitNul(out)
+
+	merged = strings.TrimSpace(merged)
+	g.record(ctx, path, JournalEntry{Event: JournalMerge, Sha: merged})
+	if len(conflicts) > 0 {
+		report := ConflictReport(ctx, path, merged, conflicts)
+		log.Printf("Conflicts in %s: %s", path, report)
+		g.record(ctx, path, JournalEntry{Event: JournalConflict, Sha: merged, Files: conflicts, Message: report})
+	}
+	// A fast-forward moves HEAD. The other merges are indexed once AddAndCommit() concludes them.
+	g.index(ctx, path)
+	return nil
+}
+
+// mergeSource returns the remote branch, or the branch of a peer when only a peer has new commits.
+func (g *GitCmd) mergeSource(ctx context.Context, path string, branch string) (string, error) {
+	upstream := fmt.Sprintf("origin/%s", branch)
+	newer, err := hasNewCommits(ctx, path, upstream)
+	if err == nil && newer {
+		return upstream, nil
+	}
+
+	// GetState() has just fetched the peers.
+	peer, err := PeerWithNewCommits(ctx, path, branch)
+	if err != nil {
+		return "", err
+	}
+	if peer != "" {
+		return peer, nil
+	}
+	return upstream, nil
+}
+
+func Merge(ctx context.Context, path string, upstream string) error {
 	// TODO: Escape branches with spaces etc.
-	cmd := exec.Command("git", "merge", fmt.Sprintf("origin/%s", branch), "--allow-unrelated-histories", "--no-commit")
+	cmd := exec.Command("git", "merge", upstream, "--allow-unrelated-histories", "--no-commit")
 	cmd.Dir = path
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	_ = cmd.Run() // Merge fails if there's conflict. So, we ignore the failure.
+	err := runTimeout(ctx, cmd, localTimeout(ctx))
+	if IsTimeout(err) {
+		return err
+	}
+	// Merge fails if there's conflict. So, we ignore the failure.
+	return nil
+}
+
+func (g *GitCmd) Push(ctx context.Context, path string) error {
+	settings := g.config.RepoSettings(path)
+	var err error
+	if settings.LargeFiles.Enabled() {
+		err = PushLargeFiles(ctx, path, settings.Credentials)
+	}
+	if err == nil {
+		err = Push(ctx, path, settings.Credentials, settings.Submodules)
+	}
+
+	if authErr, ok := err.(*AuthError); ok {
+		// The next GetState() reports it, so the sync stops instead of failing.
+		return SetAuthFailed(ctx, path, authErr, orRealClock(g.clock).Now())
+	}
+	if err != nil {
+		return err
+	}
+	g.record(ctx, path, JournalEntry{Event: JournalPush, Sha: head(ctx, path)})
+	g.relay.Publish(ctx, path)
 	return nil
 }
 
-func Push(path string) error {
-	branch, err := GetBranch(path)
+// Push pushes the branch. With the submodules, it refuses to push while the commits of a submodule aren't pushed.
+func Push(ctx context.Context, path string, credentials CredentialsConfig, submodules bool) error {
+	branch, err := GetBranch(ctx, path)
 	if err != nil {
 		return err
 	}
 
+	args := []string{"push"}
+	if submodules {
+		args = append(args, "--recurse-submodules=check")
+	}
 	// TODO: Escape branches with spaces etc.
-	cmd := exec.Command("git", "push", "origin", branch, "-u")
-	cmd.Dir = path
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	out, err := runRemoteCmd(ctx, path, credentials, append(args, "origin", branch, "-u")...)
+	log.Print(out)
+	return err
 }
 
-func Add(path string) error {
+func Add(ctx context.Context, path string) error {
 	cmd := exec.Command("git", "add", "--all")
 	cmd.Dir = path
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	return runTimeout(ctx, cmd, localTimeout(ctx))
 }
 
-func Commit(path string) error {
-	cmd := exec.Command("git", "-c", "user.name='Git notes'", "-c", "user.email='git-notes@noemail.com'", "commit", "-m", fmt.Sprintf("Commited at %v", time.Now()))
+func Commit(ctx context.Context, path string, at time.Time) error {
+	return CommitFiles(ctx, path, fmt.Sprintf("Commited at %v", at))
+}
+
+// CommitFiles commits the given files, or everything staged when no file is given.
+func CommitFiles(ctx context.Context, path string, message string, files ...string) error {
+	committed := files
+	if len(committed) == 0 {
+		out, err := runCmdStdout(ctx, path, "git", "diff", "--cached", "--name-only", "-z")
+		if err != nil {
+			return fmt.Errorf("unable to list the staged files. Err: %v", err)
+		}
+		committed = splitNul(out)
+	}
+
+	message = fmt.Sprintf("%s\n\n%s", message, commitTrailers(committed))
+	args := []string{"-c", "user.name='Git notes'", "-c", "user.email='git-notes@noemail.com'", "commit", "-m", message}
+	if len(files) > 0 {
+		args = append(append(args, "--"), files...)
+	}
+
+	cmd := exec.Command("git", args...)
 	cmd.Dir = path
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	out, err := combinedOutputTimeout(ctx, cmd, localTimeout(ctx))
+	log.Print(string(out))
+	if err != nil {
+		return fmt.Errorf("unable to commit. Err: %w, %s", err, out)
+	}
+	return nil
 }
 
-func NewGoGit() GitCmd {
-	return GitCmd{}
+func NewGoGit(relay *Relay, peers *Peers, locks *Locks) GitCmd {
+	return GitCmd{clock: RealClock{}, relay: relay, peers: peers, locks: locks}
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"git-notes/internal/test_helpers"
 	"log"
@@ -32,6 +33,15 @@ func performSync(t *testing.T, path string) {
 	assert.NoError(t, err)
 }
 
+// gitWithSettings syncs the repos with the same settings.
+func gitWithSettings(settings RepoConfig, paths ...string) *GitCmd {
+	config := &Config{Repos: paths, Settings: map[string]RepoConfig{}}
+	for _, path := range paths {
+		config.Settings[path] = settings
+	}
+	return &GitCmd{config: config}
+}
+
 func TestParseStatusBranch_NoRemote(t *testing.T) {
 	status := fmt.Sprintf("## %s", Branch)
 	state, err := ParseStatusBranch(status, Branch)
@@ -323,3 +333,18 @@ func TestGoGit_SyncFixConflict(t *testing.T) {
 	performSync(t, repos.Local)
 	assertState(t, repos.Local, Sync)
 }
+
+func TestGoGit_SyncContextCancelled(t *testing.T) {
+	repos := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(repos)
+	git := GitCmd{}
+
+	test_helpers.WriteFile(t, repos.Local, "test.md", "TestContent")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Error(t, git.SyncContext(ctx, repos.Local))
+	assertState(t, repos.Local, Dirty)
+
+	assert.NoError(t, git.SyncContext(context.Background(), repos.Local))
+	assertState(t, repos.Local, Sync)
+}
@@ -2,4 +2,8 @@ module git-notes
 
 go 1.16
 
-require github.com/stretchr/testify v1.7.0
+require (
+	github.com/BurntSushi/toml v1.3.2
+	github.com/stretchr/testify v1.7.0
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultHealthThreshold = 15 * time.Minute
+
+// HealthConfig configures the health checks. A repo is unhealthy when its sync loop hasn't completed a check within
+// the threshold, which then stops the systemd watchdog pings and fails `/healthz`.
+type HealthConfig struct {
+	// Listen is the address of the `/healthz` endpoint, e.g. `127.0.0.1:8287`. It's off without one.
+	Listen string `json:"Listen" yaml:"listen" toml:"listen"`
+	// Threshold is a duration like `15m`. It defaults to the time that a sync takes when its fetch and push both time
+	// out, along with a few local commands, and to at least 15m.
+	Threshold string `json:"Threshold" yaml:"threshold" toml:"threshold"`
+}
+
+func (h HealthConfig) ParseThreshold(timeouts TimeoutsConfig) (time.Duration, error) {
+	if h.Threshold == "" {
+		local, remote, err := timeouts.Parse()
+		if err != nil {
+			return 0, err
+		}
+		threshold := 2*remote + 3*local
+		if threshold < defaultHealthThreshold {
+			threshold = defaultHealthThreshold
+		}
+		return threshold, nil
+	}
+
+	threshold, err := time.ParseDuration(h.Threshold)
+	if err != nil || threshold <= 0 {
+		return 0, fmt.Errorf("invalid threshold: %s", h.Threshold)
+	}
+	return threshold, nil
+}
+
+type RepoHealth struct {
+	LastCheck time.Time `json:"lastCheck"`
+	Error     string    `json:"error,omitempty"`
+	// NotMonitored is true when the repo has no sync loop, e.g. because another process has it locked. It never
+	// stalls.
+	NotMonitored bool `json:"notMonitored,omitempty"`
+	Healthy      bool `json:"healthy"`
+}
+
+// Health tracks the progress of the sync loops. A nil Health tracks nothing, so the monitors work without one.
+type Health struct {
+	clock     Clock
+	threshold time.Duration
+
+	mutex sync.Mutex
+	repos map[string]*RepoHealth
+}
+
+func NewHealth(clock Clock) *Health {
+	return &Health{clock: clock, threshold: defaultHealthThreshold, repos: map[string]*RepoHealth{}}
+}
+
+func (h *Health) Configure(config HealthConfig, timeouts TimeoutsConfig) {
+	if h == nil {
+		return
+	}
+
+	threshold, err := config.ParseThreshold(timeouts)
+	if err != nil {
+		// The config is validated when it's read.
+		return
+	}
+	h.mutex.Lock()
+	h.threshold = threshold
+	h.mutex.Unlock()
+}
+
+// Watch starts tracking the repo, as if it was just checked.
+func (h *Health) Watch(path string) {
+	h.Checked(path, nil)
+}
+
+// Checked records that the sync loop of the repo completed a check. The error is nil when the sync succeeded.
+func (h *Health) Checked(path string, err error) {
+	if h == nil {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	repo := &RepoHealth{LastCheck: orRealClock(h.clock).Now()}
+	if err != nil {
+		repo.Error = err.Error()
+	}
+	h.repos[path] = repo
+}
+
+// NotMonitored records that the repo has no sync loop, and why.
+func (h *Health) NotMonitored(path string, err error) {
+	if h == nil {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.repos[path] = &RepoHealth{LastCheck: orRealClock(h.clock).Now(), Error: err.Error(), NotMonitored: true}
+}
+
+// Report returns whether every repo is healthy, and the health of each.
+func (h *Health) Report() (bool, map[string]RepoHealth) {
+	if h == nil {
+		return true, nil
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	now := orRealClock(h.clock).Now()
+	healthy := true
+	report := map[string]RepoHealth{}
+	for path, repo := range h.repos {
+		r := *repo
+		r.Healthy = r.NotMonitored || now.Sub(r.LastCheck) <= h.threshold
+		healthy = healthy && r.Healthy
+		report[path] = r
+	}
+	return healthy, report
+}
+
+// Status summarizes the health for `STATUS=` of systemd, e.g. `3 repos: 2 synced, 1 failing, 0 stalled`.
+func (h *Health) Status() string {
+	_, report := h.Report()
+
+	var synced, failing, stalled []string
+	for path, repo := range report {
+		switch {
+		case !repo.Healthy:
+			stalled = append(stalled, path)
+		case repo.Error != "":
+			failing = append(failing, path)
+		default:
+			synced = append(synced, path)
+		}
+	}
+
+	status := fmt.Sprintf("%d repos: %d synced, %d failing, %d stalled", len(report), len(synced), len(failing), len(stalled))
+	if problems := append(failing, stalled...); len(problems) > 0 {
+		sort.Strings(problems)
+		status += fmt.Sprintf(" (%s)", strings.Join(problems, ", "))
+	}
+	return status
+}
+
+// ServeHTTP answers `/healthz` with the health of every repo, and 503 when one of them is stalled.
+func (h *Health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	healthy, report := h.Report()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"healthy": healthy, "repos": report})
+}
+
+// Serve starts the `/healthz` endpoint in the background.
+func (h *Health) Serve(listen string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", h)
+
+	server := &http.Server{Addr: listen, Handler: mux}
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s. Err: %v", listen, err)
+	}
+
+	go func() {
+		err := server.Serve(listener)
+		if err != nil {
+			log.Printf("The health endpoint stopped. Err: %v", err)
+		}
+	}()
+	log.Printf("Serving the health at http://%s/healthz", listener.Addr())
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"git-notes/internal/test_helpers"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthConfig_ParseThreshold(t *testing.T) {
+	// The default covers a sync whose fetch and push both time out.
+	threshold, err := HealthConfig{}.ParseThreshold(TimeoutsConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, 26*time.Minute, threshold)
+
+	threshold, err = HealthConfig{}.ParseThreshold(TimeoutsConfig{Local: "1m", Remote: "30m"})
+	assert.NoError(t, err)
+	assert.Equal(t, 63*time.Minute, threshold)
+
+	threshold, err = HealthConfig{}.ParseThreshold(TimeoutsConfig{Local: "10s", Remote: "1m"})
+	assert.NoError(t, err)
+	assert.Equal(t, 15*time.Minute, threshold)
+
+	threshold, err = HealthConfig{Threshold: "1h"}.ParseThreshold(TimeoutsConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, time.Hour, threshold)
+
+	_, err = HealthConfig{Threshold: "soon"}.ParseThreshold(TimeoutsConfig{})
+	assert.EqualError(t, err, "invalid threshold: soon")
+}
+
+func TestHealth_Report(t *testing.T) {
+	clock := test_helpers.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	health := NewHealth(clock)
+	health.Configure(HealthConfig{Threshold: "10m"}, TimeoutsConfig{})
+
+	health.Watch("/notes")
+	health.Watch("/work")
+	health.Checked("/work", errors.New("offline"))
+	healthy, report := health.Report()
+	assert.True(t, healthy)
+	assert.Equal(t, "offline", report["/work"].Error)
+	assert.Equal(t, "2 repos: 1 synced, 1 failing, 0 stalled (/work)", health.Status())
+
+	// A failing sync still makes progress, but a stuck one doesn't.
+	clock.Advance(8 * time.Minute)
+	health.Checked("/work", errors.New("offline"))
+	clock.Advance(3 * time.Minute)
+	healthy, report = health.Report()
+	assert.False(t, healthy)
+	assert.False(t, report["/notes"].Healthy)
+	assert.True(t, report["/work"].Healthy)
+	assert.Equal(t, "2 repos: 0 synced, 1 failing, 1 stalled (/notes, /work)", health.Status())
+}
+
+func TestHealth_Nil(t *testing.T) {
+	var health *Health
+	health.Checked("/notes", nil)
+	healthy, _ := health.Report()
+	assert.True(t, healthy)
+}
+
+func TestHealth_ServeHTTP(t *testing.T) {
+	clock := test_helpers.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	health := NewHealth(clock)
+	health.Watch("/notes")
+
+	recorder := httptest.NewRecorder()
+	health.ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"healthy":true`)
+
+	clock.Advance(time.Hour)
+	recorder = httptest.NewRecorder()
+	health.ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"healthy":false`)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	OnHitBlock    = "block"
+	OnHitHoldPush = "hold-push"
+)
+
+const (
+	blockedFilesName = "blocked-files.json"
+	pushHoldName     = "push-hold"
+)
+
+type SecretDetector struct {
+	Name    string
+	Pattern *regexp.Regexp
+}
+
+var SecretDetectors = []SecretDetector{
+	{Name: "AWS access key", Pattern: regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{Name: "private key block", Pattern: regexp.MustCompile(`-----BEGIN ([A-Z0-9]+ )*PRIVATE KEY( BLOCK)?-----`)},
+	{Name: "GitHub token", Pattern: regexp.MustCompile(`\b(gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})\b`)},
+	{Name: "GitLab token", Pattern: regexp.MustCompile(`\bglpat-[A-Za-z0-9_\-]{20,}\b`)},
+	{Name: "Slack token", Pattern: regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9\-]{10,}`)},
+	{Name: "Google API key", Pattern: regexp.MustCompile(`\bAIza[0-9A-Za-z_\-]{35}\b`)},
+	{Name: "Stripe secret key", Pattern: regexp.MustCompile(`\b[rs]k_live_[0-9A-Za-z]{24,}\b`)},
+}
+
+// BlockedFiles maps the files that are left out of commits to the hash of their content. A blocked file is ignored
+// by `IsDirty()` until its content changes.
+type BlockedFiles map[string]string
+
+func ScanSecrets(content []byte) []string {
+	var found []string
+	for _, detector := range SecretDetectors {
+		if detector.Pattern.Match(content) {
+			found = append(found, detector.Name)
+		}
+	}
+	return found
+}
+
+// RunHooks checks the staged files of the repo. Depending on `hooks.OnHit`, a file with a hit is either unstaged and
+// remembered in the blocked files, or kept staged while the push of the repo is held.
+func RunHooks(ctx context.Context, path string, hooks HooksConfig) error {
+	if !hooks.Secrets && len(hooks.Commands) == 0 {
+		return nil
+	}
+
+	files, err := stagedFiles(ctx, path)
+	if err != nil {
+		return err
+	}
+	blocked, err := ReadBlockedFiles(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	var holds []string
+	for _, file := range files {
+		// A submodule is checked in its own sync.
+		if info, err := os.Stat(filepath.Join(path, file)); err == nil && info.IsDir() {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(path, file))
+		if err != nil {
+			return fmt.Errorf("unable to read %s. Err: %v", file, err)
+		}
+
+		reasons, err := checkFile(ctx, path, file, content, hooks)
+		if err != nil {
+			return err
+		}
+		if len(reasons) == 0 {
+			delete(blocked, file)
+			continue
+		}
+
+		message := fmt.Sprintf("%s in %s: %s", path, file, strings.Join(reasons, ", "))
+		if hooks.OnHit == OnHitHoldPush {
+			holds = append(holds, message)
+			notify(ctx, hooks, fmt.Sprintf("Holding the push. Found %s", message))
+			continue
+		}
+
+		err = unstage(ctx, path, file)
+		if err != nil {
+			return err
+		}
+
+		hash := hashContent(content)
+		if blocked[file] != hash {
+			notify(ctx, hooks, fmt.Sprintf("Not committing the file. Found %s", message))
+		}
+		blocked[file] = hash
+	}
+
+	err = writeBlockedFiles(ctx, path, blocked)
+	if err != nil {
+		return err
+	}
+
+	if len(holds) > 0 {
+		existing, err := readStateFile(ctx, path, pushHoldName)
+		if err != nil {
+			return err
+		}
+		return writeStateFile(ctx, path, pushHoldName, existing+strings.Join(holds, "\n")+"\n")
+	}
+	return nil
+}
+
+func checkFile(ctx context.Context, path string, file string, content []byte, hooks HooksConfig) ([]string, error) {
+	var reasons []string
+	if hooks.Secrets {
+		reasons = append(reasons, ScanSecrets(content)...)
+	}
+
+	for _, command := range hooks.Commands {
+		args := append(strings.Fields(command), file)
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Dir = path
+
+		out, err := combinedOutputTimeout(ctx, cmd, localTimeout(ctx))
+		if _, ok := err.(*exec.ExitError); ok {
+			reason := fmt.Sprintf("`%s` failed", command)
+			if output := strings.TrimSpace(string(out)); output != "" {
+				reason = fmt.Sprintf("%s (%s)", reason, output)
+			}
+			reasons = append(reasons, reason)
+		} else if err != nil {
+			return nil, fmt.Errorf("unable to run the hook `%s`. Err: %w", command, err)
+		}
+	}
+
+	return reasons, nil
+}
+
+func notify(ctx context.Context, hooks HooksConfig, message string) {
+	log.Print(message)
+	if hooks.Notify == "" {
+		return
+	}
+
+	args := append(strings.Fields(hooks.Notify), message)
+	err := runTimeout(ctx, exec.Command(args[0], args[1:]...), localTimeout(ctx))
+	if err != nil {
+		log.Printf("Unable to notify with `%s`. Err: %v", hooks.Notify, err)
+	}
+}
+
+func stagedFiles(ctx context.Context, path string) ([]string, error) {
+	out, err := runCmdStdout(ctx, path, "git", "diff", "--cached", "--name-only", "--diff-filter=ACMR", "-z")
+	if err != nil {
+		return nil, fmt.Errorf("unable to list the staged files. Err: %v", err)
+	}
+	return splitNul(out), nil
+}
+
+func unstage(ctx context.Context, path string, file string) error {
+	_, err := runCmd(ctx, path, "git", "rev-parse", "--verify", "-q", "HEAD")
+	if err != nil {
+		// There's no commit to reset to yet.
+		_, err = runCmd(ctx, path, "git", "rm", "--cached", "-q", "--", file)
+	} else {
+		_, err = runCmd(ctx, path, "git", "reset", "-q", "--", file)
+	}
+
+	if err != nil {
+		return fmt.Errorf("unable to unstage %s. Err: %v", file, err)
+	}
+	return nil
+}
+
+func hashContent(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func ReadBlockedFiles(ctx context.Context, path string) (BlockedFiles, error) {
+	content, err := readStateFile(ctx, path, blockedFilesName)
+	if err != nil {
+		return nil, err
+	}
+
+	blocked := BlockedFiles{}
+	if content == "" {
+		return blocked, nil
+	}
+	err = json.Unmarshal([]byte(content), &blocked)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the blocked files. Err: %v", err)
+	}
+	return blocked, nil
+}
+
+func writeBlockedFiles(ctx context.Context, path string, blocked BlockedFiles) error {
+	if len(blocked) == 0 {
+		return removeStateFile(ctx, path, blockedFilesName)
+	}
+
+	content, err := json.MarshalIndent(blocked, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeStateFile(ctx, path, blockedFilesName, string(content))
+}
+
+// IsStillBlocked returns true when the file is blocked and hasn't changed since.
+func (b BlockedFiles) IsStillBlocked(path string, file string) bool {
+	hash, ok := b[file]
+	if !ok {
+		return false
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(path, file))
+	if err != nil {
+		return false
+	}
+	return hashContent(content) == hash
+}
+
+// Files returns the blocked files in order.
+func (b BlockedFiles) Files() []string {
+	var files []string
+	for file := range b {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func IsPushHeld(ctx context.Context, path string) (bool, error) {
+	return stateFileExists(ctx, path, pushHoldName)
+}
+
+// ReleasePush lets the held commits be pushed on the next sync.
+func ReleasePush(ctx context.Context, path string) error {
+	held, err := IsPushHeld(ctx, path)
+	if err != nil {
+		return err
+	}
+	if !held {
+		return fmt.Errorf("the push of %s is not held", path)
+	}
+	return removeStateFile(ctx, path, pushHoldName)
+}
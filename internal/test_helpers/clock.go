@@ -0,0 +1,119 @@
+package test_helpers
+
+import (
+	"sync"
+	"time"
+)
+
+// FakeClock only moves when Advance is called. It implements the Clock of git-notes.
+type FakeClock struct {
+	mutex   sync.Mutex
+	changed *sync.Cond
+	now     time.Time
+	waiters []*waiter
+}
+
+type waiter struct {
+	at   time.Time
+	fire func()
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	clock := &FakeClock{now: now}
+	clock.changed = sync.NewCond(&clock.mutex)
+	return clock
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// Sleep blocks until the clock is advanced past the duration.
+func (c *FakeClock) Sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+
+	done := make(chan struct{})
+	c.add(d, func() { close(done) })
+	<-done
+}
+
+// AfterFunc calls f when the clock is advanced past the duration. Unlike time.AfterFunc, f runs in the goroutine
+// that calls Advance, so everything f does has happened when Advance returns.
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) func() bool {
+	w := c.add(d, f)
+
+	return func() bool {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		for i, pending := range c.waiters {
+			if pending == w {
+				c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+				c.changed.Broadcast()
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func (c *FakeClock) add(d time.Duration, fire func()) *waiter {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	w := &waiter{at: c.now.Add(d), fire: fire}
+	c.waiters = append(c.waiters, w)
+	c.changed.Broadcast()
+	return w
+}
+
+// Advance moves the clock forward and fires the sleeps and the timers that are due, in order. Timers that are set
+// by the fired ones fire too when they are due.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	target := c.now.Add(d)
+
+	for {
+		next := -1
+		for i, w := range c.waiters {
+			if !w.at.After(target) && (next == -1 || w.at.Before(c.waiters[next].at)) {
+				next = i
+			}
+		}
+		if next == -1 {
+			break
+		}
+
+		w := c.waiters[next]
+		c.waiters = append(c.waiters[:next], c.waiters[next+1:]...)
+		c.now = w.at
+		c.changed.Broadcast()
+
+		c.mutex.Unlock()
+		w.fire()
+		c.mutex.Lock()
+	}
+
+	c.now = target
+	c.mutex.Unlock()
+}
+
+// BlockUntil waits until there are at least n pending sleeps and timers, e.g. until a goroutine has gone back to
+// sleep after the last Advance.
+func (c *FakeClock) BlockUntil(n int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for len(c.waiters) < n {
+		c.changed.Wait()
+	}
+}
+
+func (c *FakeClock) Waiters() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.waiters)
+}
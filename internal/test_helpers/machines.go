@@ -0,0 +1,222 @@
+package test_helpers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Machines is one bare remote with several clones of it. Each clone stands in for a machine that runs git-notes.
+type Machines struct {
+	Remote string
+	Clones []string
+	// Shared are the files that every machine edits. They are in the first commit.
+	Shared []string
+}
+
+func SetupMachines(count int, sharedCount int) Machines {
+	remote := SetupGitRepo("Remote", true)
+
+	seed := SetupGitRepo("Seed", false)
+	defer CleanupRepo(seed)
+	SetupRemote(seed, remote)
+
+	var shared []string
+	for i := 0; i < sharedCount; i++ {
+		file := fmt.Sprintf("shared-%d.md", i)
+		shared = append(shared, file)
+		mustWrite(filepath.Join(seed, file), fmt.Sprintf("# Shared note %d\n", i))
+	}
+	mustRun(seed, "git", "add", "--all")
+	mustRun(seed, "git", "-c", "user.name=Seed", "-c", "user.email=seed@noemail.com", "commit", "--allow-empty", "-m", "Seed")
+	mustRun(seed, "git", "push", "origin", GetLocalBranch(seed), "-u")
+
+	var clones []string
+	for i := 0; i < count; i++ {
+		dir, err := ioutil.TempDir("", fmt.Sprintf("git_test_Machine%d", i))
+		if err != nil {
+			log.Fatalf("Unable to create a temp dir for a machine")
+		}
+		mustRun(dir, "git", "clone", "-q", remote, "notes")
+		clones = append(clones, filepath.Join(dir, "notes"))
+	}
+
+	log.Printf("Remote: %s, Machines: %v", remote, clones)
+	return Machines{Remote: remote, Clones: clones, Shared: shared}
+}
+
+func CleanupMachines(machines Machines) {
+	CleanupRepo(machines.Remote)
+	for _, clone := range machines.Clones {
+		CleanupRepo(filepath.Dir(clone))
+	}
+}
+
+func mustRun(path string, command string, args ...string) string {
+	c := exec.Command(command, args...)
+	c.Dir = path
+	out, err := c.CombinedOutput()
+	if err != nil {
+		log.Fatalf("Unable to run %s %v in %s. Error: %v, %s", command, args, path, err, out)
+	}
+	return string(out)
+}
+
+func mustWrite(path string, content string) {
+	err := ioutil.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		log.Fatalf("Unable to write %s. Error: %v", path, err)
+	}
+}
+
+// Converged returns true when every clone is clean and at the same commit as the remote.
+func Converged(machines Machines) (bool, string) {
+	branch := GetLocalBranch(machines.Clones[0])
+	remoteHead := strings.TrimSpace(mustRun(machines.Remote, "git", "rev-parse", branch))
+
+	for _, clone := range machines.Clones {
+		status := mustRun(clone, "git", "status", "--porcelain")
+		if strings.TrimSpace(status) != "" {
+			return false, fmt.Sprintf("%s is dirty: %s", clone, status)
+		}
+		head := strings.TrimSpace(mustRun(clone, "git", "rev-parse", "HEAD"))
+		if head != remoteHead {
+			return false, fmt.Sprintf("%s is at %s, but the remote is at %s", clone, head, remoteHead)
+		}
+	}
+	return true, ""
+}
+
+// Scenario drives random edits, deletes and renames on the machines, and remembers the token that every edit wrote,
+// so it can tell whether an edit was lost. Every machine has its own files, which only it edits, deletes and renames.
+// The shared files are edited by every machine, so they get conflicts. Step can be called concurrently for different
+// machines.
+type Scenario struct {
+	machines Machines
+	rands    []*rand.Rand
+
+	mutex sync.Mutex
+	// The tokens that every live file must contain.
+	tokens  map[string][]string
+	deleted map[string]bool
+	counts  []int
+}
+
+func NewScenario(machines Machines, seed int64) *Scenario {
+	log.Printf("Scenario seed: %d", seed)
+
+	scenario := &Scenario{
+		machines: machines,
+		tokens:   map[string][]string{},
+		deleted:  map[string]bool{},
+		counts:   make([]int, len(machines.Clones)),
+	}
+	for i := range machines.Clones {
+		scenario.rands = append(scenario.rands, rand.New(rand.NewSource(seed+int64(i))))
+	}
+	return scenario
+}
+
+// Step performs one random operation on the machine.
+func (s *Scenario) Step(t *testing.T, machine int) {
+	clone := s.machines.Clones[machine]
+	r := s.rands[machine]
+
+	s.mutex.Lock()
+	s.counts[machine]++
+	token := fmt.Sprintf("machine-%d-edit-%d", machine, s.counts[machine])
+	own := s.ownFiles(machine)
+	s.mutex.Unlock()
+
+	operation := r.Intn(10)
+	switch {
+	case operation < 4 && len(s.machines.Shared) > 0:
+		s.appendToken(t, clone, s.machines.Shared[r.Intn(len(s.machines.Shared))], token)
+	case operation < 6 || len(own) == 0:
+		file := fmt.Sprintf("machine-%d-note-%d.md", machine, s.counts[machine])
+		if len(own) > 0 && r.Intn(2) == 0 {
+			file = own[r.Intn(len(own))]
+		}
+		s.appendToken(t, clone, file, token)
+	case operation < 8:
+		file := own[r.Intn(len(own))]
+		log.Printf("Machine %d deletes %s", machine, file)
+		assert.NoError(t, os.Remove(filepath.Join(clone, file)))
+
+		s.mutex.Lock()
+		delete(s.tokens, file)
+		s.deleted[file] = true
+		s.mutex.Unlock()
+	default:
+		file := own[r.Intn(len(own))]
+		renamed := fmt.Sprintf("machine-%d-renamed-%d.md", machine, s.counts[machine])
+		log.Printf("Machine %d renames %s to %s", machine, file, renamed)
+		assert.NoError(t, os.Rename(filepath.Join(clone, file), filepath.Join(clone, renamed)))
+
+		s.mutex.Lock()
+		s.tokens[renamed] = s.tokens[file]
+		delete(s.tokens, file)
+		s.deleted[file] = true
+		s.mutex.Unlock()
+	}
+}
+
+func (s *Scenario) ownFiles(machine int) []string {
+	prefix := fmt.Sprintf("machine-%d-", machine)
+
+	var files []string
+	for file := range s.tokens {
+		if strings.HasPrefix(file, prefix) {
+			files = append(files, file)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+func (s *Scenario) appendToken(t *testing.T, clone string, file string, token string) {
+	log.Printf("Write %s to %s in %s", token, file, clone)
+
+	f, err := os.OpenFile(filepath.Join(clone, file), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	_, err = f.WriteString(token + "\n")
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	s.mutex.Lock()
+	s.tokens[file] = append(s.tokens[file], token)
+	delete(s.deleted, file)
+	s.mutex.Unlock()
+}
+
+// AssertNoLostEdits checks that every live file in the clone has the tokens of all its edits, and that the deleted
+// and renamed files are gone.
+func (s *Scenario) AssertNoLostEdits(t *testing.T, clone string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for file, tokens := range s.tokens {
+		content, err := ioutil.ReadFile(filepath.Join(clone, file))
+		if !assert.NoError(t, err, "%s is missing in %s", file, clone) {
+			continue
+		}
+		for _, token := range tokens {
+			assert.Contains(t, string(content), token+"\n", "%s lost %s in %s", file, token, clone)
+		}
+	}
+
+	for file := range s.deleted {
+		_, err := os.Stat(filepath.Join(clone, file))
+		assert.True(t, os.IsNotExist(err), "%s should be deleted in %s", file, clone)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	JournalStart      = "start"
+	JournalTransition = "transition"
+	JournalCommit     = "commit"
+	JournalMerge      = "merge"
+	JournalConflict   = "conflict"
+	JournalPush       = "push"
+	JournalError      = "error"
+	// JournalDeletionHold is recorded when too many deleted files wait for a confirmation.
+	JournalDeletionHold = "deletion-hold"
+	// JournalBackup is recorded when a mirror backs up its local changes or commits.
+	JournalBackup = "backup"
+)
+
+const journalName = "journal.jsonl"
+
+// The journal is rotated to `journal.jsonl.1`, `journal.jsonl.2` and so on when it grows past the max size. Only
+// the last files are kept.
+var (
+	journalMaxSize  int64 = 1 << 20
+	journalMaxFiles       = 5
+)
+
+var journalMutex sync.Mutex
+
+// JournalEntry is one line of the journal that git-notes keeps in `.git/git-notes/journal.jsonl` of every repo.
+type JournalEntry struct {
+	Time    time.Time `json:"time"`
+	Host    string    `json:"host"`
+	Event   string    `json:"event"`
+	From    State     `json:"from,omitempty"`
+	To      State     `json:"to,omitempty"`
+	Sha     string    `json:"sha,omitempty"`
+	Files   []string  `json:"files,omitempty"`
+	Message string    `json:"message,omitempty"`
+}
+
+func (e JournalEntry) String() string {
+	parts := []string{e.Time.Format(time.RFC3339), e.Host, e.Event}
+	if e.From != "" || e.To != "" {
+		if e.From != "" {
+			parts = append(parts, fmt.Sprintf("%s -> %s", e.From, e.To))
+		} else {
+			parts = append(parts, string(e.To))
+		}
+	}
+	if e.Sha != "" {
+		parts = append(parts, e.Sha)
+	}
+	if len(e.Files) > 0 {
+		parts = append(parts, strings.Join(e.Files, ", "))
+	}
+	if e.Message != "" {
+		parts = append(parts, e.Message)
+	}
+	return strings.Join(parts, " ")
+}
+
+func hostname() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return host
+}
+
+func AppendJournal(ctx context.Context, path string, entry JournalEntry) error {
+	if entry.Host == "" {
+		entry.Host = hostname()
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	file, err := stateFilePath(ctx, path, journalName)
+	if err != nil {
+		return err
+	}
+
+	journalMutex.Lock()
+	defer journalMutex.Unlock()
+
+	if info, err := os.Stat(file); err == nil && info.Size()+int64(len(line)) >= journalMaxSize {
+		err = rotateJournal(file)
+		if err != nil {
+			return err
+		}
+	}
+
+	out, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = out.Write(append(line, '\n'))
+	return err
+}
+
+func rotateJournal(file string) error {
+	_ = os.Remove(fmt.Sprintf("%s.%d", file, journalMaxFiles-1))
+	for i := journalMaxFiles - 2; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", file, i), fmt.Sprintf("%s.%d", file, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(file, file+".1")
+}
+
+// ReadJournal returns the entries from the oldest to the newest. A zero since or until leaves that end open.
+func ReadJournal(ctx context.Context, path string, since time.Time, until time.Time) ([]JournalEntry, error) {
+	file, err := stateFilePath(ctx, path, journalName)
+	if err != nil {
+		return nil, err
+	}
+
+	journalMutex.Lock()
+	defer journalMutex.Unlock()
+
+	var entries []JournalEntry
+	for i := journalMaxFiles - 1; i >= 0; i-- {
+		name := file
+		if i > 0 {
+			name = fmt.Sprintf("%s.%d", file, i)
+		}
+
+		read, err := readJournalFile(name, since, until)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, read...)
+	}
+	return entries, nil
+}
+
+// LastSync returns the entry of the state that the last sync reached, and its error entry when it failed. A zero
+// state entry means that no sync is recorded.
+func LastSync(ctx context.Context, path string) (JournalEntry, JournalEntry, error) {
+	entries, err := ReadJournal(ctx, path, time.Time{}, time.Time{})
+	if err != nil {
+		return JournalEntry{}, JournalEntry{}, err
+	}
+
+	var state, failure JournalEntry
+	for _, entry := range entries {
+		if entry.Event == JournalStart {
+			failure = JournalEntry{}
+		}
+		if entry.To != "" {
+			state = entry
+		}
+		if entry.Event == JournalError {
+			failure = entry
+		}
+	}
+	return state, failure, nil
+}
+
+func readJournalFile(file string, since time.Time, until time.Time) ([]JournalEntry, error) {
+	in, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry JournalEntry
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s. Err: %v", filepath.Base(file), err)
+		}
+
+		if (!since.IsZero() && entry.Time.Before(since)) || (!until.IsZero() && entry.Time.After(until)) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// ParseTime parses the times given to the subcommands: RFC3339, `2006-01-02 15:04`, `2006-01-02`, or a duration
+// before now like `90m`, `2h` or `3d`.
+func ParseTime(value string, now time.Time) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		t, err := time.ParseInLocation(layout, value, time.Local)
+		if err == nil {
+			return t, nil
+		}
+	}
+
+	if strings.HasSuffix(value, "d") {
+		days, err := time.ParseDuration(strings.TrimSuffix(value, "d") + "h")
+		if err == nil {
+			return now.Add(-24 * days), nil
+		}
+	}
+	duration, err := time.ParseDuration(value)
+	if err == nil {
+		return now.Add(-duration), nil
+	}
+
+	return time.Time{}, fmt.Errorf("invalid time: %s", value)
+}
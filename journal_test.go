@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"git-notes/internal/test_helpers"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func events(entries []JournalEntry) []string {
+	var result []string
+	for _, entry := range entries {
+		result = append(result, entry.Event)
+	}
+	return result
+}
+
+func TestJournal_AppendAndRead(t *testing.T) {
+	path := test_helpers.SetupGitRepo("journal", false)
+	defer test_helpers.CleanupRepo(path)
+
+	start := time.Date(2021, 6, 7, 12, 0, 0, 0, time.Local)
+	for i := 0; i < 3; i++ {
+		err := AppendJournal(context.Background(), path, JournalEntry{Time: start.Add(time.Duration(i) * time.Hour), Event: JournalStart, To: Dirty})
+		assert.NoError(t, err)
+	}
+
+	entries, err := ReadJournal(context.Background(), path, time.Time{}, time.Time{})
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+	assert.Equal(t, hostname(), entries[0].Host)
+	assert.Equal(t, Dirty, entries[0].To)
+
+	entries, err = ReadJournal(context.Background(), path, start.Add(30*time.Minute), start.Add(90*time.Minute))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, start.Add(time.Hour).Unix(), entries[0].Time.Unix())
+}
+
+func TestJournal_Rotate(t *testing.T) {
+	path := test_helpers.SetupGitRepo("journal", false)
+	defer test_helpers.CleanupRepo(path)
+
+	maxSize, maxFiles := journalMaxSize, journalMaxFiles
+	journalMaxSize, journalMaxFiles = 200, 3
+	defer func() { journalMaxSize, journalMaxFiles = maxSize, maxFiles }()
+
+	start := time.Date(2021, 6, 7, 12, 0, 0, 0, time.Local)
+	for i := 0; i < 20; i++ {
+		err := AppendJournal(context.Background(), path, JournalEntry{Time: start.Add(time.Duration(i) * time.Minute), Event: JournalPush, Sha: "0123456789abcdef"})
+		assert.NoError(t, err)
+	}
+
+	// Only the newest entries are kept, from the oldest to the newest.
+	entries, err := ReadJournal(context.Background(), path, time.Time{}, time.Time{})
+	assert.NoError(t, err)
+	assert.True(t, len(entries) > 0 && len(entries) < 20)
+	assert.Equal(t, start.Add(19*time.Minute).Unix(), entries[len(entries)-1].Time.Unix())
+	for i := 1; i < len(entries); i++ {
+		assert.True(t, entries[i-1].Time.Before(entries[i].Time))
+	}
+
+	exists, err := stateFileExists(context.Background(), path, journalName+".3")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2021, 6, 7, 12, 0, 0, 0, time.Local)
+
+	for value, expected := range map[string]time.Time{
+		"2021-06-01T10:00:00Z": time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC),
+		"2021-06-01 10:30":     time.Date(2021, 6, 1, 10, 30, 0, 0, time.Local),
+		"2021-06-01":           time.Date(2021, 6, 1, 0, 0, 0, 0, time.Local),
+		"90m":                  now.Add(-90 * time.Minute),
+		"3d":                   now.Add(-72 * time.Hour),
+	} {
+		parsed, err := ParseTime(value, now)
+		assert.NoError(t, err, value)
+		assert.True(t, expected.Equal(parsed), value)
+	}
+
+	_, err := ParseTime("yesterday", now)
+	assert.Error(t, err)
+}
+
+func TestJournal_Sync(t *testing.T) {
+	repos := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(repos)
+	git := GitCmd{}
+
+	test_helpers.WriteFile(t, repos.Local, "test.md", "TestContent")
+	assert.NoError(t, git.Sync(repos.Local))
+
+	entries, err := ReadJournal(context.Background(), repos.Local, time.Time{}, time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{JournalStart, JournalCommit, JournalTransition, JournalPush, JournalTransition}, events(entries))
+	assert.Equal(t, Dirty, entries[0].To)
+	assert.Equal(t, []string{"test.md"}, entries[1].Files)
+	assert.NotEmpty(t, entries[1].Sha)
+	assert.Equal(t, Dirty, entries[2].From)
+	assert.Equal(t, Ahead, entries[2].To)
+	assert.Equal(t, entries[1].Sha, entries[3].Sha)
+	assert.Equal(t, Sync, entries[4].To)
+}
+
+func TestJournal_Conflict(t *testing.T) {
+	repos := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(repos)
+	git := GitCmd{}
+
+	// Branch can differ depending on git config: init.defaultbranch
+	branch := test_helpers.GetLocalBranch(repos.Local)
+
+	test_helpers.WriteFile(t, repos.Local, "test.md", "TestContent")
+	test_helpers.PerformCmd(t, repos.Local, "git", "add", "--all")
+	test_helpers.PerformCmd(t, repos.Local, "git", "commit", "-m", "Test local")
+	test_helpers.PerformCmd(t, repos.Local, "git", "push", "origin", branch, "-u")
+
+	makeConflict(t, repos.Remote)
+	test_helpers.WriteFile(t, repos.Local, "test.md", "TestContent2")
+	assert.NoError(t, git.Sync(repos.Local))
+
+	entries, err := ReadJournal(context.Background(), repos.Local, time.Time{}, time.Time{})
+	assert.NoError(t, err)
+	var conflicts []JournalEntry
+	for _, entry := range entries {
+		if entry.Event == JournalConflict {
+			conflicts = append(conflicts, entry)
+		}
+	}
+	if assert.Len(t, conflicts, 1) {
+		assert.Equal(t, []string{"test.md"}, conflicts[0].Files)
+		assert.NotEmpty(t, conflicts[0].Sha)
+	}
+}
+
+func TestLastSync(t *testing.T) {
+	path := test_helpers.SetupGitRepo("journal", false)
+	defer test_helpers.CleanupRepo(path)
+
+	state, failure, err := LastSync(context.Background(), path)
+	assert.NoError(t, err)
+	assert.Equal(t, State(""), state.To)
+
+	at := time.Date(2021, 6, 7, 12, 0, 0, 0, time.UTC)
+	assert.NoError(t, AppendJournal(context.Background(), path, JournalEntry{Time: at, Event: JournalStart, To: Dirty}))
+	assert.NoError(t, AppendJournal(context.Background(), path, JournalEntry{Time: at, Event: JournalTransition, From: Dirty, To: Ahead}))
+	assert.NoError(t, AppendJournal(context.Background(), path, JournalEntry{Time: at, Event: JournalError, Message: "unable to push"}))
+
+	state, failure, err = LastSync(context.Background(), path)
+	assert.NoError(t, err)
+	assert.Equal(t, Ahead, state.To)
+	assert.Equal(t, "unable to push", failure.Message)
+
+	// A sync that succeeds clears the error.
+	assert.NoError(t, AppendJournal(context.Background(), path, JournalEntry{Time: at.Add(time.Minute), Event: JournalStart, To: Sync}))
+	state, failure, err = LastSync(context.Background(), path)
+	assert.NoError(t, err)
+	assert.Equal(t, Sync, state.To)
+	assert.Equal(t, at.Add(time.Minute), state.Time)
+	assert.Empty(t, failure.Message)
+}
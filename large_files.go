@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	lfsAttributes   = "filter=lfs diff=lfs merge=lfs -text"
+	lfsVerifiedName = "lfs-verified"
+)
+
+// ParseSize parses sizes like `500KB`, `10MB` or `1GB`. A plain number is in bytes.
+func ParseSize(size string) (int64, error) {
+	size = strings.ToUpper(strings.TrimSpace(size))
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	}
+
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(size, unit.suffix) {
+			size = strings.TrimSpace(strings.TrimSuffix(size, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	value, err := strconv.ParseFloat(size, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size: %s", size)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+// lfsPattern turns a file path into a gitattributes pattern that matches only that file.
+func lfsPattern(file string) string {
+	replacer := strings.NewReplacer(
+		`\`, `\\`,
+		"*", `\*`,
+		"?", `\?`,
+		"[", `\[`,
+		" ", "[[:space:]]",
+		"\t", "[[:space:]]",
+	)
+	return "/" + replacer.Replace(file)
+}
+
+// TrackLargeFiles adds the configured patterns, and the changed files above the size threshold, to `.gitattributes`
+// as Git LFS files. `git add` then stores them as LFS pointers, and `.gitattributes` is committed with them.
+func TrackLargeFiles(ctx context.Context, path string, largeFiles LargeFilesConfig) error {
+	if !largeFiles.Enabled() {
+		return nil
+	}
+
+	patterns := append([]string{}, largeFiles.Patterns...)
+
+	if largeFiles.Threshold != "" {
+		threshold, err := ParseSize(largeFiles.Threshold)
+		if err != nil {
+			return err
+		}
+
+		files, err := ChangedFiles(ctx, path)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			info, err := os.Stat(filepath.Join(path, file))
+			if err != nil || info.IsDir() || info.Size() <= threshold {
+				continue
+			}
+
+			filter, err := runCmdStdout(ctx, path, "git", "check-attr", "filter", "--", file)
+			if err != nil {
+				return fmt.Errorf("unable to check the attributes of %s. Err: %v", file, err)
+			}
+			if !strings.HasSuffix(strings.TrimSpace(filter), ": filter: lfs") {
+				patterns = append(patterns, lfsPattern(file))
+			}
+		}
+	}
+
+	return addAttributes(filepath.Join(path, ".gitattributes"), patterns, lfsAttributes)
+}
+
+func addAttributes(file string, patterns []string, attributes string) error {
+	existing, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	lines := map[string]bool{}
+	for _, line := range strings.Split(string(existing), "\n") {
+		lines[strings.TrimSpace(line)] = true
+	}
+
+	content := string(existing)
+	for _, pattern := range patterns {
+		line := pattern + " " + attributes
+		if lines[line] {
+			continue
+		}
+		if content != "" && !strings.HasSuffix(content, "\n") {
+			content += "\n"
+		}
+		content += line + "\n"
+		lines[line] = true
+	}
+
+	if content == string(existing) {
+		return nil
+	}
+	return ioutil.WriteFile(file, []byte(content), 0644)
+}
+
+func SetupLargeFiles(ctx context.Context, path string) error {
+	out, err := runCmd(ctx, path, "git", "lfs", "install", "--local")
+	if err != nil {
+		return fmt.Errorf("git-lfs is needed for the large files of %s. Err: %v, %s", path, err, out)
+	}
+	return nil
+}
+
+// IsLargeFilesVerified returns true when the LFS objects of HEAD have been confirmed on the remote.
+func IsLargeFilesVerified(ctx context.Context, path string) (bool, error) {
+	head, err := runCmdStdout(ctx, path, "git", "rev-parse", "HEAD")
+	if err != nil {
+		// There's nothing to upload without a commit.
+		return true, nil
+	}
+
+	verified, err := readStateFile(ctx, path, lfsVerifiedName)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(verified) == strings.TrimSpace(head), nil
+}
+
+// PushLargeFiles uploads the LFS objects of HEAD. The LFS server skips the objects it has, so this also verifies
+// that every object of HEAD is on the remote, even the ones whose upload failed in an earlier push.
+func PushLargeFiles(ctx context.Context, path string, credentials CredentialsConfig) error {
+	head, err := runCmdStdout(ctx, path, "git", "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+
+	out, err := runCmdStdout(ctx, path, "git", "lfs", "ls-files", "--long")
+	if err != nil {
+		return fmt.Errorf("unable to list the LFS files. Err: %v", err)
+	}
+
+	var oids []string
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 {
+			oids = append(oids, fields[0])
+		}
+	}
+
+	if len(oids) > 0 {
+		output, err := runRemoteCmd(ctx, path, credentials, append([]string{"lfs", "push", "--object-id", "origin"}, oids...)...)
+		if _, ok := err.(*AuthError); ok {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("unable to upload the LFS objects. Err: %w, %s", err, output)
+		}
+	}
+
+	return writeStateFile(ctx, path, lfsVerifiedName, head)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"git-notes/internal/test_helpers"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSize(t *testing.T) {
+	for size, expected := range map[string]int64{"100": 100, "100B": 100, "2KB": 2048, "1.5mb": 1572864, "1 GB": 1 << 30} {
+		value, err := ParseSize(size)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, value)
+	}
+
+	_, err := ParseSize("big")
+	assert.EqualError(t, err, "invalid size: BIG")
+}
+
+func TestLfsPattern(t *testing.T) {
+	assert.Equal(t, "/shots/a.png", lfsPattern("shots/a.png"))
+	assert.Equal(t, "/my[[:space:]]shot\\*.png", lfsPattern("my shot*.png"))
+}
+
+func TestTrackLargeFiles(t *testing.T) {
+	path := test_helpers.SetupGitRepo("large_files", false)
+	defer test_helpers.CleanupRepo(path)
+
+	largeFiles := LargeFilesConfig{Patterns: []string{"*.pdf"}, Threshold: "1KB"}
+
+	test_helpers.WriteFile(t, path, ".gitattributes", "*.md text")
+	test_helpers.WriteFile(t, path, "small.png", "small")
+	test_helpers.WriteFile(t, path, "big.md", strings.Repeat("a", 2048))
+	test_helpers.WriteFile(t, path, "my shot.png", strings.Repeat("a", 2048))
+
+	assert.NoError(t, TrackLargeFiles(context.Background(), path, largeFiles))
+	assert.NoError(t, TrackLargeFiles(context.Background(), path, largeFiles))
+
+	content, err := ioutil.ReadFile(filepath.Join(path, ".gitattributes"))
+	assert.NoError(t, err)
+	assert.Equal(t, "*.md text\n"+
+		"*.pdf filter=lfs diff=lfs merge=lfs -text\n"+
+		"/big.md filter=lfs diff=lfs merge=lfs -text\n"+
+		"/my[[:space:]]shot.png filter=lfs diff=lfs merge=lfs -text\n", string(content))
+
+	filter, err := runCmdStdout(context.Background(), path, "git", "check-attr", "filter", "--", "my shot.png")
+	assert.NoError(t, err)
+	assert.Equal(t, "my shot.png: filter: lfs\n", filter)
+
+	// Files matching a pattern aren't added one by one.
+	test_helpers.WriteFile(t, path, "paper.pdf", strings.Repeat("a", 2048))
+	assert.NoError(t, TrackLargeFiles(context.Background(), path, largeFiles))
+	after, err := ioutil.ReadFile(filepath.Join(path, ".gitattributes"))
+	assert.NoError(t, err)
+	assert.Equal(t, content, after)
+}
+
+func TestLargeFiles_ValidateWithEncryption(t *testing.T) {
+	err := validateRepoConfig(RepoConfig{
+		LargeFiles: LargeFilesConfig{Patterns: []string{"*.pdf"}},
+		Encryption: EncryptionConfig{KeyFile: "key"},
+	})
+	assert.EqualError(t, err, "large files can't be routed through Git LFS in an encrypted repo")
+
+	err = validateRepoConfig(RepoConfig{LargeFiles: LargeFilesConfig{Threshold: "huge"}})
+	assert.EqualError(t, err, "invalid size: HUGE")
+}
+
+func TestLargeFiles_Sync(t *testing.T) {
+	if _, err := runCmd(context.Background(), ".", "git", "lfs", "version"); err != nil {
+		t.Skip("git-lfs is not installed")
+	}
+
+	repos := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(repos)
+
+	git := gitWithSettings(RepoConfig{LargeFiles: LargeFilesConfig{Threshold: "1KB"}}, repos.Local)
+
+	test_helpers.WriteFile(t, repos.Local, "note.md", "Small note")
+	test_helpers.WriteFile(t, repos.Local, "shot.png", strings.Repeat("a", 2048))
+
+	assert.NoError(t, git.Sync(repos.Local))
+
+	state, err := git.GetState(repos.Local)
+	assert.NoError(t, err)
+	assert.Equal(t, Sync, state)
+
+	pointer, err := runCmdStdout(context.Background(), repos.Local, "git", "show", "HEAD:shot.png")
+	assert.NoError(t, err)
+	assert.Contains(t, pointer, "git-lfs")
+
+	// A missing verification is treated as an unfinished push.
+	assert.NoError(t, removeStateFile(context.Background(), repos.Local, lfsVerifiedName))
+	state, err = git.GetState(repos.Local)
+	assert.NoError(t, err)
+	assert.Equal(t, Ahead, state)
+}
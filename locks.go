@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The daemon locks every repo in `.git/git-notes/daemon.lock`, so two daemons never race on `git add` and `git
+// commit`, e.g. one started by systemd and one by hand.
+const repoLockName = "daemon.lock"
+
+// lockHolder is the content of a lock file. It only names the holder in the errors. The lock itself is an advisory
+// lock of the OS on the open file, which is released when the process dies, so it's never stale.
+type lockHolder struct {
+	Pid     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Started time.Time `json:"started"`
+	Command string    `json:"command"`
+}
+
+// LockedError names the process that holds the lock.
+type LockedError struct {
+	// What is locked, e.g. `the repo ~/notes`.
+	What   string
+	File   string
+	Holder lockHolder
+}
+
+func (e *LockedError) Error() string {
+	if e.Holder.Pid == 0 {
+		// The holder is still writing the file.
+		return fmt.Sprintf("%s is already monitored by git-notes (see %s). Stop that process", e.What, e.File)
+	}
+	return fmt.Sprintf("%s is already monitored by git-notes (pid %d on %s, started at %s: %s). Stop that process",
+		e.What, e.Holder.Pid, e.Holder.Host, e.Holder.Started.Format(time.RFC3339), e.Holder.Command)
+}
+
+// Locks holds the locks of this process until it exits. A nil Locks doesn't lock anything.
+type Locks struct {
+	mutex sync.Mutex
+	held  map[string]*os.File
+}
+
+func NewLocks() *Locks {
+	return &Locks{held: map[string]*os.File{}}
+}
+
+// LockRepo locks the repo for this process.
+func (l *Locks) LockRepo(path string) error {
+	if l == nil {
+		return nil
+	}
+	file, err := stateFilePath(context.Background(), path, repoLockName)
+	if err != nil {
+		return err
+	}
+	return l.lock(file, "the repo "+path)
+}
+
+// LockConfig locks the config file for this process. The lock is in `$XDG_RUNTIME_DIR` or the temp dir, since the
+// config might be read-only.
+func (l *Locks) LockConfig(configPath string) error {
+	if l == nil {
+		return nil
+	}
+	return l.lock(configLockPath(configPath), "the config "+configPath)
+}
+
+func configLockPath(configPath string) string {
+	absolute, err := filepath.Abs(configPath)
+	if err != nil {
+		absolute = configPath
+	}
+	hash := sha256.Sum256([]byte(absolute))
+
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, fmt.Sprintf("git-notes-%s.lock", hex.EncodeToString(hash[:8])))
+}
+
+func (l *Locks) lock(file string, what string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.held[file] != nil {
+		return nil
+	}
+
+	locked, err := acquireLock(file, what)
+	if err != nil {
+		return err
+	}
+	l.held[file] = locked
+	return nil
+}
+
+// Release releases the locks, e.g. when the daemon stops. The lock files stay, since a process that has just opened
+// one would otherwise lock a file that the next process no longer sees.
+func (l *Locks) Release() {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for file, locked := range l.held {
+		_ = locked.Truncate(0)
+		err := locked.Close()
+		if err != nil {
+			log.Printf("Unable to release the lock %s. Err: %v", file, err)
+		}
+		delete(l.held, file)
+	}
+}
+
+// acquireLock locks the file, and writes this process in it. The file stays open to keep the lock.
+func acquireLock(file string, what string) (*os.File, error) {
+	locked, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to lock %s. Err: %v", what, err)
+	}
+	ok, err := tryLockFile(locked)
+	if err != nil || !ok {
+		_ = locked.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to lock %s. Err: %v", what, err)
+		}
+		var other lockHolder
+		existing, err := ioutil.ReadFile(file)
+		if err == nil {
+			_ = json.Unmarshal(existing, &other)
+		}
+		return nil, &LockedError{What: what, File: file, Holder: other}
+	}
+
+	holder := lockHolder{Pid: os.Getpid(), Host: hostname(), Started: time.Now(), Command: strings.Join(os.Args, " ")}
+	content, err := json.Marshal(holder)
+	if err == nil {
+		err = locked.Truncate(0)
+	}
+	if err == nil {
+		_, err = locked.WriteAt(content, 0)
+	}
+	if err != nil {
+		_ = locked.Close()
+		return nil, fmt.Errorf("unable to lock %s. Err: %v", what, err)
+	}
+	return locked, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"git-notes/internal/test_helpers"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeLock(t *testing.T, file string, holder lockHolder) {
+	content, err := json.Marshal(holder)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(file, content, 0644))
+}
+
+func readLock(t *testing.T, file string) lockHolder {
+	var holder lockHolder
+	content, err := ioutil.ReadFile(file)
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(content, &holder))
+	return holder
+}
+
+func TestLockRepo(t *testing.T) {
+	repos := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(repos)
+	file, err := stateFilePath(context.Background(), repos.Local, repoLockName)
+	assert.NoError(t, err)
+
+	// Another daemon holds the lock. The locks of the OS don't care that it's the same process.
+	other := NewLocks()
+	assert.NoError(t, other.LockRepo(repos.Local))
+	holder := readLock(t, file)
+	assert.Equal(t, os.Getpid(), holder.Pid)
+
+	locks := NewLocks()
+	err = locks.LockRepo(repos.Local)
+	assert.EqualError(t, err, fmt.Sprintf("the repo %s is already monitored by git-notes (pid %d on %s, started at "+
+		"%s: %s). Stop that process", repos.Local, holder.Pid, hostname(), holder.Started.Format(time.RFC3339),
+		holder.Command))
+	assert.IsType(t, &LockedError{}, err)
+
+	// The lock is free once the other daemon stops.
+	other.Release()
+	assert.NoError(t, locks.LockRepo(repos.Local))
+	assert.NoError(t, locks.LockRepo(repos.Local))
+	assert.IsType(t, &LockedError{}, other.LockRepo(repos.Local))
+
+	locks.Release()
+	assert.NoError(t, other.LockRepo(repos.Local))
+	other.Release()
+}
+
+func TestLockRepo_LeftOverFile(t *testing.T) {
+	repos := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(repos)
+	file, err := stateFilePath(context.Background(), repos.Local, repoLockName)
+	assert.NoError(t, err)
+
+	// The file of a process that is gone doesn't lock anything, whatever it says.
+	writeLock(t, file, lockHolder{Pid: 999999, Host: "elsewhere"})
+	locks := NewLocks()
+	defer locks.Release()
+	assert.NoError(t, locks.LockRepo(repos.Local))
+	assert.Equal(t, os.Getpid(), readLock(t, file).Pid)
+}
+
+func TestLockRepo_Race(t *testing.T) {
+	repos := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(repos)
+
+	// Only one of the daemons that start at once gets the lock.
+	var wait sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			errs <- NewLocks().LockRepo(repos.Local)
+		}()
+	}
+	wait.Wait()
+	close(errs)
+
+	locked := 0
+	for err := range errs {
+		if err == nil {
+			locked++
+		} else {
+			assert.IsType(t, &LockedError{}, err)
+		}
+	}
+	assert.Equal(t, 1, locked)
+}
+
+func TestLockConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "git-notes-locks")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, os.Setenv("XDG_RUNTIME_DIR", dir))
+	defer os.Unsetenv("XDG_RUNTIME_DIR")
+
+	file := configLockPath("notes.json")
+	assert.Equal(t, dir, filepath.Dir(file))
+	assert.NotEqual(t, file, configLockPath("other.json"))
+
+	other := NewLocks()
+	defer other.Release()
+	assert.NoError(t, other.LockConfig("notes.json"))
+
+	locks := NewLocks()
+	defer locks.Release()
+	err = locks.LockConfig("notes.json")
+	assert.Contains(t, fmt.Sprint(err), fmt.Sprintf("the config notes.json is already monitored by git-notes (pid %d",
+		os.Getpid()))
+	assert.NoError(t, locks.LockConfig("other.json"))
+
+	var nilLocks *Locks
+	assert.NoError(t, nilLocks.LockConfig("notes.json"))
+	assert.NoError(t, nilLocks.LockRepo("some-path"))
+	nilLocks.Release()
+}
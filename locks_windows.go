@@ -0,0 +1,34 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+	errorLockViolation      = syscall.Errno(33)
+)
+
+// tryLockFile locks the file with LockFileEx without waiting, and returns false when another handle holds it. The
+// lock is released when the file is closed, or when the process dies. It locks a byte far past the content, since
+// the others can't read the locked bytes, and they read the content for the error.
+func tryLockFile(file *os.File) (bool, error) {
+	overlapped := syscall.Overlapped{OffsetHigh: 0x7fffffff}
+	ok, _, err := procLockFileEx.Call(file.Fd(), lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0,
+		uintptr(unsafe.Pointer(&overlapped)))
+	if ok != 0 {
+		return true, nil
+	}
+	if err == errorLockViolation {
+		return false, nil
+	}
+	return false, err
+}
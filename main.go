@@ -1,38 +1,68 @@
 package main
 
 import (
-	"fmt"
+	"context"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
 var Running = true
 
 func main() {
+	if len(os.Args) >= 2 {
+		if command, ok := commands[os.Args[1]]; ok {
+			err := command(os.Args[2:])
+			if err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
 	log.Println("Git Notes is starting...")
 
-	var git = NewGoGit()
+	var relay = NewRelay(RealClock{})
+	var locks = NewLocks()
+	var git = NewGoGit(relay, NewPeers(RealClock{}), locks)
 	var watcher = GitWatcher{
 		git:     &git,
+		clock:   RealClock{},
 		running: false,
 		checkInterval: 10 * time.Second,
 		delayBeforeFiringEvent: 2 * time.Second,
 		delayAfterFiringEvent: 5 * time.Second,
 	}
-	var configReader = JsonConfigReader{}
+	var configReader = FileConfigReader{}
+	var health = NewHealth(RealClock{})
 	var gitRepoMonitor = GitRepoMonitor{
 		scheduledUpdateInterval: 5 * time.Minute,
+		clock:                   RealClock{},
+		health:                  health,
+		relay:                   relay,
+		locks:                   locks,
 	}
 
-	Run(&git, &watcher, &configReader, &gitRepoMonitor)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		// The syncs that are running are cancelled, so their git commands don't outlive the daemon.
+		gitRepoMonitor.Stop()
+		locks.Release()
+		os.Exit(0)
+	}()
+
+	Run(&git, &watcher, &configReader, &gitRepoMonitor, health, locks)
 
 	for Running {
 		time.Sleep(1 * time.Second)
 	}
 }
 
-func Run(git Git, watcher Watcher, configReader ConfigReader, monitor PathMonitor) {
+func Run(git Git, watcher Watcher, configReader ConfigReader, monitor PathMonitor, health *Health, locks *Locks) {
 	if len(os.Args) < 2 {
 		log.Fatal("Please pass the config file path as the first argument.")
 	}
@@ -42,10 +72,44 @@ func Run(git Git, watcher Watcher, configReader ConfigReader, monitor PathMonito
 	if err != nil {
 		log.Fatalf("Unable to read the config file. Err: %v", err)
 	}
+	err = locks.LockConfig(configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	fmt.Println(config)
+	// The config isn't printed, since it holds the tokens of the relay and the peers.
+	log.Printf("Syncing %d repos", len(config.Repos))
+	git.Configure(config)
+	health.Configure(config.Health, config.Timeouts)
 	for _, repoPath := range config.Repos {
 		monitor.StartMonitoring(repoPath, watcher, git)
 	}
+
+	if config.Relay.Listen != "" {
+		err = ServeRelay(config.Relay.Listen, config.Relay.Token)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if config.Peers.Listen != "" {
+		err = ServePeers(WithTimeouts(context.Background(), config.Timeouts), config.Peers, config.Repos)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if config.Health.Listen != "" {
+		err = health.Serve(config.Health.Listen)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	err = sdNotify("READY=1\nSTATUS=" + health.Status())
+	if err != nil {
+		log.Printf("Unable to notify systemd. Err: %v", err)
+	}
+	startWatchdog(health, RealClock{})
 }
 
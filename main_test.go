@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"git-notes/internal/test_helpers"
 	"io/ioutil"
+	"log"
 	"os"
 	"testing"
 	"time"
@@ -11,10 +12,34 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// Git runs the filters of the encrypted-repo mode with `os.Executable()`, which is the test binary here. The env
+// makes the test binary act as git-notes for those subprocesses.
+const runMainEnv = "GIT_NOTES_TEST_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) != "" {
+		main()
+		os.Exit(0)
+	}
+
+	_ = os.Setenv(runMainEnv, "1")
+
+	// Keep the machine-wide files, e.g. the metered flag, of the developer out of the tests.
+	configHome, err := ioutil.TempDir("", "git-notes-config-home")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_ = os.Setenv("XDG_CONFIG_HOME", configHome)
+
+	code := m.Run()
+	test_helpers.CleanupRepo(configHome)
+	os.Exit(code)
+}
+
 func TestMainFunc(t *testing.T) {
 	Running = true
 
-	var git = NewGoGit()
+	var git = NewGoGit(nil, nil, nil)
 
 	repos := test_helpers.SetupRepos()
 	defer test_helpers.CleanupRepos(repos)
@@ -70,10 +95,11 @@ func TestRun(t *testing.T) {
 	os.Args = []string{"app", "some-git-notes.json"}
 	defer func() { os.Args = oldArgs }()
 
-	Run(&git, &watcher, &configReader, &monitor)
+	Run(&git, &watcher, &configReader, &monitor, nil, nil)
 
 	assert.Equal(t, "some-git-notes.json", configReader.readPath)
 	assert.Equal(t, []string{"some-path", "some-path-2"}, monitor.startMonitorPaths)
+	assert.Equal(t, []string{"some-path", "some-path-2"}, git.config.Repos)
 }
 
 type MockConfigReader struct {
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"regexp"
+	"strings"
+)
+
+// The inline Markdown that RenderMarkdown supports. They match the escaped text.
+var (
+	markdownCode   = regexp.MustCompile("`([^`]+)`")
+	markdownBold   = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+	markdownItalic = regexp.MustCompile(`\*([^*\s][^*]*)\*|\b_([^_\s][^_]*)_\b`)
+	markdownLink   = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	markdownList   = regexp.MustCompile(`^\s*([-*+]|\d+[.)])\s+(.*)$`)
+	markdownTask   = regexp.MustCompile(`^\[([ xX])\]\s+`)
+)
+
+// RenderMarkdown renders the common Markdown of notes: headings, paragraphs, lists, task lists, quotes, code blocks,
+// code, emphasis and links. Everything is escaped first, so the notes can't inject HTML.
+func RenderMarkdown(source string) template.HTML {
+	var out strings.Builder
+	var paragraph []string
+	list := ""
+
+	closeParagraph := func() {
+		if len(paragraph) > 0 {
+			out.WriteString("<p>" + strings.Join(paragraph, "<br>\n") + "</p>\n")
+			paragraph = nil
+		}
+	}
+	closeList := func() {
+		if list != "" {
+			out.WriteString("</" + list + ">\n")
+			list = ""
+		}
+	}
+
+	lines := strings.Split(strings.ReplaceAll(source, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case strings.HasPrefix(trimmed, "```"):
+			closeParagraph()
+			closeList()
+			out.WriteString("<pre><code>")
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+				out.WriteString(html.EscapeString(lines[i]) + "\n")
+			}
+			out.WriteString("</code></pre>\n")
+		case trimmed == "":
+			closeParagraph()
+			closeList()
+		case strings.HasPrefix(trimmed, "#"):
+			level := len(trimmed) - len(strings.TrimLeft(trimmed, "#"))
+			if level > 6 || (len(trimmed) > level && trimmed[level] != ' ') {
+				paragraph = append(paragraph, renderInline(trimmed))
+				continue
+			}
+			closeParagraph()
+			closeList()
+			out.WriteString(fmt.Sprintf("<h%d>%s</h%d>\n", level, renderInline(strings.TrimSpace(trimmed[level:])), level))
+		case trimmed == "---" || trimmed == "***":
+			closeParagraph()
+			closeList()
+			out.WriteString("<hr>\n")
+		case strings.HasPrefix(trimmed, ">"):
+			closeParagraph()
+			closeList()
+			out.WriteString("<blockquote>" + renderInline(strings.TrimSpace(strings.TrimPrefix(trimmed, ">"))) + "</blockquote>\n")
+		case markdownList.MatchString(line):
+			closeParagraph()
+			match := markdownList.FindStringSubmatch(line)
+			kind := "ul"
+			if match[1][0] >= '0' && match[1][0] <= '9' {
+				kind = "ol"
+			}
+			if list != kind {
+				closeList()
+				out.WriteString("<" + kind + ">\n")
+				list = kind
+			}
+			item := match[2]
+			if task := markdownTask.FindStringSubmatch(item); task != nil {
+				checked := ""
+				if task[1] != " " {
+					checked = " checked"
+				}
+				item = fmt.Sprintf(`<input type="checkbox" disabled%s> %s`, checked, renderInline(item[len(task[0]):]))
+			} else {
+				item = renderInline(item)
+			}
+			out.WriteString("<li>" + item + "</li>\n")
+		default:
+			closeList()
+			paragraph = append(paragraph, renderInline(trimmed))
+		}
+	}
+	closeParagraph()
+	closeList()
+
+	// The content is escaped above.
+	return template.HTML(out.String())
+}
+
+func renderInline(text string) string {
+	text = html.EscapeString(text)
+
+	// The code spans are set aside, so nothing inside them is rendered.
+	var codes []string
+	text = markdownCode.ReplaceAllStringFunc(text, func(code string) string {
+		codes = append(codes, "<code>"+markdownCode.FindStringSubmatch(code)[1]+"</code>")
+		return fmt.Sprintf("\x00%d\x00", len(codes)-1)
+	})
+
+	text = markdownLink.ReplaceAllStringFunc(text, func(link string) string {
+		match := markdownLink.FindStringSubmatch(link)
+		url := html.UnescapeString(match[2])
+		if strings.Contains(url, ":") && !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") &&
+			!strings.HasPrefix(url, "mailto:") {
+			// Only the safe schemes are linked, e.g. not `javascript:`.
+			return link
+		}
+		return fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(url), match[1])
+	})
+	text = markdownBold.ReplaceAllString(text, "<strong>$1$2</strong>")
+	text = markdownItalic.ReplaceAllString(text, "<em>$1$2</em>")
+
+	for i, code := range codes {
+		text = strings.Replace(text, fmt.Sprintf("\x00%d\x00", i), code, 1)
+	}
+	return text
+}
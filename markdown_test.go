@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	source := "# Title\n\nSome **bold**, *italic* and `co*de` in snake_case_name.\nNext line\n\n" +
+		"- [x] done\n- [ ] todo\n1. first\n\n> quoted\n\n```\n<b>code</b>\n```\n#hashtag"
+
+	assert.Equal(t, "<h1>Title</h1>\n"+
+		"<p>Some <strong>bold</strong>, <em>italic</em> and <code>co*de</code> in snake_case_name.<br>\nNext line</p>\n"+
+		"<ul>\n<li><input type=\"checkbox\" disabled checked> done</li>\n<li><input type=\"checkbox\" disabled> todo</li>\n</ul>\n"+
+		"<ol>\n<li>first</li>\n</ol>\n"+
+		"<blockquote>quoted</blockquote>\n"+
+		"<pre><code>&lt;b&gt;code&lt;/b&gt;\n</code></pre>\n"+
+		"<p>#hashtag</p>\n", string(RenderMarkdown(source)))
+}
+
+func TestRenderMarkdown_Escapes(t *testing.T) {
+	assert.Equal(t, "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n", string(RenderMarkdown("<script>alert(1)</script>")))
+	assert.Equal(t, "<p><a href=\"https://example.com/?a=1&amp;b=2\">link</a></p>\n", string(RenderMarkdown("[link](https://example.com/?a=1&b=2)")))
+	assert.Equal(t, "<p>[link](javascript:alert(1))</p>\n", string(RenderMarkdown("[link](javascript:alert(1))")))
+	assert.Equal(t, "<p><a href=\"other.md\">relative</a></p>\n", string(RenderMarkdown("[relative](other.md)")))
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// The local commits of a mirror are backed up to a branch named after the time and the commit, e.g.
+// `git-notes-backup/20210607-120000-1a2b3c4d`.
+const mirrorBackupPrefix = "git-notes-backup/"
+
+// mirrorState returns the state of a mirror once its working tree is clean. Its local commits are backed up and
+// replaced with the remote branch, so it's out of sync whenever it differs.
+func (g *GitCmd) mirrorState(path string, state State, remote bool) State {
+	switch {
+	case state == Sync:
+		return Sync
+	case !remote:
+		log.Printf("The schedule defers the remote operations of %s", path)
+		return Deferred
+	}
+	return OutOfSync
+}
+
+// ResetMirror backs up the local changes to the stash and the local commits to a branch, then resets the branch to
+// the remote branch, or to the branch of a peer with new commits. It never commits on the branch.
+func (g *GitCmd) ResetMirror(ctx context.Context, path string) error {
+	now := orRealClock(g.clock).Now()
+
+	files, err := ChangedFiles(ctx, path)
+	if err != nil {
+		return err
+	}
+	if len(files) > 0 {
+		message := fmt.Sprintf("git-notes backup at %s", now.Format(time.RFC3339))
+		out, err := runCmd(ctx, path, "git", "stash", "push", "--include-untracked", "-m", message)
+		if err != nil {
+			return fmt.Errorf("unable to back up the local changes. Err: %v, %s", err, strings.TrimSpace(out))
+		}
+		stash, _ := runCmdStdout(ctx, path, "git", "rev-parse", "stash@{0}")
+		log.Printf("Backed up the local changes of %s to the stash: %s", path, strings.Join(files, ", "))
+		g.record(ctx, path, JournalEntry{Event: JournalBackup, Sha: strings.TrimSpace(stash), Files: files, Message: "stash"})
+	}
+
+	branch, err := GetBranch(ctx, path)
+	if err != nil {
+		return err
+	}
+	upstream, err := g.mergeSource(ctx, path, branch)
+	if err != nil {
+		return err
+	}
+	target, err := runCmdStdout(ctx, path, "git", "rev-parse", "--verify", "-q", upstream)
+	target = strings.TrimSpace(target)
+	if err != nil || target == head(ctx, path) {
+		// E.g. nothing is pushed yet.
+		return nil
+	}
+
+	forward, err := canFastForward(ctx, path, upstream)
+	if err != nil {
+		return err
+	}
+	if !forward {
+		backup := mirrorBackupPrefix + now.Format("20060102-150405") + "-" + shortSha(head(ctx, path))
+		out, err := runCmd(ctx, path, "git", "branch", backup, "HEAD")
+		if err != nil {
+			return fmt.Errorf("unable to back up the local commits. Err: %v, %s", err, strings.TrimSpace(out))
+		}
+		log.Printf("Backed up the local commits of %s to the branch %s", path, backup)
+		g.record(ctx, path, JournalEntry{Event: JournalBackup, Sha: head(ctx, path), Message: backup})
+	}
+
+	out, err := runCmd(ctx, path, "git", "reset", "--hard", "-q", target)
+	if err != nil {
+		return fmt.Errorf("unable to reset to %s. Err: %v, %s", upstream, err, strings.TrimSpace(out))
+	}
+	g.record(ctx, path, JournalEntry{Event: JournalMerge, Sha: target})
+	g.index(ctx, path)
+	return nil
+}
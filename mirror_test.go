@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"git-notes/internal/test_helpers"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMirrorBacksUpLocalChanges(t *testing.T) {
+	machines := test_helpers.SetupMachines(2, 1)
+	defer test_helpers.CleanupMachines(machines)
+	mirror, other := machines.Clones[0], machines.Clones[1]
+	git := gitWithSettings(RepoConfig{Mode: ModeMirror}, mirror)
+
+	test_helpers.WriteFile(t, other, "b.md", "b")
+	assert.NoError(t, (&GitCmd{}).Sync(other))
+
+	test_helpers.WriteFile(t, mirror, machines.Shared[0], "Edited by accident")
+	test_helpers.WriteFile(t, mirror, "scratch.md", "Left behind")
+	assert.NoError(t, git.Sync(mirror))
+
+	state, err := git.GetState(mirror)
+	assert.NoError(t, err)
+	assert.Equal(t, Sync, state)
+	assert.Equal(t, head(context.Background(), other), head(context.Background(), mirror))
+	assert.Equal(t, "", gitOutput(t, mirror, "status", "--porcelain"))
+	assert.Equal(t, "# Shared note 0\n", readNote(t, mirror, machines.Shared[0]))
+
+	// The stash keeps the changes, and the untracked files in its third parent.
+	assert.Equal(t, "Edited by accident", gitOutput(t, mirror, "show", "stash@{0}:"+machines.Shared[0]))
+	assert.Equal(t, "Left behind", gitOutput(t, mirror, "show", "stash@{0}^3:scratch.md"))
+
+	entries, err := ReadJournal(context.Background(), mirror, time.Time{}, time.Time{})
+	assert.NoError(t, err)
+	var backups []JournalEntry
+	for _, entry := range entries {
+		if entry.Event == JournalBackup {
+			backups = append(backups, entry)
+		}
+	}
+	if assert.Len(t, backups, 1) {
+		assert.ElementsMatch(t, []string{"scratch.md", machines.Shared[0]}, backups[0].Files)
+		assert.Equal(t, "stash", backups[0].Message)
+	}
+	assert.NotContains(t, remoteFiles(t, test_helpers.Repos{Local: mirror, Remote: machines.Remote}), "scratch.md")
+}
+
+func TestMirrorBacksUpLocalCommits(t *testing.T) {
+	machines := test_helpers.SetupMachines(2, 0)
+	defer test_helpers.CleanupMachines(machines)
+	mirror, other := machines.Clones[0], machines.Clones[1]
+	git := gitWithSettings(RepoConfig{Mode: ModeMirror}, mirror)
+
+	test_helpers.WriteFile(t, mirror, "a.md", "a")
+	test_helpers.PerformCmd(t, mirror, "git", "add", "a.md")
+	test_helpers.PerformCmd(t, mirror, "git", "commit", "-m", "By hand")
+	local := head(context.Background(), mirror)
+
+	// Ahead of the remote.
+	assert.NoError(t, git.Sync(mirror))
+	assert.Equal(t, head(context.Background(), other), head(context.Background(), mirror))
+
+	test_helpers.WriteFile(t, mirror, "c.md", "c")
+	test_helpers.PerformCmd(t, mirror, "git", "add", "c.md")
+	test_helpers.PerformCmd(t, mirror, "git", "commit", "-m", "By hand again")
+	test_helpers.WriteFile(t, other, "b.md", "b")
+	assert.NoError(t, (&GitCmd{}).Sync(other))
+
+	// Diverged from the remote.
+	assert.NoError(t, git.Sync(mirror))
+	assert.Equal(t, head(context.Background(), other), head(context.Background(), mirror))
+	assert.Equal(t, "", gitOutput(t, mirror, "status", "--porcelain"))
+
+	branches := strings.Fields(gitOutput(t, mirror, "for-each-ref", "--format=%(objectname)", "refs/heads/"+mirrorBackupPrefix))
+	assert.Contains(t, branches, local)
+	assert.Len(t, branches, 2)
+	assert.NotContains(t, remoteFiles(t, test_helpers.Repos{Local: mirror, Remote: machines.Remote}), "a.md")
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+)
+
+// The modes of a repo. The config sets them per repo, and `git-notes mode <repo> <mode>` overrides them while the
+// daemon runs.
+const (
+	// ModeActive commits, merges and pushes. It's the default.
+	ModeActive = "active"
+	// ModePaused leaves the repo alone.
+	ModePaused = "paused"
+	// ModeCommitOnly commits the changes, but never fetches or pushes.
+	ModeCommitOnly = "commit-only"
+	// ModePullOnly never commits the local changes, and fast-forwards to the remote.
+	ModePullOnly = "pull-only"
+	// ModeMirror follows the remote, e.g. on a build box. The local changes and commits are backed up and reset.
+	ModeMirror = "mirror"
+)
+
+const modeOverrideName = "mode"
+
+func validateMode(mode string) error {
+	switch mode {
+	case "", ModeActive, ModePaused, ModeCommitOnly, ModePullOnly, ModeMirror:
+		return nil
+	}
+	return fmt.Errorf("unknown mode: %s", mode)
+}
+
+// ReadModeOverride returns the mode that `git-notes mode` set, or an empty string.
+func ReadModeOverride(ctx context.Context, path string) (string, error) {
+	mode, err := readStateFile(ctx, path, modeOverrideName)
+	return strings.TrimSpace(mode), err
+}
+
+// SetModeOverride overrides the mode of the config. An empty mode goes back to the config.
+func SetModeOverride(ctx context.Context, path string, mode string) error {
+	err := validateMode(mode)
+	if err != nil {
+		return err
+	}
+	if mode == "" {
+		return removeStateFile(ctx, path, modeOverrideName)
+	}
+	return writeStateFile(ctx, path, modeOverrideName, mode+"\n")
+}
+
+// mode returns the mode that overrides the config, or the mode of the config.
+func (g *GitCmd) mode(ctx context.Context, path string) (string, error) {
+	mode, err := ReadModeOverride(ctx, path)
+	if err != nil {
+		return "", fmt.Errorf("unable to read the mode of %s. Err: %v", path, err)
+	}
+	if mode == "" {
+		mode = g.config.RepoSettings(path).Mode
+	}
+	if mode == "" {
+		mode = ModeActive
+	}
+	return mode, validateMode(mode)
+}
+
+// pullOnlyState returns the state of a repo that only fast-forwards. The local commits are never pushed, and the
+// remote can't be merged once the branches diverge.
+func (g *GitCmd) pullOnlyState(ctx context.Context, path string, branch string, state State, remote bool) (State, error) {
+	switch {
+	case state == Sync:
+		return Sync, nil
+	case state == Ahead:
+		return Restricted, nil
+	case !remote:
+		log.Printf("The schedule defers the remote operations of %s", path)
+		return Deferred, nil
+	}
+
+	upstream, err := g.mergeSource(ctx, path, branch)
+	if err != nil {
+		return Error, err
+	}
+	forward, err := canFastForward(ctx, path, upstream)
+	if err != nil {
+		return Error, err
+	}
+	if !forward {
+		log.Printf("Not merging %s, because it has local commits and it's pull-only", path)
+		return Restricted, nil
+	}
+	return OutOfSync, nil
+}
+
+// canFastForward returns whether the upstream contains HEAD.
+func canFastForward(ctx context.Context, path string, upstream string) (bool, error) {
+	cmd := exec.Command("git", "merge-base", "--is-ancestor", "HEAD", upstream)
+	cmd.Dir = path
+	err := runTimeout(ctx, cmd, localTimeout(ctx))
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("unable to compare HEAD with %s. Err: %v", upstream, err)
+	}
+	return true, nil
+}
+
+// FastForward moves the branch to the remote branch, or to the branch of a peer, without a commit.
+func (g *GitCmd) FastForward(ctx context.Context, path string) error {
+	branch, err := GetBranch(ctx, path)
+	if err != nil {
+		return err
+	}
+	upstream, err := g.mergeSource(ctx, path, branch)
+	if err != nil {
+		return err
+	}
+
+	out, err := runCmd(ctx, path, "git", "merge", "--ff-only", upstream)
+	if err != nil {
+		return fmt.Errorf("unable to fast-forward to %s. Err: %v, %s", upstream, err, strings.TrimSpace(out))
+	}
+	g.record(ctx, path, JournalEntry{Event: JournalMerge, Sha: head(ctx, path)})
+	g.index(ctx, path)
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"git-notes/internal/test_helpers"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func gitOutput(t *testing.T, path string, args ...string) string {
+	out, err := runCmdStdout(context.Background(), path, "git", args...)
+	assert.NoError(t, err)
+	return out
+}
+
+func TestPausedMode(t *testing.T) {
+	machines := test_helpers.SetupMachines(1, 0)
+	defer test_helpers.CleanupMachines(machines)
+	local := machines.Clones[0]
+	git := gitWithSettings(RepoConfig{Mode: ModePaused}, local)
+
+	test_helpers.WriteFile(t, local, "a.md", "a")
+	assert.NoError(t, git.Sync(local))
+
+	state, err := git.GetState(local)
+	assert.NoError(t, err)
+	assert.Equal(t, Paused, state)
+	assert.Contains(t, gitOutput(t, local, "status", "--porcelain"), "a.md")
+}
+
+func TestCommitOnlyMode(t *testing.T) {
+	machines := test_helpers.SetupMachines(2, 0)
+	defer test_helpers.CleanupMachines(machines)
+	local, other := machines.Clones[0], machines.Clones[1]
+	git := gitWithSettings(RepoConfig{Mode: ModeCommitOnly}, local)
+
+	test_helpers.WriteFile(t, other, "b.md", "b")
+	assert.NoError(t, (&GitCmd{}).Sync(other))
+
+	test_helpers.WriteFile(t, local, "a.md", "a")
+	assert.NoError(t, git.Sync(local))
+
+	state, err := git.GetState(local)
+	assert.NoError(t, err)
+	assert.Equal(t, Restricted, state)
+	assert.Equal(t, "", gitOutput(t, local, "status", "--porcelain"))
+	// Nothing is fetched or pushed.
+	assert.NotContains(t, remoteFiles(t, test_helpers.Repos{Local: local, Remote: machines.Remote}), "a.md")
+	_, err = runCmd(context.Background(), local, "git", "cat-file", "-e", head(context.Background(), other))
+	assert.Error(t, err)
+}
+
+func TestPullOnlyMode(t *testing.T) {
+	machines := test_helpers.SetupMachines(2, 0)
+	defer test_helpers.CleanupMachines(machines)
+	local, other := machines.Clones[0], machines.Clones[1]
+	git := gitWithSettings(RepoConfig{Mode: ModePullOnly}, local)
+
+	test_helpers.WriteFile(t, other, "b.md", "b")
+	assert.NoError(t, (&GitCmd{}).Sync(other))
+
+	test_helpers.WriteFile(t, local, "a.md", "a")
+	assert.NoError(t, git.Sync(local))
+
+	state, err := git.GetState(local)
+	assert.NoError(t, err)
+	assert.Equal(t, Sync, state)
+	assert.Equal(t, head(context.Background(), other), head(context.Background(), local))
+	// The local change is left alone.
+	assert.Equal(t, "?? a.md\n", gitOutput(t, local, "status", "--porcelain"))
+	assert.NotContains(t, remoteFiles(t, test_helpers.Repos{Local: local, Remote: machines.Remote}), "a.md")
+
+	// A local commit is never pushed, and the remote isn't merged into it.
+	test_helpers.PerformCmd(t, local, "git", "add", "a.md")
+	test_helpers.PerformCmd(t, local, "git", "commit", "-m", "By hand")
+	test_helpers.WriteFile(t, other, "c.md", "c")
+	assert.NoError(t, (&GitCmd{}).Sync(other))
+	assert.NoError(t, git.Sync(local))
+
+	state, err = git.GetState(local)
+	assert.NoError(t, err)
+	assert.Equal(t, Restricted, state)
+	assert.NotContains(t, remoteFiles(t, test_helpers.Repos{Local: local, Remote: machines.Remote}), "a.md")
+}
+
+func TestModeOverride(t *testing.T) {
+	machines := test_helpers.SetupMachines(1, 0)
+	defer test_helpers.CleanupMachines(machines)
+	local := machines.Clones[0]
+	git := gitWithSettings(RepoConfig{Mode: ModePaused}, local)
+
+	assert.NoError(t, SetModeOverride(context.Background(), local, ModeActive))
+	mode, err := git.mode(context.Background(), local)
+	assert.NoError(t, err)
+	assert.Equal(t, ModeActive, mode)
+
+	test_helpers.WriteFile(t, local, "a.md", "a")
+	assert.NoError(t, git.Sync(local))
+	assert.Contains(t, remoteFiles(t, test_helpers.Repos{Local: local, Remote: machines.Remote}), "a.md")
+
+	// Back to the config.
+	assert.NoError(t, SetModeOverride(context.Background(), local, ""))
+	mode, err = git.mode(context.Background(), local)
+	assert.NoError(t, err)
+	assert.Equal(t, ModePaused, mode)
+
+	assert.EqualError(t, SetModeOverride(context.Background(), local, "sleeping"), "unknown mode: sleeping")
+
+	mode, err = (&GitCmd{}).mode(context.Background(), local)
+	assert.NoError(t, err)
+	assert.Equal(t, ModeActive, mode)
+}
@@ -1,10 +1,19 @@
 package main
 
 import (
+	"context"
 	"log"
+	"sync"
 	"time"
 )
 
+// After a sync times out, the next syncs are skipped for a while, which doubles up to the max on every timeout in a
+// row. A hung remote then doesn't get a new fetch on every change.
+const (
+	minTimeoutBackoff = time.Minute
+	maxTimeoutBackoff = 30 * time.Minute
+)
+
 type PathMonitor interface {
 	StartMonitoring(repoPath string, watcher Watcher, git Git)
 	scheduleUpdate(repoPath string, channel chan string)
@@ -12,32 +21,117 @@ type PathMonitor interface {
 
 type GitRepoMonitor struct {
 	scheduledUpdateInterval time.Duration
+	clock                   Clock
+	health                  *Health
+	relay                   *Relay
+	locks                   *Locks
+
+	mutex sync.Mutex
+	// ctx is cancelled by Stop.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// loops are the sync loops of the repos.
+	loops sync.WaitGroup
+}
+
+// lifetime returns the context of the syncs, which is cancelled once the monitor is stopped.
+func (g *GitRepoMonitor) lifetime() context.Context {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.ctx == nil {
+		g.ctx, g.cancel = context.WithCancel(context.Background())
+	}
+	return g.ctx
+}
+
+// Stop ends the monitoring of every repo, and the scheduled updates. The syncs that are running are cancelled, which
+// kills their git commands, and Stop returns once they've ended.
+func (g *GitRepoMonitor) Stop() {
+	g.lifetime()
+	g.cancel()
+	g.loops.Wait()
 }
 
 func (g *GitRepoMonitor) scheduleUpdate(repoPath string, channel chan string) {
-	time.AfterFunc(g.scheduledUpdateInterval, func() {
-		channel <- repoPath
-		g.scheduleUpdate(repoPath, channel)
+	ctx := g.lifetime()
+	orRealClock(g.clock).AfterFunc(g.scheduledUpdateInterval, func() {
+		select {
+		case channel <- repoPath:
+			g.scheduleUpdate(repoPath, channel)
+		case <-ctx.Done():
+		}
 	})
 }
 
+// nextBackoff returns the backoff after the result of a sync.
+func nextBackoff(err error, backoff time.Duration) time.Duration {
+	if !IsTimeout(err) {
+		return 0
+	}
+
+	backoff *= 2
+	if backoff < minTimeoutBackoff {
+		backoff = minTimeoutBackoff
+	}
+	if backoff > maxTimeoutBackoff {
+		backoff = maxTimeoutBackoff
+	}
+	log.Printf("Backing off for %v after the timeout", backoff)
+	return backoff
+}
+
 func (g *GitRepoMonitor) StartMonitoring(repoPath string, watcher Watcher, git Git) {
 	var channel = make(chan string)
-	err := git.Sync(repoPath)
+	g.health.Watch(repoPath)
+	err := g.locks.LockRepo(repoPath)
 	if err != nil {
-		log.Printf("Syncing failed. Err: %v", err)
+		// The other repos are still monitored, and the health reports this one as failing, but not as stalled.
+		log.Printf("Not monitoring %s. Err: %v", repoPath, err)
+		g.health.NotMonitored(repoPath, err)
+		return
 	}
+
+	// The scheduled updates catch up on the pushes that the relay misses.
 	g.scheduleUpdate(repoPath, channel)
+	g.relay.Subscribe(repoPath, channel)
 
 	watcher.Watch(repoPath, channel)
 
+	ctx := g.lifetime()
+	g.loops.Add(1)
 	go func() {
+		defer g.loops.Done()
+		// The first sync runs here too, so that a slow remote doesn't hold up the start of the other repos.
+		err := git.SyncContext(ctx, repoPath)
+		if err != nil {
+			log.Printf("Syncing failed. Err: %v", err)
+		}
+		g.health.Checked(repoPath, err)
+		backoff := nextBackoff(err, 0)
+		retryAt := orRealClock(g.clock).Now().Add(backoff)
+
 		for {
-			path := <-channel
-			err = git.Sync(path)
+			var path string
+			select {
+			case path = <-channel:
+			case <-ctx.Done():
+				log.Printf("Git notes stopped monitoring %s", repoPath)
+				return
+			}
+			if orRealClock(g.clock).Now().Before(retryAt) {
+				// The loop still makes progress.
+				log.Printf("Skipping the sync of %s until %v", path, retryAt)
+				g.health.Checked(path, err)
+				continue
+			}
+
+			err = git.SyncContext(ctx, path)
 			if err != nil {
 				log.Printf("Syncing failed. Err: %v", err)
 			}
+			g.health.Checked(path, err)
+			backoff = nextBackoff(err, backoff)
+			retryAt = orRealClock(g.clock).Now().Add(backoff)
 		}
 	}()
 
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"git-notes/internal/test_helpers"
+	"os"
 	"testing"
 	"time"
 
@@ -8,54 +12,159 @@ import (
 )
 
 func TestGitRepoMonitor_StartMonitoring(t *testing.T) {
+	var clock = test_helpers.NewFakeClock(time.Now())
 	var gitRepoMonitor = GitRepoMonitor{
 		scheduledUpdateInterval: time.Minute,
+		clock:                   clock,
 	}
 	var watcher = MockWatcher{}
-	var git = MockGit{}
+	var git = MockGit{synced: make(chan string, 10)}
 
 	gitRepoMonitor.StartMonitoring("some-path", &watcher, &git)
 
 	assert.Equal(t, "some-path", watcher.repoPath)
+	assert.Equal(t, "some-path", <-git.synced)
 	assert.Equal(t, 1, git.Count)
 
 	watcher.channel <- watcher.repoPath
 
-	time.Sleep(1 * time.Second)
+	assert.Equal(t, "some-path", <-git.synced)
 	assert.Equal(t, 2, git.Count)
 }
 
 func TestGitRepoMonitor_StartMonitoringAutomaticScheduleUpdate(t *testing.T) {
+	var clock = test_helpers.NewFakeClock(time.Now())
 	var gitRepoMonitor = GitRepoMonitor{
-		scheduledUpdateInterval: 100 * time.Millisecond,
+		scheduledUpdateInterval: 5 * time.Minute,
+		clock:                   clock,
 	}
 	var watcher = MockWatcher{}
-	var git = MockGit{}
+	var git = MockGit{synced: make(chan string, 10)}
+
+	gitRepoMonitor.StartMonitoring("some-path", &watcher, &git)
+	<-git.synced
+
+	clock.Advance(5*time.Minute - time.Second)
+	assert.Equal(t, 0, len(git.synced))
+
+	clock.Advance(time.Second)
+	assert.Equal(t, "some-path", <-git.synced)
+	assert.Equal(t, 2, git.Count)
+
+	// The next update is scheduled after the interval again.
+	assert.Equal(t, 1, clock.Waiters())
+	clock.Advance(10 * time.Minute)
+	assert.Equal(t, "some-path", <-git.synced)
+	assert.Equal(t, "some-path", <-git.synced)
+	assert.Equal(t, 4, git.Count)
+}
+
+func TestGitRepoMonitor_Stop(t *testing.T) {
+	var clock = test_helpers.NewFakeClock(time.Now())
+	var gitRepoMonitor = GitRepoMonitor{
+		scheduledUpdateInterval: time.Minute,
+		clock:                   clock,
+	}
+	var watcher = MockWatcher{}
+	var git = MockGit{synced: make(chan string, 10)}
+
+	gitRepoMonitor.StartMonitoring("some-path", &watcher, &git)
+	<-git.synced
+
+	gitRepoMonitor.Stop()
+	gitRepoMonitor.Stop()
+
+	// The scheduled update isn't sent, and isn't scheduled again.
+	clock.Advance(time.Minute)
+	assert.Equal(t, 0, clock.Waiters())
+	assert.Equal(t, 0, len(git.synced))
+	assert.Equal(t, 1, git.Count)
+}
+
+func TestGitRepoMonitor_StopCancelsTheSync(t *testing.T) {
+	var health = NewHealth(test_helpers.NewFakeClock(time.Now()))
+	var gitRepoMonitor = GitRepoMonitor{
+		scheduledUpdateInterval: time.Minute,
+		clock:                   test_helpers.NewFakeClock(time.Now()),
+		health:                  health,
+	}
+	var watcher = MockWatcher{}
+	var git = MockGit{synced: make(chan string, 10), blocking: true}
 
 	gitRepoMonitor.StartMonitoring("some-path", &watcher, &git)
+	gitRepoMonitor.Stop()
 
-	assert.Eventually(t, func() bool {
-		return git.Count >= 2
-	}, 1*time.Second, 10*time.Millisecond)
+	// Stop returns once the sync is cancelled.
+	assert.Equal(t, 1, len(git.synced))
+	_, report := health.Report()
+	assert.Equal(t, "context canceled", report["some-path"].Error)
 }
 
 func TestGitRepoMonitor_ScheduleUpdate(t *testing.T) {
+	var clock = test_helpers.NewFakeClock(time.Now())
 	var gitRepoMonitor = GitRepoMonitor{
 		scheduledUpdateInterval: 100 * time.Millisecond,
+		clock:                   clock,
 	}
 
-	var channel = make(chan string)
-	var path string
-
-	go func() {
-		path = <-channel
-	}()
+	var channel = make(chan string, 10)
 
 	gitRepoMonitor.scheduleUpdate("some-path", channel)
 
-	assert.Eventually(t, func() bool {
-		return path == "some-path"
-	}, 1*time.Second, 10*time.Millisecond)
+	clock.Advance(99 * time.Millisecond)
+	assert.Equal(t, 0, len(channel))
+
+	clock.Advance(time.Millisecond)
+	assert.Equal(t, 1, len(channel))
+	assert.Equal(t, "some-path", <-channel)
+}
+
+func TestGitRepoMonitor_TimeoutBackoff(t *testing.T) {
+	var clock = test_helpers.NewFakeClock(time.Now())
+	var gitRepoMonitor = GitRepoMonitor{
+		scheduledUpdateInterval: time.Hour,
+		clock:                   clock,
+	}
+	var watcher = MockWatcher{}
+	var git = MockGit{synced: make(chan string, 10), err: &TimeoutError{Command: "git fetch", Timeout: time.Minute}}
+
+	gitRepoMonitor.StartMonitoring("some-path", &watcher, &git)
+	<-git.synced
+
+	// The changes are skipped for a minute after the timeout.
+	watcher.channel <- watcher.repoPath
+	watcher.channel <- watcher.repoPath
+	assert.Equal(t, 0, len(git.synced))
+
+	clock.Advance(time.Minute)
+	watcher.channel <- watcher.repoPath
+	assert.Equal(t, "some-path", <-git.synced)
+
+	// Then for 2 minutes after the next timeout.
+	clock.Advance(time.Minute)
+	watcher.channel <- watcher.repoPath
+	watcher.channel <- watcher.repoPath
+	assert.Equal(t, 0, len(git.synced))
+
+	git.err = nil
+	clock.Advance(time.Minute)
+	watcher.channel <- watcher.repoPath
+	assert.Equal(t, "some-path", <-git.synced)
+
+	// A sync that doesn't time out ends the backoff.
+	watcher.channel <- watcher.repoPath
+	assert.Equal(t, "some-path", <-git.synced)
+	assert.Equal(t, 4, git.Count)
+}
+
+func TestNextBackoff(t *testing.T) {
+	timeout := fmt.Errorf("performing GetState() failed. Err: %w", &TimeoutError{Command: "git fetch", Timeout: time.Minute})
+
+	assert.Equal(t, time.Duration(0), nextBackoff(nil, 4*time.Minute))
+	assert.Equal(t, time.Duration(0), nextBackoff(fmt.Errorf("unable to fetch"), 4*time.Minute))
+	assert.Equal(t, time.Minute, nextBackoff(timeout, 0))
+	assert.Equal(t, 8*time.Minute, nextBackoff(timeout, 4*time.Minute))
+	assert.Equal(t, 30*time.Minute, nextBackoff(timeout, 20*time.Minute))
 }
 
 type MockWatcher struct {
@@ -69,7 +178,18 @@ func (m *MockWatcher) Watch(path string, channel chan string) {
 }
 
 type MockGit struct {
-	Count int
+	Count  int
+	config *Config
+	// err is returned by every sync.
+	err error
+	// synced receives the path of every sync when it's set.
+	synced chan string
+	// blocking holds every sync until its context is cancelled.
+	blocking bool
+}
+
+func (m *MockGit) Configure(config *Config) {
+	m.config = config
 }
 
 func (m *MockGit) IsDirty(path string) (bool, error) {
@@ -77,8 +197,19 @@ func (m *MockGit) IsDirty(path string) (bool, error) {
 }
 
 func (m *MockGit) Sync(path string) error {
+	return m.SyncContext(context.Background(), path)
+}
+
+func (m *MockGit) SyncContext(ctx context.Context, path string) error {
 	m.Count++
-	return nil
+	if m.blocking {
+		<-ctx.Done()
+		m.err = ctx.Err()
+	}
+	if m.synced != nil {
+		m.synced <- path
+	}
+	return m.err
 }
 
 func (m *MockGit) Update(path string) error {
@@ -92,3 +223,37 @@ func (m *MockGit) GetState(path string) (State, error) {
 func (m *MockGit) GetCurrentBranch(path string) (string, error) {
 	return "trunk", nil
 }
+
+func TestGitRepoMonitor_StartMonitoringLockedRepo(t *testing.T) {
+	repos := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(repos)
+	other := NewLocks()
+	defer other.Release()
+	assert.NoError(t, other.LockRepo(repos.Local))
+
+	var clock = test_helpers.NewFakeClock(time.Now())
+	var health = NewHealth(clock)
+	var gitRepoMonitor = GitRepoMonitor{
+		scheduledUpdateInterval: time.Minute,
+		clock:                   test_helpers.NewFakeClock(time.Now()),
+		health:                  health,
+		locks:                   NewLocks(),
+	}
+	var watcher = MockWatcher{}
+	var git = MockGit{}
+
+	gitRepoMonitor.StartMonitoring(repos.Local, &watcher, &git)
+
+	assert.Equal(t, 0, git.Count)
+	assert.Equal(t, "", watcher.repoPath)
+	_, report := health.Report()
+	assert.Contains(t, report[repos.Local].Error, fmt.Sprintf("pid %d", os.Getpid()))
+	assert.True(t, report[repos.Local].NotMonitored)
+
+	// The repo is reported as failing, but it never stalls, which would restart the daemon.
+	clock.Advance(defaultHealthThreshold + time.Minute)
+	healthy, report := health.Report()
+	assert.True(t, healthy)
+	assert.True(t, report[repos.Local].Healthy)
+	assert.Equal(t, "1 repos: 0 synced, 1 failing, 0 stalled ("+repos.Local+")", health.Status())
+}
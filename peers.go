@@ -0,0 +1,527 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/cgi"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	peerRefPrefix     = "refs/git-notes/peers"
+	peerTimeout       = time.Minute
+	discoveryInterval = 30 * time.Second
+	// A discovered peer is dropped after missing this many announcements.
+	discoveryMissed = 3
+	// The peers authenticate each other at this path before fetching.
+	peerChallengePath = "/challenge"
+	// The challenges that a server keeps at most, so that unauthenticated clients can't fill its memory.
+	maxPeerSessions = 1024
+)
+
+// The announcements are broadcast to this address. The tests send them to the loopback instead.
+var discoveryAddress = &net.UDPAddr{IP: net.IPv4bcast, Port: 8290}
+
+// PeersConfig lets the machines on the same network sync with each other, e.g. while the remote is down or there is
+// no internet. The peers only ever fetch from each other. The remote is reconciled once it's reachable again.
+type PeersConfig struct {
+	// Listen serves the repos read-only to the peers, e.g. `0.0.0.0:8289`. It requires the token.
+	Listen string `json:"Listen" yaml:"listen" toml:"listen"`
+	// Token is shared by the peers. They prove to each other that they have it, but never send it.
+	Token string `json:"Token" yaml:"token" toml:"token"`
+	// Hosts are the URLs of the peers, e.g. `http://laptop.local:8289`.
+	Hosts []string `json:"Hosts" yaml:"hosts" toml:"hosts"`
+	// Discover finds the peers by broadcasting on the local network, and announces this machine when it listens.
+	Discover bool `json:"Discover" yaml:"discover" toml:"discover"`
+}
+
+func (p PeersConfig) Enabled() bool {
+	return len(p.Hosts) > 0 || p.Discover
+}
+
+func (p PeersConfig) Validate() error {
+	if (p.Listen != "" || p.Enabled()) && p.Token == "" {
+		return fmt.Errorf("the peers require a token")
+	}
+	for _, host := range p.Hosts {
+		parsed, err := url.Parse(host)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("invalid peer url: %s", host)
+		}
+	}
+	return nil
+}
+
+type discoveredPeer struct {
+	channels map[string]bool
+	seen     time.Time
+}
+
+type peerAnnouncement struct {
+	ID       string   `json:"id"`
+	Port     int      `json:"port"`
+	Channels []string `json:"channels"`
+	// MAC signs the announcement with the token, so that only the peers are discovered.
+	MAC string `json:"mac,omitempty"`
+}
+
+// peerMAC authenticates the parts with the token.
+func peerMAC(token string, parts ...string) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sign returns the message of the announcement, signed with the token.
+func (a peerAnnouncement) sign(token string) []byte {
+	a.MAC = ""
+	unsigned, _ := json.Marshal(a)
+	a.MAC = peerMAC(token, "announce", string(unsigned))
+	message, _ := json.Marshal(a)
+	return message
+}
+
+// verifyAnnouncement returns the announcement of the message, when it's signed with the token.
+func verifyAnnouncement(token string, message []byte) (peerAnnouncement, bool) {
+	var announcement peerAnnouncement
+	if err := json.Unmarshal(message, &announcement); err != nil || announcement.MAC == "" {
+		return announcement, false
+	}
+	signed := announcement.sign(token)
+	var expected peerAnnouncement
+	_ = json.Unmarshal(signed, &expected)
+	return announcement, hmac.Equal([]byte(announcement.MAC), []byte(expected.MAC))
+}
+
+// Peers fetches the repos from the configured and the discovered peers. A nil Peers, or one without peers, does
+// nothing.
+type Peers struct {
+	id    string
+	clock Clock
+	once  sync.Once
+
+	mutex      sync.Mutex
+	config     PeersConfig
+	discovered map[string]*discoveredPeer
+}
+
+func NewPeers(clock Clock) *Peers {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return &Peers{id: hex.EncodeToString(id), clock: clock, discovered: map[string]*discoveredPeer{}}
+}
+
+// Configure starts the discovery, when it's on, the first time.
+func (p *Peers) Configure(config PeersConfig, repos []string) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	p.config = config
+	p.mutex.Unlock()
+
+	if config.Discover {
+		p.once.Do(func() { p.discover(config.Listen, repos) })
+	}
+}
+
+func (p *Peers) Enabled() bool {
+	if p == nil {
+		return false
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.config.Enabled()
+}
+
+// urls returns the peers that serve the channel.
+func (p *Peers) urls(channel string) []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	urls := append([]string{}, p.config.Hosts...)
+	expiry := orRealClock(p.clock).Now().Add(-discoveryMissed * discoveryInterval)
+	for peerUrl, peer := range p.discovered {
+		if peer.seen.Before(expiry) {
+			delete(p.discovered, peerUrl)
+			continue
+		}
+		if peer.channels[channel] {
+			urls = append(urls, peerUrl)
+		}
+	}
+	sort.Strings(urls[len(p.config.Hosts):])
+	return urls
+}
+
+var unsafeRefChars = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+func peerRef(peerUrl string, branch string) string {
+	name := strings.Trim(unsafeRefChars.ReplaceAllString(strings.TrimPrefix(strings.TrimPrefix(peerUrl, "http://"), "https://"), "-"), "-.")
+	return fmt.Sprintf("%s/%s/%s", peerRefPrefix, name, branch)
+}
+
+// Fetch fetches the branch from every peer, and returns the ref of a peer that has commits that HEAD doesn't have.
+// The peers that can't be reached are skipped, because they're often just asleep.
+func (p *Peers) Fetch(ctx context.Context, path string, branch string) (string, error) {
+	if !p.Enabled() {
+		return "", nil
+	}
+	channel, err := repoRelayChannel(ctx, path)
+	if err != nil {
+		return "", err
+	}
+
+	token := p.token()
+	for _, peerUrl := range p.urls(channel) {
+		authorization, err := authenticatePeer(ctx, peerUrl, token)
+		if err != nil {
+			log.Printf("Unable to authenticate the peer %s. Err: %v", peerUrl, err)
+			continue
+		}
+		ref := peerRef(peerUrl, branch)
+		cmd := exec.Command("git", "fetch", "--no-tags", strings.TrimSuffix(peerUrl, "/")+"/"+channel,
+			fmt.Sprintf("+refs/heads/%s:%s", branch, ref))
+		cmd.Dir = path
+		// The authorization is passed in the environment, since the other users can read the arguments.
+		cmd.Env = append(os.Environ(),
+			"GIT_TERMINAL_PROMPT=0",
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http.extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: "+authorization,
+		)
+		out, err := combinedOutputTimeout(ctx, cmd, peerTimeout)
+		if err != nil {
+			log.Printf("Unable to fetch %s from the peer %s. Err: %v, %s", path, peerUrl, err, strings.TrimSpace(string(out)))
+		}
+	}
+	return PeerWithNewCommits(ctx, path, branch)
+}
+
+func (p *Peers) token() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.config.Token
+}
+
+type peerChallenge struct {
+	Nonce string `json:"nonce"`
+	Proof string `json:"proof"`
+}
+
+// authenticatePeer challenges the peer to prove that it has the token, and returns the authorization of the fetch
+// from it. Neither side sends the token, so a machine that only pretends to be a peer learns nothing from it.
+func authenticatePeer(ctx context.Context, peerUrl string, token string) (string, error) {
+	clientNonce, err := randomNonce()
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(ctx, peerTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET",
+		strings.TrimSuffix(peerUrl, "/")+peerChallengePath+"?nonce="+clientNonce, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("the peer answered %s", resp.Status)
+	}
+
+	var challenge peerChallenge
+	err = json.NewDecoder(resp.Body).Decode(&challenge)
+	if err != nil {
+		return "", fmt.Errorf("invalid challenge. Err: %v", err)
+	}
+	if !hmac.Equal([]byte(challenge.Proof), []byte(peerMAC(token, "server", clientNonce, challenge.Nonce))) {
+		return "", fmt.Errorf("the peer didn't prove that it has the token")
+	}
+	return fmt.Sprintf("Peer %s %s", challenge.Nonce, peerMAC(token, "client", clientNonce, challenge.Nonce)), nil
+}
+
+func randomNonce() (string, error) {
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", fmt.Errorf("unable to generate a nonce. Err: %v", err)
+	}
+	return hex.EncodeToString(nonce), nil
+}
+
+// PeerWithNewCommits returns the last fetched branch of a peer that has commits that HEAD doesn't have.
+func PeerWithNewCommits(ctx context.Context, path string, branch string) (string, error) {
+	out, err := runCmdStdout(ctx, path, "git", "for-each-ref", "--format=%(refname)", peerRefPrefix)
+	if err != nil {
+		return "", fmt.Errorf("unable to list the branches of the peers. Err: %v", err)
+	}
+
+	for _, ref := range strings.Fields(out) {
+		// The refs are named like peerRef().
+		parts := strings.SplitN(strings.TrimPrefix(ref, peerRefPrefix+"/"), "/", 2)
+		if len(parts) != 2 || parts[1] != branch {
+			continue
+		}
+		newer, err := hasNewCommits(ctx, path, ref)
+		if err != nil {
+			return "", err
+		}
+		if newer {
+			return ref, nil
+		}
+	}
+	return "", nil
+}
+
+// hasNewCommits returns whether the ref has commits that HEAD doesn't have.
+func hasNewCommits(ctx context.Context, path string, ref string) (bool, error) {
+	out, err := runCmdStdout(ctx, path, "git", "rev-list", "--count", "HEAD.."+ref)
+	if err != nil {
+		return false, fmt.Errorf("unable to compare with %s. Err: %v", ref, err)
+	}
+	return strings.TrimSpace(out) != "0", nil
+}
+
+// discover listens to the announcements of the other peers, and announces this machine when it serves its repos.
+func (p *Peers) discover(listen string, repos []string) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: discoveryAddress.Port})
+	if err != nil {
+		log.Printf("Unable to discover the peers. Err: %v", err)
+		return
+	}
+
+	go func() {
+		buffer := make([]byte, 65536)
+		for {
+			n, addr, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				log.Printf("The discovery of the peers stopped. Err: %v", err)
+				return
+			}
+			p.announced(addr.IP, buffer[:n])
+		}
+	}()
+
+	if listen == "" {
+		return
+	}
+	_, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		log.Printf("Unable to announce this machine to the peers. Err: %v", err)
+		return
+	}
+	announcement := peerAnnouncement{ID: p.id, Channels: repoChannels(context.Background(), repos)}
+	announcement.Port, _ = strconv.Atoi(port)
+
+	var announce func()
+	announce = func() {
+		_, err := conn.WriteToUDP(announcement.sign(p.token()), discoveryAddress)
+		if err != nil {
+			log.Printf("Unable to announce this machine to the peers. Err: %v", err)
+		}
+		orRealClock(p.clock).AfterFunc(discoveryInterval, announce)
+	}
+	announce()
+}
+
+// announced records the peer of the announcement. The announcements that aren't signed with the token are ignored.
+func (p *Peers) announced(ip net.IP, message []byte) {
+	announcement, ok := verifyAnnouncement(p.token(), message)
+	if !ok || announcement.ID == p.id || announcement.Port == 0 {
+		return
+	}
+
+	peer := &discoveredPeer{channels: map[string]bool{}, seen: orRealClock(p.clock).Now()}
+	for _, channel := range announcement.Channels {
+		peer.channels[channel] = true
+	}
+	peerUrl := "http://" + net.JoinHostPort(ip.String(), strconv.Itoa(announcement.Port))
+
+	p.mutex.Lock()
+	if _, ok := p.discovered[peerUrl]; !ok {
+		log.Printf("Discovered the peer %s", peerUrl)
+	}
+	p.discovered[peerUrl] = peer
+	p.mutex.Unlock()
+}
+
+// repoChannels returns the channels of the repos, which name them for the peers. See RelayChannel.
+func repoChannels(ctx context.Context, repos []string) []string {
+	var channels []string
+	for _, repo := range repos {
+		channel, err := repoRelayChannel(ctx, repo)
+		if err != nil {
+			log.Printf("Not serving %s to the peers. Err: %v", repo, err)
+			continue
+		}
+		channels = append(channels, channel)
+	}
+	return channels
+}
+
+// PeerServer serves the repos read-only over the smart HTTP protocol of git, at `/<channel>`. The peers authenticate
+// at `/challenge` first, see authenticatePeer.
+type PeerServer struct {
+	token string
+	git   string
+	repos map[string]string
+
+	mutex sync.Mutex
+	// sessions are the nonces of the clients, by the nonces of the server.
+	sessions map[string]peerSession
+}
+
+type peerSession struct {
+	clientNonce string
+	expiry      time.Time
+}
+
+func NewPeerServer(ctx context.Context, token string, repos []string) (*PeerServer, error) {
+	git, err := exec.LookPath("git")
+	if err != nil {
+		return nil, err
+	}
+
+	server := &PeerServer{token: token, git: git, repos: map[string]string{}, sessions: map[string]peerSession{}}
+	for _, repo := range repos {
+		channel, err := repoRelayChannel(ctx, repo)
+		if err != nil {
+			log.Printf("Not serving %s to the peers. Err: %v", repo, err)
+			continue
+		}
+		// A linked worktree has its objects in the common git dir.
+		gitDir, err := commonGitDir(ctx, repo)
+		if err != nil {
+			return nil, err
+		}
+		server.repos[channel] = gitDir
+	}
+	return server, nil
+}
+
+func (s *PeerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == peerChallengePath {
+		s.challenge(w, r)
+		return
+	}
+	if !s.authorized(r.Header.Get("Authorization")) {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	if strings.Contains(r.URL.Path, "git-receive-pack") || r.URL.Query().Get("service") == "git-receive-pack" {
+		http.Error(w, "the peers are read-only", http.StatusForbidden)
+		return
+	}
+
+	channel := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0]
+	gitDir, ok := s.repos[channel]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	handler := &cgi.Handler{
+		Path: s.git,
+		Args: []string{"http-backend"},
+		Root: "/" + channel,
+		Env: []string{
+			"GIT_PROJECT_ROOT=" + gitDir,
+			"GIT_HTTP_EXPORT_ALL=1",
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http.receivepack",
+			"GIT_CONFIG_VALUE_0=false",
+		},
+	}
+	handler.ServeHTTP(w, r)
+}
+
+// challenge proves to the client that the server has the token, and gives the client a nonce to prove the same.
+func (s *PeerServer) challenge(w http.ResponseWriter, r *http.Request) {
+	clientNonce := r.URL.Query().Get("nonce")
+	if len(clientNonce) != 32 {
+		http.Error(w, "invalid nonce", http.StatusBadRequest)
+		return
+	}
+	serverNonce, err := randomNonce()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.mutex.Lock()
+	now := time.Now()
+	for nonce, session := range s.sessions {
+		if now.After(session.expiry) {
+			delete(s.sessions, nonce)
+		}
+	}
+	full := len(s.sessions) >= maxPeerSessions
+	if !full {
+		s.sessions[serverNonce] = peerSession{clientNonce: clientNonce, expiry: now.Add(peerTimeout)}
+	}
+	s.mutex.Unlock()
+	if full {
+		http.Error(w, "too many challenges", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(peerChallenge{Nonce: serverNonce, Proof: peerMAC(s.token, "server", clientNonce, serverNonce)})
+}
+
+// authorized returns whether the authorization answers a challenge of the server, see authenticatePeer.
+func (s *PeerServer) authorized(authorization string) bool {
+	fields := strings.Fields(authorization)
+	if len(fields) != 3 || fields[0] != "Peer" {
+		return false
+	}
+	s.mutex.Lock()
+	session, ok := s.sessions[fields[1]]
+	s.mutex.Unlock()
+	if !ok || time.Now().After(session.expiry) {
+		return false
+	}
+	proof := peerMAC(s.token, "client", session.clientNonce, fields[1])
+	return subtle.ConstantTimeCompare([]byte(fields[2]), []byte(proof)) == 1
+}
+
+// ServePeers serves the repos to the peers in the background.
+func ServePeers(ctx context.Context, config PeersConfig, repos []string) error {
+	server, err := NewPeerServer(ctx, config.Token, repos)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s. Err: %v", config.Listen, err)
+	}
+
+	go func() {
+		err := http.Serve(listener, server)
+		if err != nil {
+			log.Printf("Serving the peers stopped. Err: %v", err)
+		}
+	}()
+	log.Printf("Serving %d repos to the peers at http://%s", len(server.repos), listener.Addr())
+	return nil
+}
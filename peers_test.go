@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"git-notes/internal/test_helpers"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// peerGit syncs the repo with the peers, and with the remote when it's reachable.
+func peerGit(path string, hosts ...string) *GitCmd {
+	git := NewGoGit(nil, NewPeers(nil), nil)
+	git.Configure(&Config{Repos: []string{path}, Peers: PeersConfig{Token: "secret", Hosts: hosts}})
+	return &git
+}
+
+func servePeer(t *testing.T, repos ...string) *httptest.Server {
+	server, err := NewPeerServer(context.Background(), "secret", repos)
+	assert.NoError(t, err)
+	return httptest.NewServer(server)
+}
+
+func readNote(t *testing.T, path string, file string) string {
+	content, err := ioutil.ReadFile(filepath.Join(path, file))
+	assert.NoError(t, err)
+	return string(content)
+}
+
+func TestPeersConfig_Validate(t *testing.T) {
+	assert.NoError(t, PeersConfig{}.Validate())
+	assert.NoError(t, PeersConfig{Listen: "0.0.0.0:8289", Token: "secret", Hosts: []string{"http://laptop.local:8289"}}.Validate())
+	assert.EqualError(t, PeersConfig{Listen: "0.0.0.0:8289"}.Validate(), "the peers require a token")
+	assert.EqualError(t, PeersConfig{Hosts: []string{"http://laptop.local:8289"}}.Validate(), "the peers require a token")
+	assert.EqualError(t, PeersConfig{Discover: true}.Validate(), "the peers require a token")
+	assert.EqualError(t, PeersConfig{Token: "secret", Hosts: []string{"laptop.local"}}.Validate(), "invalid peer url: laptop.local")
+}
+
+func TestPeerRef(t *testing.T) {
+	assert.Equal(t, "refs/git-notes/peers/192.168.1.20-8289/master", peerRef("http://192.168.1.20:8289", "master"))
+	assert.Equal(t, "refs/git-notes/peers/laptop.local-8289/main", peerRef("https://laptop.local:8289/", "main"))
+}
+
+func TestPeers_Announced(t *testing.T) {
+	clock := test_helpers.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	peers := NewPeers(clock)
+	peers.Configure(PeersConfig{Token: "secret", Hosts: []string{"http://desktop:8289"}}, nil)
+
+	peers.announced(net.ParseIP("192.168.1.20"), peerAnnouncement{ID: "laptop", Port: 8289, Channels: []string{"notes"}}.sign("secret"))
+	peers.announced(net.ParseIP("192.168.1.21"), peerAnnouncement{ID: "phone", Port: 8289, Channels: []string{"work"}}.sign("secret"))
+	peers.announced(net.ParseIP("192.168.1.22"), peerAnnouncement{ID: peers.id, Port: 8289, Channels: []string{"notes"}}.sign("secret"))
+	peers.announced(net.ParseIP("192.168.1.23"), []byte(`garbage`))
+	// The announcements that aren't signed with the token are ignored.
+	peers.announced(net.ParseIP("192.168.1.24"), []byte(`{"id":"intruder","port":8289,"channels":["notes"]}`))
+	peers.announced(net.ParseIP("192.168.1.25"), peerAnnouncement{ID: "intruder", Port: 8289, Channels: []string{"notes"}}.sign("wrong"))
+
+	assert.Equal(t, []string{"http://desktop:8289", "http://192.168.1.20:8289"}, peers.urls("notes"))
+	assert.Equal(t, []string{"http://desktop:8289", "http://192.168.1.21:8289"}, peers.urls("work"))
+
+	// A peer that stops announcing itself is dropped.
+	clock.Advance(discoveryMissed*discoveryInterval + time.Second)
+	assert.Equal(t, []string{"http://desktop:8289"}, peers.urls("notes"))
+}
+
+func TestPeerServer(t *testing.T) {
+	machines := test_helpers.SetupMachines(1, 1)
+	defer test_helpers.CleanupMachines(machines)
+	server := servePeer(t, machines.Clones[0])
+	defer server.Close()
+	channel, err := repoRelayChannel(context.Background(), machines.Clones[0])
+	assert.NoError(t, err)
+
+	authorization, err := authenticatePeer(context.Background(), server.URL, "secret")
+	assert.NoError(t, err)
+	request := func(method string, url string, authorization string) int {
+		req, err := http.NewRequest(method, server.URL+url, nil)
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", authorization)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, request("GET", "/"+channel+"/info/refs?service=git-upload-pack", authorization))
+	assert.Equal(t, http.StatusUnauthorized, request("GET", "/"+channel+"/info/refs?service=git-upload-pack", "Bearer secret"))
+	assert.Equal(t, http.StatusUnauthorized, request("GET", "/"+channel+"/info/refs?service=git-upload-pack", authorization+"0"))
+	assert.Equal(t, http.StatusForbidden, request("GET", "/"+channel+"/info/refs?service=git-receive-pack", authorization))
+	assert.Equal(t, http.StatusForbidden, request("POST", "/"+channel+"/git-receive-pack", authorization))
+	assert.Equal(t, http.StatusNotFound, request("GET", "/unknown/info/refs?service=git-upload-pack", authorization))
+}
+
+func TestAuthenticatePeer_WrongToken(t *testing.T) {
+	machines := test_helpers.SetupMachines(1, 1)
+	defer test_helpers.CleanupMachines(machines)
+	server := servePeer(t, machines.Clones[0])
+	defer server.Close()
+
+	_, err := authenticatePeer(context.Background(), server.URL, "wrong")
+	assert.EqualError(t, err, "the peer didn't prove that it has the token")
+}
+
+func TestPeers_SyncWhileTheRemoteIsDown(t *testing.T) {
+	machines := test_helpers.SetupMachines(2, 1)
+	defer test_helpers.CleanupMachines(machines)
+	laptop, desktop := machines.Clones[0], machines.Clones[1]
+	laptopServer := servePeer(t, laptop)
+	defer laptopServer.Close()
+	desktopServer := servePeer(t, desktop)
+	defer desktopServer.Close()
+	laptopGit := peerGit(laptop, desktopServer.URL)
+	desktopGit := peerGit(desktop, laptopServer.URL)
+
+	assert.NoError(t, os.Rename(machines.Remote, machines.Remote+".down"))
+
+	// The laptop commits, but can't push.
+	test_helpers.WriteFile(t, laptop, "plane.md", "Written on the plane")
+	assert.NoError(t, laptopGit.Sync(laptop))
+	state, err := laptopGit.GetState(laptop)
+	assert.NoError(t, err)
+	assert.Equal(t, Offline, state)
+
+	// The desktop gets the note from the laptop.
+	assert.NoError(t, desktopGit.Sync(desktop))
+	assert.Equal(t, "Written on the plane", readNote(t, desktop, "plane.md"))
+	state, err = desktopGit.GetState(desktop)
+	assert.NoError(t, err)
+	assert.Equal(t, Offline, state)
+
+	// The remote is reconciled once it's back.
+	assert.NoError(t, os.Rename(machines.Remote+".down", machines.Remote))
+	assert.NoError(t, desktopGit.Sync(desktop))
+	assert.NoError(t, laptopGit.Sync(laptop))
+	assertState(t, laptop, Sync)
+	assertState(t, desktop, Sync)
+
+	branch := test_helpers.GetLocalBranch(laptop)
+	out, err := runCmdStdout(context.Background(), machines.Remote, "git", "show", branch+":plane.md")
+	assert.NoError(t, err)
+	assert.Equal(t, "Written on the plane", strings.TrimSpace(out))
+}
+
+func TestPeers_NotFetchedWhileTheRemoteIsReachable(t *testing.T) {
+	machines := test_helpers.SetupMachines(1, 1)
+	defer test_helpers.CleanupMachines(machines)
+	local := machines.Clones[0]
+	var requests int32
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		// The token is never sent to the peers.
+		assert.NotContains(t, r.URL.String()+r.Header.Get("Authorization"), "secret")
+		http.NotFound(w, r)
+	}))
+	defer peer.Close()
+	git := peerGit(local, peer.URL)
+
+	test_helpers.WriteFile(t, local, "a.md", "a")
+	assert.NoError(t, git.Sync(local))
+	assertState(t, local, Sync)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&requests))
+
+	// The peer is asked once the remote is down.
+	assert.NoError(t, os.Rename(machines.Remote, machines.Remote+".down"))
+	_, err := git.GetState(local)
+	assert.NoError(t, err)
+	assert.NotEqual(t, int32(0), atomic.LoadInt32(&requests))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// The timeouts of the subprocesses. The remote ones talk to the remote: the fetches, the pushes and the LFS uploads.
+// The config overrides them with WithTimeouts.
+const (
+	defaultLocalTimeout  = 2 * time.Minute
+	defaultRemoteTimeout = 10 * time.Minute
+)
+
+type timeoutsKey struct{}
+
+type timeouts struct {
+	local  time.Duration
+	remote time.Duration
+}
+
+// Once the process group is killed, Wait() can still be held up by a process that left the group but keeps the
+// output pipes open, e.g. an SSH control master. It's given up on after this delay.
+const waitDelay = 5 * time.Second
+
+// TimeoutError is returned when a subprocess takes longer than its timeout and is killed.
+type TimeoutError struct {
+	Command string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("`%s` timed out after %v", e.Command, e.Timeout)
+}
+
+func IsTimeout(err error) bool {
+	var timeoutErr *TimeoutError
+	return errors.As(err, &timeoutErr)
+}
+
+// WithTimeouts returns a context whose subprocesses get the timeouts of the config. The ones that aren't set get the
+// defaults.
+func WithTimeouts(ctx context.Context, config TimeoutsConfig) context.Context {
+	local, remote, err := config.Parse()
+	if err != nil {
+		// The config is validated when it's read.
+		return ctx
+	}
+	return context.WithValue(ctx, timeoutsKey{}, timeouts{local: local, remote: remote})
+}
+
+// localTimeout is the timeout of the commands that don't talk to the remote.
+func localTimeout(ctx context.Context) time.Duration {
+	if t, ok := ctx.Value(timeoutsKey{}).(timeouts); ok {
+		return t.local
+	}
+	return defaultLocalTimeout
+}
+
+// remoteTimeout is the timeout of the commands that talk to the remote.
+func remoteTimeout(ctx context.Context) time.Duration {
+	if t, ok := ctx.Value(timeoutsKey{}).(timeouts); ok {
+		return t.remote
+	}
+	return defaultRemoteTimeout
+}
+
+// runContext runs the command in its own process group, and kills the whole group when the context is done.
+func runContext(ctx context.Context, cmd *exec.Cmd) error {
+	setProcessGroup(cmd)
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	killProcessGroup(cmd.Process)
+	select {
+	case <-done:
+	case <-time.After(waitDelay):
+	}
+	return ctx.Err()
+}
+
+// runTimeout is runContext with a timeout, which is reported as a TimeoutError. The deadline of the context is one
+// too.
+func runTimeout(ctx context.Context, cmd *exec.Cmd, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := runContext(ctx, cmd)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &TimeoutError{Command: strings.Join(cmd.Args, " "), Timeout: timeout}
+	}
+	return err
+}
+
+// combinedOutputTimeout is like cmd.CombinedOutput(), but with a timeout.
+func combinedOutputTimeout(ctx context.Context, cmd *exec.Cmd, timeout time.Duration) ([]byte, error) {
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := runTimeout(ctx, cmd, timeout)
+	return out.Bytes(), err
+}
+
+// outputTimeout is like cmd.Output(), but with a timeout.
+func outputTimeout(ctx context.Context, cmd *exec.Cmd, timeout time.Duration) ([]byte, error) {
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	err := runTimeout(ctx, cmd, timeout)
+	return out.Bytes(), err
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunTimeout(t *testing.T) {
+	assert.NoError(t, runTimeout(context.Background(), exec.Command("true"), time.Second))
+
+	err := runTimeout(context.Background(), exec.Command("false"), time.Second)
+	_, ok := err.(*exec.ExitError)
+	assert.True(t, ok)
+	assert.False(t, IsTimeout(err))
+
+	err = runTimeout(context.Background(), exec.Command("sleep", "30"), 100*time.Millisecond)
+	assert.EqualError(t, err, "`sleep 30` timed out after 100ms")
+	assert.True(t, IsTimeout(err))
+}
+
+func TestRunContext_Cancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	err := runContext(ctx, exec.Command("sleep", "30"))
+	assert.Equal(t, context.Canceled, err)
+	assert.False(t, IsTimeout(err))
+	assert.True(t, time.Since(start) < 10*time.Second)
+}
+
+func TestOutputTimeout(t *testing.T) {
+	out, err := outputTimeout(context.Background(), exec.Command("sh", "-c", "echo out; echo err >&2"), time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, "out\n", string(out))
+
+	out, err = combinedOutputTimeout(context.Background(), exec.Command("sh", "-c", "echo out; echo err >&2"), time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, "out\nerr\n", string(out))
+}
+
+func TestWithTimeouts(t *testing.T) {
+	ctx := WithTimeouts(context.Background(), TimeoutsConfig{Local: "100ms"})
+	assert.Equal(t, 100*time.Millisecond, localTimeout(ctx))
+	assert.Equal(t, defaultRemoteTimeout, remoteTimeout(ctx))
+	assert.Equal(t, defaultLocalTimeout, localTimeout(context.Background()))
+
+	_, err := runCmd(ctx, ".", "sleep", "30")
+	assert.EqualError(t, err, "`sleep 30` timed out after 100ms")
+
+	// The deadline of the context applies too, whichever comes first.
+	deadline, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = runCmd(deadline, ".", "sleep", "30")
+	assert.True(t, IsTimeout(err))
+}
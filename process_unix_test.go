@@ -0,0 +1,55 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// isRunning returns false when the process is gone or a zombie.
+func isRunning(pid int) bool {
+	stat, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+func TestRunTimeout_KillsProcessGroup(t *testing.T) {
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("/proc is needed to check the processes")
+	}
+
+	dir, err := ioutil.TempDir("", "git-notes-process")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	pidFile := filepath.Join(dir, "pid")
+
+	// Like git running ssh, the child outlives its parent unless the whole group is killed.
+	start := time.Now()
+	err = runTimeout(context.Background(), exec.Command("sh", "-c", "sleep 30 & echo $! > "+pidFile+"; wait"), 200*time.Millisecond)
+	assert.True(t, IsTimeout(err))
+	assert.True(t, time.Since(start) < 10*time.Second)
+
+	content, err := ioutil.ReadFile(pidFile)
+	assert.NoError(t, err)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	assert.NoError(t, err)
+
+	for i := 0; i < 50 && isRunning(pid); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.False(t, isRunning(pid))
+}
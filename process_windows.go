@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup only kills the process itself, since Windows has no process groups to signal.
+func killProcessGroup(process *os.Process) {
+	_ = process.Kill()
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	relayPublishTimeout = 10 * time.Second
+	relayKeepAlive      = 30 * time.Second
+	minRelayRetry       = 5 * time.Second
+	maxRelayRetry       = 5 * time.Minute
+)
+
+// RelayConfig connects the machines through a relay, so a push on one machine makes the others fetch right away
+// instead of on the next scheduled update.
+type RelayConfig struct {
+	// URL of the relay, e.g. `https://relay.example.com`. The relay is off without one.
+	URL string `json:"URL" yaml:"url" toml:"url"`
+	// Token is sent as a bearer token, and required by the built-in relay when it's set.
+	Token string `json:"Token" yaml:"token" toml:"token"`
+	// Listen runs the built-in relay on this address too, e.g. `0.0.0.0:8288`.
+	Listen string `json:"Listen" yaml:"listen" toml:"listen"`
+}
+
+func (r RelayConfig) Validate() error {
+	if r.URL == "" {
+		return nil
+	}
+	parsed, err := url.Parse(r.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("invalid relay url: %s", r.URL)
+	}
+	return nil
+}
+
+var scpLikeUrl = regexp.MustCompile(`^(?:[^@/]+@)?([^:/]+):(.*)$`)
+
+// RelayChannel names the channel of a remote. The ssh and the https URLs of the same repo give the same channel, and
+// the relay never sees the URL itself.
+func RelayChannel(remoteUrl string) string {
+	normalized := strings.TrimSpace(remoteUrl)
+	if parsed, err := url.Parse(normalized); err == nil && parsed.Scheme != "" && parsed.Host != "" {
+		normalized = parsed.Hostname() + "/" + strings.TrimPrefix(parsed.Path, "/")
+	} else if match := scpLikeUrl.FindStringSubmatch(normalized); match != nil && !strings.Contains(match[1], `\`) {
+		normalized = match[1] + "/" + strings.TrimPrefix(match[2], "/")
+	}
+	normalized = strings.ToLower(strings.TrimSuffix(strings.TrimSuffix(normalized, "/"), ".git"))
+
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:16])
+}
+
+func repoRelayChannel(ctx context.Context, path string) (string, error) {
+	remoteUrl, err := runCmdStdout(ctx, path, "git", "remote", "get-url", "origin")
+	if err != nil {
+		return "", fmt.Errorf("unable to get the url of origin. Err: %v", err)
+	}
+	return RelayChannel(remoteUrl), nil
+}
+
+// Relay publishes the pushes of this machine, and subscribes to the pushes of the others. A nil Relay, or one
+// without a URL, does nothing.
+type Relay struct {
+	id     string
+	clock  Clock
+	client *http.Client
+
+	mutex  sync.Mutex
+	config RelayConfig
+}
+
+func NewRelay(clock Clock) *Relay {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return &Relay{id: hex.EncodeToString(id), clock: clock, client: &http.Client{}}
+}
+
+func (r *Relay) Configure(config RelayConfig) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	r.config = config
+	r.mutex.Unlock()
+}
+
+func (r *Relay) getConfig() RelayConfig {
+	if r == nil {
+		return RelayConfig{}
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.config
+}
+
+func (r *Relay) request(method string, endpoint string, channel string, body io.Reader) (*http.Request, error) {
+	config := r.getConfig()
+	req, err := http.NewRequest(method, fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(config.URL, "/"), endpoint, channel), body)
+	if err != nil {
+		return nil, err
+	}
+	if config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+config.Token)
+	}
+	return req, nil
+}
+
+// Publish tells the other machines that the repo was pushed. A failure only delays them until their next scheduled
+// update, so it's logged instead of failing the sync.
+func (r *Relay) Publish(ctx context.Context, path string) {
+	if r.getConfig().URL == "" {
+		return
+	}
+
+	err := r.publish(ctx, path)
+	if err != nil {
+		log.Printf("Unable to publish the push of %s to the relay. Err: %v", path, err)
+	}
+}
+
+func (r *Relay) publish(ctx context.Context, path string) error {
+	channel, err := repoRelayChannel(ctx, path)
+	if err != nil {
+		return err
+	}
+	req, err := r.request("POST", "publish", channel, strings.NewReader(r.id))
+	if err != nil {
+		return err
+	}
+
+	client := *r.client
+	client.Timeout = relayPublishTimeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("the relay answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Subscribe sends the path to the channel whenever another machine pushes the repo. It reconnects in the background
+// until the process exits.
+func (r *Relay) Subscribe(path string, updates chan string) {
+	if r.getConfig().URL == "" {
+		return
+	}
+
+	channel, err := repoRelayChannel(context.Background(), path)
+	if err != nil {
+		log.Printf("Unable to subscribe to the pushes of %s. Err: %v", path, err)
+		return
+	}
+
+	go func() {
+		retry := time.Duration(0)
+		for {
+			connected, err := r.subscribe(channel, func() { updates <- path })
+			if connected {
+				retry = 0
+			}
+			retry *= 2
+			if retry < minRelayRetry {
+				retry = minRelayRetry
+			}
+			if retry > maxRelayRetry {
+				retry = maxRelayRetry
+			}
+			log.Printf("The subscription of %s to the relay ended. Reconnecting in %v. Err: %v", path, retry, err)
+			orRealClock(r.clock).Sleep(retry)
+		}
+	}()
+}
+
+// subscribe reads the pushes of the channel until the connection ends, and calls pushed for the ones of the other
+// machines.
+func (r *Relay) subscribe(channel string, pushed func()) (bool, error) {
+	req, err := r.request("GET", "subscribe", channel, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("the relay answered %s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		sender := strings.TrimSpace(scanner.Text())
+		if sender == "" || sender == r.id {
+			// A keep-alive, or our own push.
+			continue
+		}
+		pushed()
+	}
+	err = scanner.Err()
+	if err == nil {
+		err = io.EOF
+	}
+	return true, err
+}
+
+// RelayServer fans out the pushes of each channel to its subscribers. It keeps nothing, so a machine that's offline
+// catches up on its next scheduled update.
+type RelayServer struct {
+	token string
+
+	mutex       sync.Mutex
+	subscribers map[string]map[chan string]bool
+}
+
+func NewRelayServer(token string) *RelayServer {
+	return &RelayServer{token: token, subscribers: map[string]map[chan string]bool{}}
+}
+
+func (s *RelayServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+s.token)) != 1 {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.Method == "POST" && strings.HasPrefix(r.URL.Path, "/publish/"):
+		s.publish(w, r, strings.TrimPrefix(r.URL.Path, "/publish/"))
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/subscribe/"):
+		s.subscribe(w, r, strings.TrimPrefix(r.URL.Path, "/subscribe/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *RelayServer) publish(w http.ResponseWriter, r *http.Request, channel string) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 256))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sender := strings.Join(strings.Fields(string(body)), " ")
+	if sender == "" {
+		sender = "anonymous"
+	}
+
+	s.Publish(channel, sender)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Publish sends the push of the sender to the subscribers of the channel.
+func (s *RelayServer) Publish(channel string, sender string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for subscriber := range s.subscribers[channel] {
+		select {
+		case subscriber <- sender:
+		default:
+			// The subscriber already has a push to fetch.
+		}
+	}
+}
+
+func (s *RelayServer) subscribe(w http.ResponseWriter, r *http.Request, channel string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	subscriber := make(chan string, 16)
+	s.mutex.Lock()
+	if s.subscribers[channel] == nil {
+		s.subscribers[channel] = map[chan string]bool{}
+	}
+	s.subscribers[channel][subscriber] = true
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		delete(s.subscribers[channel], subscriber)
+		if len(s.subscribers[channel]) == 0 {
+			delete(s.subscribers, channel)
+		}
+		s.mutex.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(relayKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case sender := <-subscriber:
+			_, err := fmt.Fprintf(w, "%s\n", sender)
+			if err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			_, err := fmt.Fprint(w, "\n")
+			if err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// ServeRelay runs the built-in relay in the background.
+func ServeRelay(listen string, token string) error {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s. Err: %v", listen, err)
+	}
+
+	go func() {
+		err := http.Serve(listener, NewRelayServer(token))
+		if err != nil {
+			log.Printf("The relay stopped. Err: %v", err)
+		}
+	}()
+	log.Printf("Serving the relay at http://%s", listener.Addr())
+	return nil
+}
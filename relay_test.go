@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"git-notes/internal/test_helpers"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func relayServer(t *testing.T, token string) (*RelayServer, *httptest.Server) {
+	server := NewRelayServer(token)
+	return server, httptest.NewServer(server)
+}
+
+func closeRelayServer(server *httptest.Server) {
+	server.CloseClientConnections()
+	server.Close()
+}
+
+// waitForSubscribers waits until the channel has the number of subscribers.
+func waitForSubscribers(t *testing.T, server *RelayServer, channel string, count int) {
+	for i := 0; i < 500; i++ {
+		server.mutex.Lock()
+		subscribers := len(server.subscribers[channel])
+		server.mutex.Unlock()
+		if subscribers == count {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("the channel %s never had %d subscribers", channel, count)
+}
+
+// subscribedRelay subscribes a relay that never reconnects, because its clock doesn't move.
+func subscribedRelay(t *testing.T, server *RelayServer, url string, path string) (*Relay, chan string) {
+	relay := NewRelay(test_helpers.NewFakeClock(time.Now()))
+	relay.Configure(RelayConfig{URL: url, Token: "secret"})
+	updates := make(chan string, 10)
+	relay.Subscribe(path, updates)
+
+	channel, err := repoRelayChannel(context.Background(), path)
+	assert.NoError(t, err)
+	waitForSubscribers(t, server, channel, 1)
+	return relay, updates
+}
+
+func TestRelayChannel(t *testing.T) {
+	channel := RelayChannel("git@github.com:me/notes.git")
+	assert.Len(t, channel, 32)
+	assert.Equal(t, channel, RelayChannel("https://github.com/me/notes"))
+	assert.Equal(t, channel, RelayChannel("ssh://git@github.com/me/notes.git/"))
+	assert.Equal(t, channel, RelayChannel("https://user@GitHub.com/me/notes.git\n"))
+	assert.NotEqual(t, channel, RelayChannel("git@github.com:me/work.git"))
+	assert.NotEqual(t, channel, RelayChannel("git@gitlab.com:me/notes.git"))
+}
+
+func TestRelayConfig_Validate(t *testing.T) {
+	assert.NoError(t, RelayConfig{}.Validate())
+	assert.NoError(t, RelayConfig{URL: "https://relay.example.com"}.Validate())
+	assert.EqualError(t, RelayConfig{URL: "relay.example.com"}.Validate(), "invalid relay url: relay.example.com")
+}
+
+func TestRelay_PublishSubscribe(t *testing.T) {
+	repos := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(repos)
+	server, httpServer := relayServer(t, "secret")
+	defer closeRelayServer(httpServer)
+
+	subscriber, updates := subscribedRelay(t, server, httpServer.URL, repos.Local)
+	publisher := NewRelay(nil)
+	publisher.Configure(RelayConfig{URL: httpServer.URL, Token: "secret"})
+
+	assert.NoError(t, publisher.publish(context.Background(), repos.Local))
+	select {
+	case path := <-updates:
+		assert.Equal(t, repos.Local, path)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the push was never received")
+	}
+
+	// The own pushes are ignored.
+	assert.NoError(t, subscriber.publish(context.Background(), repos.Local))
+	assert.NoError(t, publisher.publish(context.Background(), repos.Local))
+	assert.Equal(t, repos.Local, <-updates)
+	assert.Equal(t, 0, len(updates))
+}
+
+func TestRelay_InvalidToken(t *testing.T) {
+	repos := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(repos)
+	_, httpServer := relayServer(t, "secret")
+	defer closeRelayServer(httpServer)
+
+	relay := NewRelay(nil)
+	relay.Configure(RelayConfig{URL: httpServer.URL, Token: "wrong"})
+	assert.EqualError(t, relay.publish(context.Background(), repos.Local), "the relay answered 401 Unauthorized")
+
+	_, err := relay.subscribe(RelayChannel("git@github.com:me/notes.git"), func() {})
+	assert.EqualError(t, err, "the relay answered 401 Unauthorized")
+}
+
+func TestRelay_PublishAfterPush(t *testing.T) {
+	repos := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(repos)
+	server, httpServer := relayServer(t, "secret")
+	defer closeRelayServer(httpServer)
+
+	_, updates := subscribedRelay(t, server, httpServer.URL, repos.Local)
+	git := NewGoGit(NewRelay(nil), nil, nil)
+	git.Configure(&Config{Repos: []string{repos.Local}, Relay: RelayConfig{URL: httpServer.URL, Token: "secret"}})
+
+	test_helpers.WriteFile(t, repos.Local, "test.md", "TestContent")
+	assert.NoError(t, git.Sync(repos.Local))
+	select {
+	case path := <-updates:
+		assert.Equal(t, repos.Local, path)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the push was never published")
+	}
+
+	// Nothing is published without a push.
+	assert.NoError(t, git.Sync(repos.Local))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, len(updates))
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Git notes keeps its per-repo files (e.g. the files blocked by hooks and the push hold) in `.git/git-notes`. They
+// are never committed, and the CLI subcommands use them to talk to the running daemon.
+const stateDirName = "git-notes"
+
+func stateDir(ctx context.Context, path string) (string, error) {
+	out, err := runCmdStdout(ctx, path, "git", "rev-parse", "--absolute-git-dir")
+	if err != nil {
+		return "", fmt.Errorf("unable to find the git dir of %s. Err: %v", path, err)
+	}
+
+	dir := filepath.Join(strings.TrimSpace(out), stateDirName)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+func stateFilePath(ctx context.Context, path string, name string) (string, error) {
+	dir, err := stateDir(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// readStateFile returns an empty string when the file doesn't exist.
+func readStateFile(ctx context.Context, path string, name string) (string, error) {
+	file, err := stateFilePath(ctx, path, name)
+	if err != nil {
+		return "", err
+	}
+
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return string(content), err
+}
+
+func stateFileExists(ctx context.Context, path string, name string) (bool, error) {
+	file, err := stateFilePath(ctx, path, name)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = os.Stat(file)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func writeStateFile(ctx context.Context, path string, name string, content string) error {
+	file, err := stateFilePath(ctx, path, name)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, []byte(content), 0644)
+}
+
+func removeStateFile(ctx context.Context, path string, name string) error {
+	file, err := stateFilePath(ctx, path, name)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const meteredName = "metered"
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Window is a daily time range on some days of the week, written like `Mon-Fri 09:00-18:00`, `Sat,Sun 10:00-12:00`
+// or `22:00-07:00`. Without days, it applies every day. A range that ends before it starts crosses midnight, and
+// belongs to the day it starts on.
+type Window struct {
+	days  [7]bool
+	start int
+	end   int
+}
+
+func ParseWindow(window string) (Window, error) {
+	var w Window
+	fields := strings.Fields(window)
+
+	var times string
+	switch len(fields) {
+	case 1:
+		for i := range w.days {
+			w.days[i] = true
+		}
+		times = fields[0]
+	case 2:
+		err := parseDays(fields[0], &w.days)
+		if err != nil {
+			return w, fmt.Errorf("invalid window: %s. Err: %v", window, err)
+		}
+		times = fields[1]
+	default:
+		return w, fmt.Errorf("invalid window: %s", window)
+	}
+
+	bounds := strings.Split(times, "-")
+	if len(bounds) != 2 {
+		return w, fmt.Errorf("invalid window: %s", window)
+	}
+
+	var err error
+	w.start, err = parseMinutes(bounds[0])
+	if err == nil {
+		w.end, err = parseMinutes(bounds[1])
+	}
+	if err != nil {
+		return w, fmt.Errorf("invalid window: %s. Err: %v", window, err)
+	}
+	return w, nil
+}
+
+func parseDays(days string, result *[7]bool) error {
+	for _, part := range strings.Split(strings.ToLower(days), ",") {
+		bounds := strings.Split(part, "-")
+		from, ok := weekdays[bounds[0]]
+		if !ok || len(bounds) > 2 {
+			return fmt.Errorf("invalid days: %s", part)
+		}
+
+		to := from
+		if len(bounds) == 2 {
+			to, ok = weekdays[bounds[1]]
+			if !ok {
+				return fmt.Errorf("invalid days: %s", part)
+			}
+		}
+
+		for day := from; ; day = (day + 1) % 7 {
+			result[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func parseMinutes(clock string) (int, error) {
+	parts := strings.Split(clock, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid time: %s", clock)
+	}
+
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid time: %s", clock)
+	}
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, fmt.Errorf("invalid time: %s", clock)
+	}
+
+	total := hours*60 + minutes
+	if hours < 0 || minutes < 0 || minutes >= 60 || total > 24*60 {
+		return 0, fmt.Errorf("invalid time: %s", clock)
+	}
+	return total, nil
+}
+
+func (w Window) Contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if w.start <= w.end {
+		return w.days[t.Weekday()] && minute >= w.start && minute < w.end
+	}
+
+	yesterday := (t.Weekday() + 6) % 7
+	return (w.days[t.Weekday()] && minute >= w.start) || (w.days[yesterday] && minute < w.end)
+}
+
+func inWindows(windows []string, t time.Time) bool {
+	for _, window := range windows {
+		w, err := ParseWindow(window)
+		if err == nil && w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows returns whether the remote operations (fetch, merge and push), and the pushes in particular, are allowed at
+// the time. Local commits are always allowed.
+func (s ScheduleConfig) Allows(t time.Time, metered bool) (remote bool, push bool) {
+	remote = !inWindows(s.QuietHours, t)
+	if len(s.RemoteWindows) > 0 && !inWindows(s.RemoteWindows, t) {
+		remote = false
+	}
+
+	push = remote
+	if metered && !inWindows(s.UnmeteredWindows, t) {
+		push = false
+	}
+	return remote, push
+}
+
+func validateSchedule(schedule ScheduleConfig) error {
+	for _, windows := range [][]string{schedule.RemoteWindows, schedule.QuietHours, schedule.UnmeteredWindows} {
+		for _, window := range windows {
+			_, err := ParseWindow(window)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// userStateDir holds the files of git-notes that aren't about a single repo, e.g. the machine-wide metered flag.
+func userStateDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	dir = filepath.Join(dir, "git-notes")
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// IsMetered returns true when the whole machine or the repo is flagged as metered.
+func IsMetered(ctx context.Context, path string) (bool, error) {
+	metered, err := IsMachineMetered()
+	if err != nil || metered {
+		return metered, err
+	}
+
+	return stateFileExists(ctx, path, meteredName)
+}
+
+func IsMachineMetered() (bool, error) {
+	dir, err := userStateDir()
+	if err != nil {
+		return false, err
+	}
+
+	_, err = os.Stat(filepath.Join(dir, meteredName))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// SetMetered flags the repo, or the whole machine when the repo is empty, as metered.
+func SetMetered(ctx context.Context, path string, metered bool) error {
+	if path != "" {
+		if metered {
+			return writeStateFile(ctx, path, meteredName, "")
+		}
+		return removeStateFile(ctx, path, meteredName)
+	}
+
+	dir, err := userStateDir()
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(dir, meteredName)
+
+	if metered {
+		return ioutil.WriteFile(file, []byte{}, 0644)
+	}
+	err = os.Remove(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
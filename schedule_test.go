@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"git-notes/internal/test_helpers"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 2021-06-07 is a Monday.
+func at(day int, clock string) time.Time {
+	t, err := time.ParseInLocation("2006-01-02 15:04", fmt.Sprintf("2021-06-%02d %s", day, clock), time.Local)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestParseWindow(t *testing.T) {
+	w, err := ParseWindow("Mon-Fri 09:00-18:00")
+	assert.NoError(t, err)
+	assert.True(t, w.Contains(at(7, "09:00")))
+	assert.True(t, w.Contains(at(11, "17:59")))
+	assert.False(t, w.Contains(at(7, "18:00")))
+	assert.False(t, w.Contains(at(7, "08:59")))
+	assert.False(t, w.Contains(at(12, "12:00")))
+
+	w, err = ParseWindow("Sat,Sun 10:00-12:00")
+	assert.NoError(t, err)
+	assert.True(t, w.Contains(at(12, "11:00")))
+	assert.True(t, w.Contains(at(13, "10:00")))
+	assert.False(t, w.Contains(at(7, "11:00")))
+
+	w, err = ParseWindow("Fri-Mon 00:00-24:00")
+	assert.NoError(t, err)
+	assert.True(t, w.Contains(at(7, "23:59")))
+	assert.False(t, w.Contains(at(8, "12:00")))
+
+	_, err = ParseWindow("Someday 10:00-12:00")
+	assert.EqualError(t, err, "invalid window: Someday 10:00-12:00. Err: invalid days: someday")
+	_, err = ParseWindow("10:00-25:00")
+	assert.EqualError(t, err, "invalid window: 10:00-25:00. Err: invalid time: 25:00")
+	_, err = ParseWindow("10:00")
+	assert.EqualError(t, err, "invalid window: 10:00")
+}
+
+func TestParseWindow_Midnight(t *testing.T) {
+	w, err := ParseWindow("Fri 22:00-07:00")
+	assert.NoError(t, err)
+	assert.True(t, w.Contains(at(11, "23:00")))
+	assert.True(t, w.Contains(at(12, "06:59")))
+	assert.False(t, w.Contains(at(12, "07:00")))
+	assert.False(t, w.Contains(at(12, "23:00")))
+	assert.False(t, w.Contains(at(11, "06:00")))
+}
+
+func TestScheduleConfig_Allows(t *testing.T) {
+	schedule := ScheduleConfig{
+		RemoteWindows:    []string{"08:00-23:00"},
+		QuietHours:       []string{"12:00-13:00"},
+		UnmeteredWindows: []string{"20:00-23:00"},
+	}
+
+	remote, push := schedule.Allows(at(7, "10:00"), false)
+	assert.True(t, remote)
+	assert.True(t, push)
+
+	remote, push = schedule.Allows(at(7, "12:30"), false)
+	assert.False(t, remote)
+	assert.False(t, push)
+
+	remote, push = schedule.Allows(at(7, "23:30"), false)
+	assert.False(t, remote)
+	assert.False(t, push)
+
+	remote, push = schedule.Allows(at(7, "10:00"), true)
+	assert.True(t, remote)
+	assert.False(t, push)
+
+	remote, push = schedule.Allows(at(7, "21:00"), true)
+	assert.True(t, remote)
+	assert.True(t, push)
+
+	remote, push = ScheduleConfig{}.Allows(at(7, "03:00"), false)
+	assert.True(t, remote)
+	assert.True(t, push)
+}
+
+func TestSchedule_QuietHours(t *testing.T) {
+	repos := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(repos)
+
+	clock := test_helpers.NewFakeClock(at(7, "12:30"))
+	git := gitWithSettings(RepoConfig{Schedule: ScheduleConfig{QuietHours: []string{"12:00-13:00"}}}, repos.Local)
+	git.clock = clock
+
+	test_helpers.WriteFile(t, repos.Local, "test.md", "TestContent")
+	assert.NoError(t, git.Sync(repos.Local))
+
+	state, err := git.GetState(repos.Local)
+	assert.NoError(t, err)
+	assert.Equal(t, Deferred, state)
+	assert.Empty(t, remoteFiles(t, repos))
+
+	dirty, err := git.IsDirty(repos.Local)
+	assert.NoError(t, err)
+	assert.False(t, dirty)
+
+	clock.Advance(29 * time.Minute)
+	state, err = git.GetState(repos.Local)
+	assert.NoError(t, err)
+	assert.Equal(t, Deferred, state)
+
+	clock.Advance(time.Minute)
+	assert.NoError(t, git.Sync(repos.Local))
+	assert.Equal(t, []string{"test.md"}, remoteFiles(t, repos))
+}
+
+func TestSchedule_Metered(t *testing.T) {
+	repos := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(repos)
+
+	git := gitWithSettings(RepoConfig{Schedule: ScheduleConfig{}}, repos.Local)
+	assert.NoError(t, meteredCommand([]string{"on", repos.Local}))
+
+	metered, err := IsMetered(context.Background(), repos.Local)
+	assert.NoError(t, err)
+	assert.True(t, metered)
+
+	test_helpers.WriteFile(t, repos.Local, "test.md", "TestContent")
+	assert.NoError(t, git.Sync(repos.Local))
+
+	state, err := git.GetState(repos.Local)
+	assert.NoError(t, err)
+	assert.Equal(t, Deferred, state)
+	assert.Empty(t, remoteFiles(t, repos))
+
+	// Pushing is fine in an unmetered window.
+	unmetered := gitWithSettings(RepoConfig{Schedule: ScheduleConfig{UnmeteredWindows: []string{"00:00-24:00"}}}, repos.Local)
+	state, err = unmetered.GetState(repos.Local)
+	assert.NoError(t, err)
+	assert.Equal(t, Ahead, state)
+
+	assert.NoError(t, meteredCommand([]string{"off", repos.Local}))
+	assert.NoError(t, git.Sync(repos.Local))
+	assert.Equal(t, []string{"test.md"}, remoteFiles(t, repos))
+}
+
+func TestSchedule_MachineMetered(t *testing.T) {
+	path := test_helpers.SetupGitRepo("metered", false)
+	defer test_helpers.CleanupRepo(path)
+
+	assert.NoError(t, SetMetered(context.Background(), "", true))
+	defer SetMetered(context.Background(), "", false)
+
+	metered, err := IsMetered(context.Background(), path)
+	assert.NoError(t, err)
+	assert.True(t, metered)
+
+	assert.NoError(t, SetMetered(context.Background(), "", false))
+	metered, err = IsMetered(context.Background(), path)
+	assert.NoError(t, err)
+	assert.False(t, metered)
+}
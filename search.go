@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	// The index is only local, so it holds the words of the decrypted notes of the encrypted repos too.
+	searchIndexName    = "search-index.json"
+	searchIndexVersion = 1
+	maxIndexedFileSize = 1 << 20
+	maxSearchTermSize  = 64
+	defaultSearchLimit = 20
+)
+
+// The BM25 parameters of the ranking.
+const (
+	searchK1 = 1.2
+	searchB  = 0.75
+)
+
+// SearchIndex holds the words of the files of a repo at a commit.
+type SearchIndex struct {
+	Version int                    `json:"version"`
+	Commit  string                 `json:"commit"`
+	Files   map[string]IndexedFile `json:"files"`
+}
+
+type IndexedFile struct {
+	// Terms counts the words of the file.
+	Terms  map[string]int `json:"terms"`
+	Length int            `json:"length"`
+}
+
+// searchTerms splits the text in lowercase words.
+func searchTerms(text string) []string {
+	var terms []string
+	for _, term := range strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len(term) <= maxSearchTermSize {
+			terms = append(terms, strings.ToLower(term))
+		}
+	}
+	return terms
+}
+
+func readSearchIndex(ctx context.Context, path string) (SearchIndex, error) {
+	empty := SearchIndex{Version: searchIndexVersion, Files: map[string]IndexedFile{}}
+	content, err := readStateFile(ctx, path, searchIndexName)
+	if err != nil || content == "" {
+		return empty, err
+	}
+
+	var index SearchIndex
+	err = json.Unmarshal([]byte(content), &index)
+	if err != nil || index.Version != searchIndexVersion || index.Files == nil {
+		// It's rebuilt.
+		return empty, nil
+	}
+	return index, nil
+}
+
+// writeSearchIndex replaces the index at once, because the daemon and the search command both update it.
+func writeSearchIndex(ctx context.Context, path string, index SearchIndex) error {
+	content, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	file, err := stateFilePath(ctx, path, searchIndexName)
+	if err != nil {
+		return err
+	}
+	temp := fmt.Sprintf("%s.%d", file, os.Getpid())
+	err = ioutil.WriteFile(temp, content, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp, file)
+}
+
+// UpdateSearchIndex indexes the files that changed between the indexed commit and HEAD, and returns the index.
+func UpdateSearchIndex(ctx context.Context, path string) (SearchIndex, error) {
+	index, err := readSearchIndex(ctx, path)
+	if err != nil {
+		return index, err
+	}
+	commit := head(ctx, path)
+	if commit == "" || commit == index.Commit {
+		return index, nil
+	}
+
+	changed, deleted, err := changedSinceIndex(ctx, path, index.Commit, commit)
+	if err != nil {
+		// E.g. the indexed commit is gone after a rewrite of the history.
+		index = SearchIndex{Version: searchIndexVersion, Files: map[string]IndexedFile{}}
+		changed, deleted, err = changedSinceIndex(ctx, path, "", commit)
+		if err != nil {
+			return index, err
+		}
+	}
+
+	for _, file := range deleted {
+		delete(index.Files, file)
+	}
+	lfs, err := largeFilePaths(ctx, path, changed)
+	if err != nil {
+		return index, err
+	}
+	for _, file := range changed {
+		delete(index.Files, file)
+		if lfs[file] {
+			// Indexing them would download them.
+			continue
+		}
+		indexed, ok := indexFile(ctx, path, commit, file)
+		if ok {
+			index.Files[file] = indexed
+		}
+	}
+
+	index.Commit = commit
+	return index, writeSearchIndex(ctx, path, index)
+}
+
+// changedSinceIndex returns the changed and the deleted files since the indexed commit, or all the files without
+// one.
+func changedSinceIndex(ctx context.Context, path string, indexed string, commit string) ([]string, []string, error) {
+	if indexed == "" {
+		out, err := runCmdStdout(ctx, path, "git", "ls-tree", "-r", "-z", "--name-only", commit)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to list the files of %s. Err: %v", commit, err)
+		}
+		return splitNul(out), nil, nil
+	}
+
+	out, err := runCmdStdout(ctx, path, "git", "diff", "--name-status", "--no-renames", "-z", indexed, commit)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to diff %s with %s. Err: %v", indexed, commit, err)
+	}
+	var changed, deleted []string
+	fields := splitNul(out)
+	for i := 0; i+1 < len(fields); i += 2 {
+		if fields[i] == "D" {
+			deleted = append(deleted, fields[i+1])
+		} else {
+			changed = append(changed, fields[i+1])
+		}
+	}
+	return changed, deleted, nil
+}
+
+// largeFilePaths returns the files that are stored in LFS.
+func largeFilePaths(ctx context.Context, path string, files []string) (map[string]bool, error) {
+	lfs := map[string]bool{}
+	if len(files) == 0 {
+		return lfs, nil
+	}
+	cmd := []string{"check-attr", "-z", "filter", "--"}
+	out, err := runCmdStdout(ctx, path, "git", append(cmd, files...)...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the attributes of the files. Err: %v", err)
+	}
+	// The output is `<file> NUL filter NUL <value> NUL`.
+	fields := strings.Split(out, "\x00")
+	for i := 0; i+2 < len(fields); i += 3 {
+		if fields[i+2] == "lfs" {
+			lfs[fields[i]] = true
+		}
+	}
+	return lfs, nil
+}
+
+// indexFile counts the words of the file at the commit. The binary and the large files aren't indexed.
+func indexFile(ctx context.Context, path string, commit string, file string) (IndexedFile, bool) {
+	// The filters decrypt the encrypted repos.
+	content, err := runCmdStdout(ctx, path, "git", "cat-file", "--filters", fmt.Sprintf("%s:%s", commit, file))
+	if err != nil {
+		// E.g. a submodule.
+		log.Printf("Not indexing %s in %s. Err: %v", file, path, err)
+		return IndexedFile{}, false
+	}
+	if len(content) > maxIndexedFileSize || strings.ContainsRune(content, 0) {
+		return IndexedFile{}, false
+	}
+
+	indexed := IndexedFile{Terms: map[string]int{}}
+	for _, term := range searchTerms(content) {
+		indexed.Terms[term]++
+		indexed.Length++
+	}
+	return indexed, true
+}
+
+// SearchQuery is parsed from the text of a search, e.g. `groceries path:home/ repo:personal`.
+type SearchQuery struct {
+	// Terms are the words that the files must all have. A term that ends with `*` matches the words that start
+	// with it.
+	Terms []string
+	// Paths are globs, e.g. `*.md` or `work/*.md`, or directories, e.g. `work/`. A file matches any of them.
+	Paths []string
+	// Repos are parts of the paths of the repos. A repo matches any of them.
+	Repos []string
+	Limit int
+}
+
+func ParseSearchQuery(text string) SearchQuery {
+	var query SearchQuery
+	for _, word := range strings.Fields(text) {
+		switch {
+		case strings.HasPrefix(word, "path:") && len(word) > len("path:"):
+			query.Paths = append(query.Paths, strings.TrimPrefix(word, "path:"))
+		case strings.HasPrefix(word, "repo:") && len(word) > len("repo:"):
+			query.Repos = append(query.Repos, strings.TrimPrefix(word, "repo:"))
+		default:
+			prefix := strings.HasSuffix(word, "*")
+			terms := searchTerms(word)
+			if prefix && len(terms) > 0 {
+				terms[len(terms)-1] += "*"
+			}
+			query.Terms = append(query.Terms, terms...)
+		}
+	}
+	return query
+}
+
+type SearchResult struct {
+	Repo  string  `json:"repo"`
+	File  string  `json:"file"`
+	Score float64 `json:"score"`
+	// Line is the first line with one of the terms.
+	Line string `json:"line"`
+}
+
+func (r SearchResult) String() string {
+	if r.Line == "" {
+		return filepath.Join(r.Repo, r.File)
+	}
+	return fmt.Sprintf("%s: %s", filepath.Join(r.Repo, r.File), r.Line)
+}
+
+func matchesRepo(repo string, filters []string) bool {
+	for _, filter := range filters {
+		if strings.Contains(repo, filter) {
+			return true
+		}
+	}
+	return len(filters) == 0
+}
+
+func matchesPath(file string, filters []string) bool {
+	for _, filter := range filters {
+		if strings.HasSuffix(filter, "/") {
+			if strings.HasPrefix(file, filter) {
+				return true
+			}
+			continue
+		}
+		if strings.HasPrefix(file, filter+"/") {
+			return true
+		}
+		if ok, _ := path.Match(filter, file); ok {
+			return true
+		}
+		// E.g. `*.md` matches in every directory.
+		if ok, _ := path.Match(filter, path.Base(file)); ok && !strings.Contains(filter, "/") {
+			return true
+		}
+	}
+	return len(filters) == 0
+}
+
+// termFrequency counts the term in the file. A prefix term counts all the words that start with it.
+func termFrequency(file IndexedFile, term string) int {
+	if !strings.HasSuffix(term, "*") {
+		return file.Terms[term]
+	}
+	count := 0
+	for word, n := range file.Terms {
+		if termMatches(word, term) {
+			count += n
+		}
+	}
+	return count
+}
+
+func termMatches(word string, term string) bool {
+	prefix := strings.TrimSuffix(term, "*")
+	return word == term || (prefix != term && strings.HasPrefix(word, prefix))
+}
+
+func nameHasTerm(file string, term string) bool {
+	for _, word := range searchTerms(file) {
+		if termMatches(word, term) {
+			return true
+		}
+	}
+	return false
+}
+
+type searchCandidate struct {
+	repo string
+	file string
+	doc  IndexedFile
+}
+
+// Search updates the indexes of the repos, and returns the files that have all the terms, the best first. They're
+// ranked with BM25 across the repos, and the files with a term in their path rank higher.
+func Search(ctx context.Context, repos []string, query SearchQuery) ([]SearchResult, error) {
+	if len(query.Terms) == 0 {
+		return nil, fmt.Errorf("the search has no words")
+	}
+
+	var candidates []searchCandidate
+	for _, repo := range repos {
+		if !matchesRepo(repo, query.Repos) {
+			continue
+		}
+		index, err := UpdateSearchIndex(ctx, repo)
+		if err != nil {
+			return nil, fmt.Errorf("unable to index %s. Err: %v", repo, err)
+		}
+		for file, doc := range index.Files {
+			if matchesPath(file, query.Paths) {
+				candidates = append(candidates, searchCandidate{repo: repo, file: file, doc: doc})
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	total := 0
+	frequencies := make([]map[string]int, len(candidates))
+	documents := map[string]int{}
+	for i, candidate := range candidates {
+		total += candidate.doc.Length
+		frequencies[i] = map[string]int{}
+		for _, term := range query.Terms {
+			tf := termFrequency(candidate.doc, term)
+			frequencies[i][term] = tf
+			if tf > 0 || nameHasTerm(candidate.file, term) {
+				documents[term]++
+			}
+		}
+	}
+	count := float64(len(candidates))
+	average := math.Max(float64(total)/count, 1)
+
+	var results []SearchResult
+	for i, candidate := range candidates {
+		score := 0.0
+		matched := true
+		for _, term := range query.Terms {
+			idf := math.Log(1 + (count-float64(documents[term])+0.5)/(float64(documents[term])+0.5))
+			tf := float64(frequencies[i][term])
+			inName := nameHasTerm(candidate.file, term)
+			if tf == 0 && !inName {
+				matched = false
+				break
+			}
+			score += idf * tf * (searchK1 + 1) /
+				(tf + searchK1*(1-searchB+searchB*float64(candidate.doc.Length)/average))
+			if inName {
+				// As much as the most the content can score.
+				score += idf * (searchK1 + 1)
+			}
+		}
+		if matched {
+			results = append(results, SearchResult{Repo: candidate.repo, File: candidate.file, Score: score})
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		if results[i].Repo != results[j].Repo {
+			return results[i].Repo < results[j].Repo
+		}
+		return results[i].File < results[j].File
+	})
+	limit := query.Limit
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	for i := range results {
+		results[i].Line = matchingLine(results[i].Repo, results[i].File, query.Terms)
+	}
+	return results, nil
+}
+
+// matchingLine returns the first line of the file in the working tree with one of the terms.
+func matchingLine(repo string, file string, terms []string) string {
+	content, err := ioutil.ReadFile(filepath.Join(repo, filepath.FromSlash(file)))
+	if err != nil || len(content) > maxIndexedFileSize {
+		return ""
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		for _, word := range searchTerms(line) {
+			for _, term := range terms {
+				if termMatches(word, term) {
+					runes := []rune(strings.TrimSpace(line))
+					if len(runes) > 120 {
+						return string(runes[:117]) + "..."
+					}
+					return string(runes)
+				}
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"git-notes/internal/test_helpers"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSearchIndexIsIncremental(t *testing.T) {
+	repos := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(repos)
+	git := GitCmd{}
+
+	test_helpers.WriteFile(t, repos.Local, "groceries.md", "Milk, eggs and more eggs")
+	test_helpers.WriteFile(t, repos.Local, "todo.md", "Call the plumber")
+	test_helpers.WriteFile(t, repos.Local, "old.md", "Nothing")
+	assert.NoError(t, git.Sync(repos.Local))
+
+	index, err := readSearchIndex(context.Background(), repos.Local)
+	assert.NoError(t, err)
+	assert.Equal(t, head(context.Background(), repos.Local), index.Commit)
+	assert.Equal(t, IndexedFile{Terms: map[string]int{"milk": 1, "eggs": 2, "and": 1, "more": 1}, Length: 5},
+		index.Files["groceries.md"])
+	assert.Len(t, index.Files, 3)
+
+	// The files that didn't change aren't indexed again.
+	index.Files["todo.md"] = IndexedFile{Terms: map[string]int{"untouched": 1}, Length: 1}
+	assert.NoError(t, writeSearchIndex(context.Background(), repos.Local, index))
+
+	test_helpers.WriteFile(t, repos.Local, "groceries.md", "Bread")
+	assert.NoError(t, os.Remove(filepath.Join(repos.Local, "old.md")))
+	assert.NoError(t, git.Sync(repos.Local))
+
+	index, err = readSearchIndex(context.Background(), repos.Local)
+	assert.NoError(t, err)
+	assert.Equal(t, head(context.Background(), repos.Local), index.Commit)
+	assert.Equal(t, map[string]int{"bread": 1}, index.Files["groceries.md"].Terms)
+	assert.Equal(t, map[string]int{"untouched": 1}, index.Files["todo.md"].Terms)
+	assert.NotContains(t, index.Files, "old.md")
+}
+
+func TestSearchIndexIsRebuiltWithoutItsCommit(t *testing.T) {
+	repos := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(repos)
+
+	test_helpers.WriteFile(t, repos.Local, "a.md", "apple")
+	assert.NoError(t, (&GitCmd{}).Sync(repos.Local))
+
+	stale := SearchIndex{Version: searchIndexVersion, Commit: "0123456789012345678901234567890123456789",
+		Files: map[string]IndexedFile{"gone.md": {Terms: map[string]int{"gone": 1}, Length: 1}}}
+	assert.NoError(t, writeSearchIndex(context.Background(), repos.Local, stale))
+
+	index, err := UpdateSearchIndex(context.Background(), repos.Local)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a.md"}, indexedFiles(index))
+}
+
+func TestSearchIndexAfterMerge(t *testing.T) {
+	machines := test_helpers.SetupMachines(2, 0)
+	defer test_helpers.CleanupMachines(machines)
+	desktop, laptop := machines.Clones[0], machines.Clones[1]
+	git := GitCmd{}
+
+	test_helpers.WriteFile(t, desktop, "trip.md", "Pack the passport")
+	assert.NoError(t, git.Sync(desktop))
+	assert.NoError(t, git.Sync(laptop))
+
+	index, err := readSearchIndex(context.Background(), laptop)
+	assert.NoError(t, err)
+	assert.Equal(t, head(context.Background(), laptop), index.Commit)
+	assert.Equal(t, 1, index.Files["trip.md"].Terms["passport"])
+}
+
+func indexedFiles(index SearchIndex) []string {
+	var files []string
+	for file := range index.Files {
+		files = append(files, file)
+	}
+	return files
+}
+
+func TestSearch(t *testing.T) {
+	personal := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(personal)
+	work := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(work)
+	git := GitCmd{}
+
+	test_helpers.WriteFile(t, personal.Local, "recipes.md", "# Pancakes\nFlour, milk and eggs.\nPancakes are great.")
+	test_helpers.WriteFile(t, personal.Local, "diary.md", "Had pancakes for breakfast with a lot of friends today")
+	test_helpers.WriteFile(t, personal.Local, "pancakes.md", "A list")
+	assert.NoError(t, git.Sync(personal.Local))
+	test_helpers.WriteFile(t, work.Local, "meeting.md", "Pancakes at the meeting")
+	test_helpers.WriteFile(t, work.Local, "notes.txt", "Nothing here")
+	assert.NoError(t, git.Sync(work.Local))
+	repos := []string{personal.Local, work.Local}
+
+	results, err := Search(context.Background(), repos, ParseSearchQuery("pancakes"))
+	assert.NoError(t, err)
+	var files []string
+	for _, result := range results {
+		files = append(files, result.File)
+	}
+	// The file named after the word ranks first, then the file that has it the most.
+	assert.Equal(t, []string{"pancakes.md", "recipes.md", "meeting.md", "diary.md"}, files)
+	assert.Equal(t, "# Pancakes", results[1].Line)
+	assert.Equal(t, "Pancakes at the meeting", results[2].Line)
+	assert.Equal(t, work.Local, results[2].Repo)
+
+	// Every word must be found.
+	results, err = Search(context.Background(), repos, ParseSearchQuery("pancakes milk"))
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	assert.Equal(t, "recipes.md", results[0].File)
+
+	results, err = Search(context.Background(), repos, ParseSearchQuery("breakf*"))
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	assert.Equal(t, "diary.md", results[0].File)
+
+	query := ParseSearchQuery("pancakes")
+	query.Repos = []string{work.Local}
+	results, err = Search(context.Background(), repos, query)
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	assert.Equal(t, "meeting.md", results[0].File)
+
+	results, err = Search(context.Background(), repos, ParseSearchQuery("pancakes path:diary.md"))
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	assert.Equal(t, "diary.md", results[0].File)
+
+	query = ParseSearchQuery("pancakes")
+	query.Limit = 2
+	results, err = Search(context.Background(), repos, query)
+	assert.NoError(t, err)
+	assert.Len(t, results, 2)
+
+	_, err = Search(context.Background(), repos, ParseSearchQuery("path:*.md"))
+	assert.Error(t, err)
+}
+
+func TestParseSearchQuery(t *testing.T) {
+	assert.Equal(t, SearchQuery{
+		Terms: []string{"call", "mom", "plumb*"},
+		Paths: []string{"todo/", "*.md"},
+		Repos: []string{"personal"},
+	}, ParseSearchQuery("Call-Mom path:todo/ plumb* repo:personal path:*.md"))
+}
+
+func TestMatchesPath(t *testing.T) {
+	assert.True(t, matchesPath("a/b.md", nil))
+	assert.True(t, matchesPath("work/a/b.md", []string{"work/"}))
+	assert.True(t, matchesPath("work/a/b.md", []string{"work"}))
+	assert.False(t, matchesPath("workshop/b.md", []string{"work"}))
+	assert.True(t, matchesPath("work/b.md", []string{"*.md"}))
+	assert.True(t, matchesPath("work/b.md", []string{"work/*.md"}))
+	assert.False(t, matchesPath("home/b.md", []string{"work/*.md"}))
+	assert.False(t, matchesPath("b.txt", []string{"*.md", "work/"}))
+}
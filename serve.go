@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/cgi"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// The suffixes of the smart HTTP requests. What comes before them is the path of the repo.
+var smartHttpSuffixes = []string{"/info/refs", "/git-upload-pack", "/git-receive-pack", "/HEAD"}
+
+var validRepoName = regexp.MustCompile(`^[A-Za-z0-9_.-]+(/[A-Za-z0-9_.-]+)*$`)
+
+// RepoServer hosts the bare repos under its root over the smart HTTP protocol of git, so it can be the `origin` of
+// the machines. It also runs a relay at `/relay`, and announces every push there.
+type RepoServer struct {
+	root  string
+	token string
+	// create makes the bare repos on the first request.
+	create bool
+	git    string
+	relay  *RelayServer
+}
+
+func NewRepoServer(root string, token string, create bool) (*RepoServer, error) {
+	if token == "" {
+		return nil, fmt.Errorf("serving the repos requires a token")
+	}
+	git, err := exec.LookPath("git")
+	if err != nil {
+		return nil, err
+	}
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(root)
+	if err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+	return &RepoServer{root: root, token: token, create: create, git: git, relay: NewRelayServer(token)}, nil
+}
+
+// authorized accepts the token as a bearer token, or as the password of basic auth with any user, e.g. in
+// `http://git-notes:<token>@host/notes.git`.
+func (s *RepoServer) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if _, password, ok := r.BasicAuth(); ok {
+		token = password
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+// repoName returns the path of the repo in the request, e.g. `notes.git` for `/notes.git/info/refs`.
+func repoName(path string) string {
+	for _, suffix := range smartHttpSuffixes {
+		if strings.HasSuffix(path, suffix) {
+			name := strings.Trim(strings.TrimSuffix(path, suffix), "/")
+			if validRepoName.MatchString(name) && !strings.Contains("/"+name+"/", "/../") && !strings.Contains("/"+name+"/", "/./") {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+func (s *RepoServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/relay" || strings.HasPrefix(r.URL.Path, "/relay/") {
+		http.StripPrefix("/relay", s.relay).ServeHTTP(w, r)
+		return
+	}
+
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="git-notes"`)
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	name := repoName(r.URL.Path)
+	if name == "" {
+		http.NotFound(w, r)
+		return
+	}
+	repo := filepath.Join(s.root, filepath.FromSlash(name))
+
+	if _, err := os.Stat(repo); os.IsNotExist(err) {
+		// The machines fetch before their first push.
+		if !s.create {
+			http.NotFound(w, r)
+			return
+		}
+		out, err := runCmd(r.Context(), s.root, "git", "init", "-q", "--bare", repo)
+		if err != nil {
+			log.Printf("Unable to create %s. Err: %v, %s", repo, err, out)
+			http.Error(w, "unable to create the repo", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Created %s", repo)
+	}
+
+	handler := &cgi.Handler{
+		Path: s.git,
+		Args: []string{"http-backend"},
+		Env: []string{
+			"GIT_PROJECT_ROOT=" + s.root,
+			"GIT_HTTP_EXPORT_ALL=1",
+			// The token is checked already.
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http.receivepack",
+			"GIT_CONFIG_VALUE_0=true",
+		},
+	}
+	if r.Method != "POST" || !strings.HasSuffix(r.URL.Path, "/git-receive-pack") {
+		handler.ServeHTTP(w, r)
+		return
+	}
+
+	// A rejected push still answers 200, with the rejection in the body, so the refs tell whether it went through.
+	before := refs(r.Context(), repo)
+	handler.ServeHTTP(w, r)
+	if refs(r.Context(), repo) != before {
+		// The machines name the channel after the URL they push to. See RelayChannel.
+		s.relay.Publish(RelayChannel("http://"+r.Host+"/"+name), "serve")
+	}
+}
+
+// refs lists the refs of the repo with their shas.
+func refs(ctx context.Context, repo string) string {
+	out, err := runCmdStdout(ctx, repo, "git", "for-each-ref", "--format=%(objectname) %(refname)")
+	if err != nil {
+		log.Printf("Unable to list the refs of %s. Err: %v", repo, err)
+	}
+	return out
+}
+
+// ServeRepos serves the repos until the server fails.
+func ServeRepos(listen string, server *RepoServer) error {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s. Err: %v", listen, err)
+	}
+	log.Printf("Serving the repos in %s at http://%s", server.root, listener.Addr())
+	return http.Serve(listener, server)
+}
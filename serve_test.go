@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"git-notes/internal/test_helpers"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func repoServer(t *testing.T, create bool) (string, *RepoServer, *httptest.Server) {
+	root, err := ioutil.TempDir("", "git-notes-serve")
+	assert.NoError(t, err)
+	server, err := NewRepoServer(root, "secret", create)
+	assert.NoError(t, err)
+	return root, server, httptest.NewServer(server)
+}
+
+// servedUrl is the URL of the repo, with the token as the password.
+func servedUrl(server *httptest.Server, token string, name string) string {
+	return strings.Replace(server.URL, "http://", "http://git-notes:"+token+"@", 1) + "/" + name
+}
+
+func TestRepoName(t *testing.T) {
+	assert.Equal(t, "notes.git", repoName("/notes.git/info/refs"))
+	assert.Equal(t, "team/notes.git", repoName("/team/notes.git/git-receive-pack"))
+	assert.Equal(t, "notes", repoName("/notes/git-upload-pack"))
+	assert.Equal(t, "", repoName("/../notes.git/info/refs"))
+	assert.Equal(t, "", repoName("/notes.git/objects/info/packs"))
+	assert.Equal(t, "", repoName("/info/refs"))
+}
+
+func TestNewRepoServer_RequiresToken(t *testing.T) {
+	_, err := NewRepoServer(os.TempDir(), "", false)
+	assert.EqualError(t, err, "serving the repos requires a token")
+}
+
+func TestRepoServer_PushAndFetch(t *testing.T) {
+	root, server, httpServer := repoServer(t, true)
+	defer os.RemoveAll(root)
+	defer closeRelayServer(httpServer)
+
+	laptop := test_helpers.SetupGitRepo("Laptop", false)
+	defer test_helpers.CleanupRepo(laptop)
+	test_helpers.PerformCmd(t, laptop, "git", "remote", "add", "origin", servedUrl(httpServer, "secret", "notes.git"))
+	git := &GitCmd{}
+
+	// The first push creates the repo.
+	test_helpers.WriteFile(t, laptop, "test.md", "TestContent")
+	assert.NoError(t, git.Sync(laptop))
+	assertState(t, laptop, Sync)
+	out, err := runCmdStdout(context.Background(), filepath.Join(root, "notes.git"), "git", "show", "HEAD:test.md")
+	assert.NoError(t, err)
+	assert.Equal(t, "TestContent", strings.TrimSpace(out))
+
+	// The laptop hears about the pushes of the desktop.
+	relay := NewRelay(test_helpers.NewFakeClock(time.Now()))
+	relay.Configure(RelayConfig{URL: httpServer.URL + "/relay", Token: "secret"})
+	updates := make(chan string, 10)
+	relay.Subscribe(laptop, updates)
+	channel, err := repoRelayChannel(context.Background(), laptop)
+	assert.NoError(t, err)
+	waitForSubscribers(t, server.relay, channel, 1)
+
+	dir, err := ioutil.TempDir("", "git-notes-desktop")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	test_helpers.PerformCmd(t, dir, "git", "clone", "-q", servedUrl(httpServer, "secret", "notes.git"), "notes")
+	desktop := filepath.Join(dir, "notes")
+	test_helpers.WriteFile(t, desktop, "desktop.md", "From the desktop")
+	assert.NoError(t, git.Sync(desktop))
+
+	select {
+	case path := <-updates:
+		assert.Equal(t, laptop, path)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the push was never announced")
+	}
+	assert.NoError(t, git.Sync(laptop))
+	assert.Equal(t, "From the desktop", readNote(t, laptop, "desktop.md"))
+}
+
+func TestRepoServer_Rejected(t *testing.T) {
+	root, _, httpServer := repoServer(t, false)
+	defer os.RemoveAll(root)
+	defer closeRelayServer(httpServer)
+
+	laptop := test_helpers.SetupGitRepo("Laptop", false)
+	defer test_helpers.CleanupRepo(laptop)
+	test_helpers.PerformCmd(t, laptop, "git", "remote", "add", "origin", servedUrl(httpServer, "wrong", "notes.git"))
+	test_helpers.WriteFile(t, laptop, "test.md", "TestContent")
+
+	// A wrong token is an auth failure.
+	assert.NoError(t, (&GitCmd{}).Sync(laptop))
+	assertState(t, laptop, AuthFailed)
+	assert.NoError(t, RetryAuth(context.Background(), laptop))
+
+	// Repos aren't created without --create.
+	test_helpers.PerformCmd(t, laptop, "git", "remote", "set-url", "origin", servedUrl(httpServer, "secret", "notes.git"))
+	assert.Error(t, (&GitCmd{}).Sync(laptop))
+	_, err := os.Stat(filepath.Join(root, "notes.git"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRepoServer_RejectedPushIsNotPublished(t *testing.T) {
+	root, server, httpServer := repoServer(t, true)
+	defer os.RemoveAll(root)
+	defer closeRelayServer(httpServer)
+
+	laptop := test_helpers.SetupGitRepo("Laptop", false)
+	defer test_helpers.CleanupRepo(laptop)
+	test_helpers.PerformCmd(t, laptop, "git", "remote", "add", "origin", servedUrl(httpServer, "secret", "notes.git"))
+	git := &GitCmd{}
+
+	channel, err := repoRelayChannel(context.Background(), laptop)
+	assert.NoError(t, err)
+	published := make(chan string, 10)
+	server.relay.mutex.Lock()
+	server.relay.subscribers[channel] = map[chan string]bool{published: true}
+	server.relay.mutex.Unlock()
+
+	test_helpers.WriteFile(t, laptop, "test.md", "TestContent")
+	assert.NoError(t, git.Sync(laptop))
+	assert.Equal(t, 1, len(published))
+
+	// The server refuses to rewrite the history, so the forced push fails.
+	test_helpers.PerformCmd(t, filepath.Join(root, "notes.git"), "git", "config", "receive.denyNonFastForwards", "true")
+	test_helpers.PerformCmd(t, laptop, "git", "-c", "user.name=Laptop", "-c", "user.email=laptop@example.com", "commit", "-q", "--amend", "-m", "Rewritten")
+	branch := test_helpers.GetLocalBranch(laptop)
+	_, err = runCmd(context.Background(), laptop, "git", "push", "-f", "origin", branch)
+	assert.Error(t, err)
+	assert.Equal(t, 1, len(published))
+}
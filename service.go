@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+const serviceName = "git-notes.service"
+
+var unitTemplate = template.Must(template.New("unit").Parse(`[Unit]
+Description=Git Notes
+{{- if .System}}
+Wants=network-online.target
+After=network-online.target
+{{- end}}
+
+[Service]
+Type=notify
+NotifyAccess=main
+{{- if .User}}
+User={{.User}}
+{{- end}}
+ExecStart={{.ExecStart}}
+TimeoutStartSec=10min
+WatchdogSec=20min
+Restart=always
+RestartSec=60
+
+[Install]
+WantedBy={{if .System}}multi-user.target{{else}}default.target{{end}}
+`))
+
+// ServiceOptions describes the systemd unit of git-notes.
+type ServiceOptions struct {
+	// Binary and Config are absolute paths.
+	Binary string
+	Config string
+	// System installs a system unit that runs as User instead of a user unit.
+	System bool
+	User   string
+	// UnitDir overrides the directory of the unit file.
+	UnitDir string
+}
+
+// Systemctl runs systemctl for the user or the system manager.
+type Systemctl interface {
+	Run(system bool, args ...string) (string, error)
+}
+
+type SystemctlCmd struct{}
+
+func (s SystemctlCmd) Run(system bool, args ...string) (string, error) {
+	if !system {
+		args = append([]string{"--user"}, args...)
+	}
+	cmd := exec.Command("systemctl", args...)
+	out, err := combinedOutputTimeout(context.Background(), cmd, defaultLocalTimeout)
+	if err != nil {
+		return string(out), fmt.Errorf("systemctl %s failed: %s. Err: %v", strings.Join(args, " "), strings.TrimSpace(string(out)), err)
+	}
+	return string(out), nil
+}
+
+// NewServiceOptions uses the running binary and the given config file, which only install needs.
+func NewServiceOptions(configPath string, system bool) (ServiceOptions, error) {
+	binary, err := os.Executable()
+	if err != nil {
+		return ServiceOptions{}, fmt.Errorf("unable to find the git-notes binary. Err: %v", err)
+	}
+	binary, err = filepath.EvalSymlinks(binary)
+	if err != nil {
+		return ServiceOptions{}, fmt.Errorf("unable to find the git-notes binary. Err: %v", err)
+	}
+
+	if configPath != "" {
+		configPath, err = filepath.Abs(expandPath(configPath))
+		if err != nil {
+			return ServiceOptions{}, err
+		}
+	}
+
+	options := ServiceOptions{Binary: binary, Config: configPath, System: system}
+	if system {
+		current, err := user.Current()
+		if err != nil {
+			return ServiceOptions{}, fmt.Errorf("unable to find the current user. Err: %v", err)
+		}
+		options.User = current.Username
+	}
+	return options, nil
+}
+
+// unitDir returns where systemd reads the units from.
+func (o ServiceOptions) unitDir() (string, error) {
+	if o.UnitDir != "" {
+		return o.UnitDir, nil
+	}
+	if o.System {
+		return "/etc/systemd/system", nil
+	}
+	if config := os.Getenv("XDG_CONFIG_HOME"); config != "" {
+		return filepath.Join(config, "systemd", "user"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".config", "systemd", "user"), nil
+}
+
+func (o ServiceOptions) unitPath() (string, error) {
+	dir, err := o.unitDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, serviceName), nil
+}
+
+// systemdQuote quotes an argument of ExecStart, where `%` starts a specifier and `$` a variable.
+func systemdQuote(arg string) string {
+	arg = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%", "$", "$$").Replace(arg)
+	if arg == "" || strings.ContainsAny(arg, " \t'") {
+		return `"` + arg + `"`
+	}
+	return arg
+}
+
+// RenderUnit returns the content of the unit file.
+func RenderUnit(options ServiceOptions) (string, error) {
+	var buffer bytes.Buffer
+	err := unitTemplate.Execute(&buffer, struct {
+		ServiceOptions
+		ExecStart string
+	}{options, systemdQuote(options.Binary) + " " + systemdQuote(options.Config)})
+	if err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
+
+// InstallService writes the unit, then enables and (re)starts it. With dryRun, it only prints what it would do.
+func InstallService(options ServiceOptions, systemctl Systemctl, dryRun bool, out io.Writer) error {
+	unit, err := RenderUnit(options)
+	if err != nil {
+		return err
+	}
+	path, err := options.unitPath()
+	if err != nil {
+		return err
+	}
+	commands := [][]string{{"daemon-reload"}, {"enable", serviceName}, {"restart", serviceName}}
+
+	if dryRun {
+		fmt.Fprintf(out, "# %s\n%s\n", path, unit)
+		printSystemctl(out, options.System, commands)
+		return nil
+	}
+
+	_, err = os.Stat(options.Config)
+	if err != nil {
+		return fmt.Errorf("unable to read the config file %s. Err: %v", options.Config, err)
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("unable to create %s. Err: %v", filepath.Dir(path), err)
+	}
+	err = ioutil.WriteFile(path, []byte(unit), 0644)
+	if err != nil {
+		return fmt.Errorf("unable to write %s. Err: %v", path, err)
+	}
+	fmt.Fprintf(out, "Wrote %s\n", path)
+
+	return runSystemctl(systemctl, options.System, commands)
+}
+
+// UninstallService stops and disables the unit, then removes it.
+func UninstallService(options ServiceOptions, systemctl Systemctl, dryRun bool, out io.Writer) error {
+	path, err := options.unitPath()
+	if err != nil {
+		return err
+	}
+	commands := [][]string{{"disable", "--now", serviceName}, {"daemon-reload"}}
+
+	if dryRun {
+		fmt.Fprintf(out, "rm %s\n", path)
+		printSystemctl(out, options.System, commands)
+		return nil
+	}
+
+	_, err = os.Stat(path)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s is not installed", path)
+	}
+	err = runSystemctl(systemctl, options.System, commands[:1])
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if err != nil {
+		return fmt.Errorf("unable to remove %s. Err: %v", path, err)
+	}
+	fmt.Fprintf(out, "Removed %s\n", path)
+
+	return runSystemctl(systemctl, options.System, commands[1:])
+}
+
+// ServiceStatus prints where the unit is and what systemd says about it.
+func ServiceStatus(options ServiceOptions, systemctl Systemctl, out io.Writer) error {
+	path, err := options.unitPath()
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stat(path)
+	if os.IsNotExist(err) {
+		fmt.Fprintf(out, "%s is not installed\n", path)
+		return nil
+	}
+	fmt.Fprintf(out, "Unit: %s\n", path)
+
+	// `systemctl status` fails when the unit isn't running, which is a status too.
+	status, _ := systemctl.Run(options.System, "status", "--no-pager", serviceName)
+	fmt.Fprint(out, status)
+	return nil
+}
+
+func runSystemctl(systemctl Systemctl, system bool, commands [][]string) error {
+	for _, args := range commands {
+		_, err := systemctl.Run(system, args...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func printSystemctl(out io.Writer, system bool, commands [][]string) {
+	for _, args := range commands {
+		scope := " --user"
+		if system {
+			scope = ""
+		}
+		fmt.Fprintf(out, "systemctl%s %s\n", scope, strings.Join(args, " "))
+	}
+}
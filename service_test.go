@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type MockSystemctl struct {
+	calls []string
+}
+
+func (m *MockSystemctl) Run(system bool, args ...string) (string, error) {
+	call := strings.Join(args, " ")
+	if !system {
+		call = "--user " + call
+	}
+	m.calls = append(m.calls, call)
+	return "active (running)\n", nil
+}
+
+func serviceOptions(t *testing.T) (ServiceOptions, func()) {
+	dir, err := ioutil.TempDir("", "git-notes-service")
+	assert.NoError(t, err)
+	config := filepath.Join(dir, "my notes.yaml")
+	assert.NoError(t, ioutil.WriteFile(config, []byte("repos: []\n"), 0644))
+
+	options := ServiceOptions{Binary: "/usr/local/bin/git-notes", Config: config, UnitDir: filepath.Join(dir, "units")}
+	return options, func() { _ = os.RemoveAll(dir) }
+}
+
+func TestSystemdQuote(t *testing.T) {
+	assert.Equal(t, "/usr/bin/git-notes", systemdQuote("/usr/bin/git-notes"))
+	assert.Equal(t, `"/home/me/my notes.json"`, systemdQuote("/home/me/my notes.json"))
+	assert.Equal(t, "/home/me/100%%/$$HOME", systemdQuote("/home/me/100%/$HOME"))
+}
+
+func TestRenderUnit(t *testing.T) {
+	unit, err := RenderUnit(ServiceOptions{Binary: "/usr/local/bin/git-notes", Config: "/home/me/git-notes.yaml"})
+	assert.NoError(t, err)
+	assert.Contains(t, unit, "\nType=notify\n")
+	assert.Contains(t, unit, "\nExecStart=/usr/local/bin/git-notes /home/me/git-notes.yaml\n")
+	assert.Contains(t, unit, "\nWantedBy=default.target\n")
+	assert.NotContains(t, unit, "User=")
+
+	unit, err = RenderUnit(ServiceOptions{Binary: "/usr/local/bin/git-notes", Config: "/home/me/git-notes.yaml", System: true, User: "me"})
+	assert.NoError(t, err)
+	assert.Contains(t, unit, "\nUser=me\n")
+	assert.Contains(t, unit, "\nAfter=network-online.target\n")
+	assert.Contains(t, unit, "\nWantedBy=multi-user.target\n")
+}
+
+func TestInstallService(t *testing.T) {
+	options, cleanup := serviceOptions(t)
+	defer cleanup()
+	systemctl := &MockSystemctl{}
+	unitPath := filepath.Join(options.UnitDir, "git-notes.service")
+
+	var out bytes.Buffer
+	assert.NoError(t, InstallService(options, systemctl, false, &out))
+
+	content, err := ioutil.ReadFile(unitPath)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), `ExecStart=/usr/local/bin/git-notes "`+options.Config+`"`)
+	assert.Equal(t, []string{"--user daemon-reload", "--user enable git-notes.service", "--user restart git-notes.service"}, systemctl.calls)
+
+	out.Reset()
+	assert.NoError(t, ServiceStatus(options, systemctl, &out))
+	assert.Equal(t, "Unit: "+unitPath+"\nactive (running)\n", out.String())
+
+	systemctl.calls = nil
+	assert.NoError(t, UninstallService(options, systemctl, false, &out))
+	_, err = os.Stat(unitPath)
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, []string{"--user disable --now git-notes.service", "--user daemon-reload"}, systemctl.calls)
+
+	out.Reset()
+	assert.NoError(t, ServiceStatus(options, systemctl, &out))
+	assert.Equal(t, unitPath+" is not installed\n", out.String())
+	assert.Error(t, UninstallService(options, systemctl, false, &out))
+}
+
+func TestInstallService_DryRun(t *testing.T) {
+	options, cleanup := serviceOptions(t)
+	defer cleanup()
+	options.System = true
+	options.User = "me"
+	systemctl := &MockSystemctl{}
+
+	var out bytes.Buffer
+	assert.NoError(t, InstallService(options, systemctl, true, &out))
+
+	assert.Empty(t, systemctl.calls)
+	_, err := os.Stat(options.UnitDir)
+	assert.True(t, os.IsNotExist(err))
+	assert.True(t, strings.HasPrefix(out.String(), "# "+filepath.Join(options.UnitDir, "git-notes.service")+"\n[Unit]\n"))
+	assert.Contains(t, out.String(), "\nUser=me\n")
+	assert.True(t, strings.HasSuffix(out.String(), "systemctl daemon-reload\nsystemctl enable git-notes.service\nsystemctl restart git-notes.service\n"))
+}
+
+func TestInstallService_MissingConfig(t *testing.T) {
+	options, cleanup := serviceOptions(t)
+	defer cleanup()
+	options.Config = filepath.Join(options.UnitDir, "missing.yaml")
+	systemctl := &MockSystemctl{}
+
+	err := InstallService(options, systemctl, false, &bytes.Buffer{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unable to read the config file")
+	}
+	assert.Empty(t, systemctl.calls)
+}
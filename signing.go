@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// signingSetting lists the settings that SetupSigning made, so TeardownSigning removes them and leaves the ones of the
+// user alone.
+const signingSetting = "git-notes.signing"
+
+// SetupSigning makes git sign every commit of the repo, including the ones of `git-notes restore`. The format and
+// the key are only set when they're configured, so the ones of the repo are used otherwise.
+func SetupSigning(ctx context.Context, path string, signing SigningConfig) error {
+	settings := [][]string{
+		{"commit.gpgsign", "true"},
+		{"gpg.format", signing.Format},
+		{"user.signingkey", signing.Key},
+	}
+	var set []string
+	for _, setting := range settings {
+		if setting[1] == "" {
+			continue
+		}
+		out, err := runCmd(ctx, path, "git", "config", setting[0], setting[1])
+		if err != nil {
+			return fmt.Errorf("unable to set %s. Err: %v, %s", setting[0], err, out)
+		}
+		set = append(set, setting[0])
+	}
+	out, err := runCmd(ctx, path, "git", "config", signingSetting, strings.Join(set, " "))
+	if err != nil {
+		return fmt.Errorf("unable to set %s. Err: %v, %s", signingSetting, err, out)
+	}
+	return nil
+}
+
+// TeardownSigning removes the settings of SetupSigning once signing is disabled, so the commits made by hand aren't
+// signed anymore.
+func TeardownSigning(ctx context.Context, path string) error {
+	out, err := runCmdStdout(ctx, path, "git", "config", "--get", signingSetting)
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		// Signing was never set up.
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read %s. Err: %v", signingSetting, err)
+	}
+
+	for _, setting := range append(strings.Fields(out), signingSetting) {
+		out, err := runCmd(ctx, path, "git", "config", "--unset", setting)
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 5 {
+			// The user removed it already.
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unable to unset %s. Err: %v, %s", setting, err, out)
+		}
+	}
+	return nil
+}
+
+// signingFailed returns whether the output of `git commit` shows that the commit couldn't be signed, as opposed to
+// e.g. a failing pre-commit hook.
+func signingFailed(out string) bool {
+	return strings.Contains(out, "failed to sign the data") || strings.Contains(out, "failed to write commit object")
+}
+
+// UnsignedCommits lists the commits that aren't on the remote yet and have no signature.
+func UnsignedCommits(ctx context.Context, path string) ([]string, error) {
+	out, err := runCmdStdout(ctx, path, "git", "rev-list", "HEAD", "--not", "--remotes=origin")
+	if err != nil {
+		return nil, fmt.Errorf("unable to list the commits to push. Err: %v", err)
+	}
+
+	var unsigned []string
+	for _, sha := range strings.Fields(out) {
+		commit, err := runCmdStdout(ctx, path, "git", "cat-file", "commit", sha)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the commit %s. Err: %v", sha, err)
+		}
+
+		// The headers end at the first empty line.
+		headers := strings.SplitN(commit, "\n\n", 2)[0]
+		if !strings.Contains(headers, "\ngpgsig ") && !strings.Contains(headers, "\ngpgsig-sha256 ") {
+			unsigned = append(unsigned, sha)
+		}
+	}
+	return unsigned, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"git-notes/internal/test_helpers"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// sshSigningKey makes an SSH key without a passphrase, and returns the path of its public key.
+func sshSigningKey(t *testing.T) (string, func()) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "git-notes-signing")
+	assert.NoError(t, err)
+	test_helpers.PerformCmd(t, dir, "ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", filepath.Join(dir, "id_ed25519"))
+	return filepath.Join(dir, "id_ed25519.pub"), func() { _ = os.RemoveAll(dir) }
+}
+
+func TestSigning_Ssh(t *testing.T) {
+	repos := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(repos)
+	key, cleanupKey := sshSigningKey(t)
+	defer cleanupKey()
+	git := gitWithSettings(RepoConfig{Signing: SigningConfig{Enabled: true, Format: "ssh", Key: key}}, repos.Local)
+
+	test_helpers.WriteFile(t, repos.Local, "test.md", "TestContent")
+	assert.NoError(t, git.Sync(repos.Local))
+
+	branch := test_helpers.GetLocalBranch(repos.Local)
+	commit, err := runCmdStdout(context.Background(), repos.Remote, "git", "cat-file", "commit", branch)
+	assert.NoError(t, err)
+	assert.Contains(t, commit, "\ngpgsig -----BEGIN SSH SIGNATURE-----")
+}
+
+func TestSigning_Unavailable(t *testing.T) {
+	repos := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(repos)
+	git := gitWithSettings(RepoConfig{Signing: SigningConfig{Enabled: true, Format: "ssh", Key: filepath.Join(repos.Local, "missing.pub")}}, repos.Local)
+
+	test_helpers.WriteFile(t, repos.Local, "test.md", "TestContent")
+	err := git.Sync(repos.Local)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unable to sign the commit")
+	}
+	assert.Empty(t, remoteFiles(t, repos))
+}
+
+func TestSigning_UnsignedCommit(t *testing.T) {
+	repos := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(repos)
+	key, cleanupKey := sshSigningKey(t)
+	defer cleanupKey()
+	git := gitWithSettings(RepoConfig{Signing: SigningConfig{Enabled: true, Format: "ssh", Key: key}}, repos.Local)
+
+	test_helpers.WriteFile(t, repos.Local, "test.md", "TestContent")
+	test_helpers.PerformCmd(t, repos.Local, "git", "add", "--all")
+	test_helpers.PerformCmd(t, repos.Local, "git", "-c", "commit.gpgsign=false", "commit", "-m", "Unsigned")
+
+	assert.NoError(t, git.Sync(repos.Local))
+
+	state, err := git.GetState(repos.Local)
+	assert.NoError(t, err)
+	assert.Equal(t, Unsigned, state)
+	assert.Empty(t, remoteFiles(t, repos))
+
+	// Signing the commit lets it through.
+	test_helpers.PerformCmd(t, repos.Local, "git", "commit", "--amend", "--no-edit", "-S")
+	unsigned, err := UnsignedCommits(context.Background(), repos.Local)
+	assert.NoError(t, err)
+	assert.Empty(t, unsigned)
+
+	assert.NoError(t, git.Sync(repos.Local))
+	assert.Equal(t, []string{"test.md"}, remoteFiles(t, repos))
+	out, err := runCmdStdout(context.Background(), repos.Local, "git", "config", "commit.gpgsign")
+	assert.NoError(t, err)
+	assert.Equal(t, "true", strings.TrimSpace(out))
+}
+
+func TestSigning_Disabled(t *testing.T) {
+	repos := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(repos)
+	key, cleanupKey := sshSigningKey(t)
+	defer cleanupKey()
+	test_helpers.PerformCmd(t, repos.Local, "git", "config", "user.signingkey", key)
+
+	git := gitWithSettings(RepoConfig{Signing: SigningConfig{Enabled: true, Format: "ssh"}}, repos.Local)
+	test_helpers.WriteFile(t, repos.Local, "test.md", "TestContent")
+	assert.NoError(t, git.Sync(repos.Local))
+
+	git = gitWithSettings(RepoConfig{Signing: SigningConfig{}}, repos.Local)
+	test_helpers.WriteFile(t, repos.Local, "test.md", "OtherContent")
+	assert.NoError(t, git.Sync(repos.Local))
+
+	// The settings of git-notes are gone, the ones of the user are kept.
+	for _, setting := range []string{"commit.gpgsign", "gpg.format", signingSetting} {
+		_, err := runCmdStdout(context.Background(), repos.Local, "git", "config", setting)
+		assert.Error(t, err, setting)
+	}
+	out, err := runCmdStdout(context.Background(), repos.Local, "git", "config", "user.signingkey")
+	assert.NoError(t, err)
+	assert.Equal(t, key, strings.TrimSpace(out))
+
+	unsigned, err := UnsignedCommits(context.Background(), repos.Local)
+	assert.NoError(t, err)
+	assert.Empty(t, unsigned)
+	commit, err := runCmdStdout(context.Background(), repos.Local, "git", "cat-file", "commit", "HEAD")
+	assert.NoError(t, err)
+	assert.NotContains(t, commit, "\ngpgsig ")
+}
+
+func TestSigning_OtherCommitFailure(t *testing.T) {
+	repos := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(repos)
+	git := gitWithSettings(RepoConfig{Signing: SigningConfig{Enabled: true, Format: "ssh", Key: filepath.Join(repos.Local, "missing.pub")}}, repos.Local)
+	hook := filepath.Join(repos.Local, ".git", "hooks", "pre-commit")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(hook), 0755))
+	assert.NoError(t, ioutil.WriteFile(hook, []byte("#!/bin/sh\necho 'rejected by the hook'\nexit 1\n"), 0755))
+
+	test_helpers.WriteFile(t, repos.Local, "test.md", "TestContent")
+	err := git.Sync(repos.Local)
+	if assert.Error(t, err) {
+		assert.NotContains(t, err.Error(), "unable to sign the commit")
+		assert.Contains(t, err.Error(), "rejected by the hook")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// Submodules returns the paths of the checked out submodules of the repo, relative to it.
+func Submodules(ctx context.Context, path string) ([]string, error) {
+	out, err := runCmdStdout(ctx, path, "git", "submodule", "foreach", "--quiet", `printf '%s\0' "$sm_path"`)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list the submodules of %s. Err: %v", path, err)
+	}
+	return splitNul(out), nil
+}
+
+// syncSubmodules syncs the submodules, the nested ones first, so their commits are pushed before the repo points
+// at them. The submodules have the settings of the repo, see Config.RepoSettings. Only an active repo syncs its
+// submodules while its schedule allows the pushes, since they'd be pushed in their own sync.
+func (g *GitCmd) syncSubmodules(ctx context.Context, path string) error {
+	mode, err := g.mode(ctx, path)
+	if err != nil {
+		return err
+	}
+	if mode != ModeActive {
+		log.Printf("Not syncing the submodules of %s in the %s mode", path, mode)
+		return nil
+	}
+	remote, push, err := g.allowedNow(ctx, path)
+	if err != nil {
+		return err
+	}
+	if !remote || !push {
+		log.Printf("Not syncing the submodules of %s, since the schedule doesn't allow the pushes now", path)
+		return nil
+	}
+
+	submodules, err := Submodules(ctx, path)
+	if err != nil {
+		return err
+	}
+	for _, submodule := range submodules {
+		inner := filepath.Join(path, filepath.FromSlash(submodule))
+		err = g.locks.LockRepo(inner)
+		if err != nil {
+			return err
+		}
+		err = attachSubmodule(ctx, inner)
+		if err != nil {
+			return err
+		}
+
+		// The sync of the submodule syncs its own submodules first.
+		log.Printf("Syncing the submodule %s of %s", submodule, path)
+		state, err := g.sync(ctx, inner)
+		if err != nil {
+			return fmt.Errorf("syncing the submodule %s failed. Err: %w", submodule, err)
+		}
+		if state != Sync {
+			// The repo would point at commits that aren't pushed, which the push refuses.
+			return fmt.Errorf("the submodule %s is %s. %s is synced once the submodule is in sync", submodule, state,
+				path)
+		}
+	}
+	return nil
+}
+
+// initSubmodules checks out the submodules that aren't yet, e.g. the ones that another machine added.
+func initSubmodules(ctx context.Context, path string, credentials CredentialsConfig) error {
+	out, err := runCmdStdout(ctx, path, "git", "submodule", "status")
+	if err != nil {
+		return fmt.Errorf("unable to list the submodules of %s. Err: %v", path, err)
+	}
+	var missing []string
+	for _, line := range strings.Split(out, "\n") {
+		// The lines are `-<sha> <path>` for the submodules that aren't checked out.
+		if parts := strings.SplitN(line, " ", 2); len(parts) == 2 && strings.HasPrefix(line, "-") {
+			missing = append(missing, parts[1])
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	log.Printf("Checking out the submodules %s of %s", strings.Join(missing, ", "), path)
+	args := append([]string{"submodule", "update", "--init", "--recursive", "--"}, missing...)
+	out, err = runRemoteCmd(ctx, path, credentials, args...)
+	if err != nil {
+		return fmt.Errorf("unable to check out the submodules of %s. Err: %w, %s", path, err, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// attachSubmodule checks out the branch of a submodule, since `git submodule update` leaves the submodules
+// detached. Only a branch at the checked out commit is checked out, so none of the files change.
+func attachSubmodule(ctx context.Context, path string) error {
+	if _, err := GetBranch(ctx, path); err == nil {
+		return nil
+	}
+
+	out, err := runCmdStdout(ctx, path, "git", "for-each-ref", "--format=%(refname:short)", "--points-at", "HEAD", "refs/heads/")
+	if err != nil {
+		return fmt.Errorf("unable to list the branches of %s. Err: %v", path, err)
+	}
+	branches := strings.Fields(out)
+	if len(branches) != 1 {
+		return fmt.Errorf("the submodule %s isn't on a branch. Check out the branch that git-notes should sync in it", path)
+	}
+
+	out, err = runCmd(ctx, path, "git", "checkout", "-q", branches[0])
+	if err != nil {
+		return fmt.Errorf("unable to check out %s in %s. Err: %v, %s", branches[0], path, err, strings.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"git-notes/internal/test_helpers"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setupSubmodule adds the team notes as a submodule of the personal notes on the first machine, and checks it out on
+// the others, detached like `git submodule update` leaves it.
+func setupSubmodule(t *testing.T) (personal test_helpers.Machines, team test_helpers.Machines) {
+	personal = test_helpers.SetupMachines(2, 1)
+	team = test_helpers.SetupMachines(0, 1)
+
+	first := personal.Clones[0]
+	test_helpers.PerformCmd(t, first, "git", "-c", "protocol.file.allow=always", "submodule", "add", "-q", team.Remote, "team")
+	test_helpers.PerformCmd(t, first, "git", "commit", "-q", "-m", "Add the team notes")
+	test_helpers.PerformCmd(t, first, "git", "push", "-q")
+
+	for _, clone := range personal.Clones[1:] {
+		test_helpers.PerformCmd(t, clone, "git", "pull", "-q")
+		test_helpers.PerformCmd(t, clone, "git", "-c", "protocol.file.allow=always", "submodule", "update", "-q", "--init")
+	}
+	// The first one is detached too.
+	test_helpers.PerformCmd(t, filepath.Join(first, "team"), "git", "checkout", "-q", "--detach")
+	return personal, team
+}
+
+// remotePointer returns the commit of the submodule in the remote branch.
+func remotePointer(t *testing.T, remote string, branch string) string {
+	fields := strings.Fields(gitOutput(t, remote, "ls-tree", branch, "team"))
+	if !assert.Len(t, fields, 4) {
+		return ""
+	}
+	return fields[2]
+}
+
+func TestSubmodules_SyncInnerFirst(t *testing.T) {
+	personal, team := setupSubmodule(t)
+	defer test_helpers.CleanupMachines(personal)
+	defer test_helpers.CleanupMachines(team)
+	desktop, laptop := personal.Clones[0], personal.Clones[1]
+	branch := test_helpers.GetLocalBranch(desktop)
+	git := gitWithSettings(RepoConfig{Submodules: true}, desktop, laptop)
+
+	test_helpers.WriteFile(t, filepath.Join(desktop, "team"), "standup.md", "Ship it")
+	test_helpers.WriteFile(t, desktop, "diary.md", "Dear diary")
+	assert.NoError(t, git.Sync(desktop))
+
+	// The submodule is back on its branch, and its commit is pushed before the pointer.
+	inner := filepath.Join(desktop, "team")
+	assert.Equal(t, branch, test_helpers.GetLocalBranch(inner))
+	assert.Contains(t, remoteFiles(t, test_helpers.Repos{Local: inner, Remote: team.Remote}), "standup.md")
+	assert.Equal(t, head(context.Background(), inner), remotePointer(t, personal.Remote, branch))
+	assert.Contains(t, remoteFiles(t, test_helpers.Repos{Local: desktop, Remote: personal.Remote}), "diary.md")
+	assert.Equal(t, "", gitOutput(t, desktop, "status", "--porcelain"))
+
+	// The other machine catches up in the submodule, without moving the pointer back.
+	pointer := remotePointer(t, personal.Remote, branch)
+	assert.NoError(t, git.Sync(laptop))
+	assert.Equal(t, pointer, head(context.Background(), filepath.Join(laptop, "team")))
+	assert.Equal(t, pointer, remotePointer(t, personal.Remote, branch))
+	assert.Equal(t, "Ship it", readNote(t, filepath.Join(laptop, "team"), "standup.md"))
+	assert.Equal(t, "", gitOutput(t, laptop, "status", "--porcelain"))
+	assertState(t, laptop, Sync)
+}
+
+func TestSubmodules_PushChecksTheSubmodules(t *testing.T) {
+	personal, team := setupSubmodule(t)
+	defer test_helpers.CleanupMachines(personal)
+	defer test_helpers.CleanupMachines(team)
+	desktop := personal.Clones[0]
+	inner := filepath.Join(desktop, "team")
+
+	// The commit of the submodule isn't pushed.
+	test_helpers.WriteFile(t, inner, "standup.md", "Ship it")
+	test_helpers.PerformCmd(t, inner, "git", "add", "standup.md")
+	test_helpers.PerformCmd(t, inner, "git", "commit", "-q", "-m", "By hand")
+	test_helpers.PerformCmd(t, desktop, "git", "commit", "-q", "-am", "Point at it")
+
+	assert.Error(t, Push(context.Background(), desktop, CredentialsConfig{}, true))
+	assert.NoError(t, Push(context.Background(), desktop, CredentialsConfig{}, false))
+}
+
+func TestSubmodules_Detached(t *testing.T) {
+	personal, team := setupSubmodule(t)
+	defer test_helpers.CleanupMachines(personal)
+	defer test_helpers.CleanupMachines(team)
+	inner := filepath.Join(personal.Clones[0], "team")
+
+	submodules, err := Submodules(context.Background(), personal.Clones[0])
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"team"}, submodules)
+
+	// No branch is at the checked out commit.
+	test_helpers.WriteFile(t, inner, "standup.md", "Ship it")
+	test_helpers.PerformCmd(t, inner, "git", "add", "standup.md")
+	test_helpers.PerformCmd(t, inner, "git", "commit", "-q", "-m", "Detached")
+	assert.EqualError(t, attachSubmodule(context.Background(), inner), "the submodule "+inner+" isn't on a branch. Check out the branch "+
+		"that git-notes should sync in it")
+}
+
+func TestSubmodules_NotInSync(t *testing.T) {
+	personal, team := setupSubmodule(t)
+	defer test_helpers.CleanupMachines(personal)
+	defer test_helpers.CleanupMachines(team)
+	desktop := personal.Clones[0]
+	inner := filepath.Join(desktop, "team")
+	branch := test_helpers.GetLocalBranch(desktop)
+	pointer := remotePointer(t, personal.Remote, branch)
+	git := gitWithSettings(RepoConfig{Submodules: true}, desktop)
+
+	// The submodule only commits, so its commit isn't pushed.
+	assert.NoError(t, SetModeOverride(context.Background(), inner, ModeCommitOnly))
+	test_helpers.WriteFile(t, inner, "standup.md", "Ship it")
+	err := git.Sync(desktop)
+	assert.EqualError(t, err, "the submodule team is restricted. "+desktop+" is synced once the submodule is in sync")
+	assert.Equal(t, pointer, remotePointer(t, personal.Remote, branch))
+}
+
+func TestSubmodules_Secret(t *testing.T) {
+	personal, team := setupSubmodule(t)
+	defer test_helpers.CleanupMachines(personal)
+	defer test_helpers.CleanupMachines(team)
+	desktop := personal.Clones[0]
+	inner := filepath.Join(desktop, "team")
+	git := gitWithSettings(RepoConfig{Submodules: true, Hooks: HooksConfig{Secrets: true}}, desktop)
+
+	// The submodule is scanned like the repo.
+	test_helpers.WriteFile(t, inner, "standup.md", "Ship it")
+	test_helpers.WriteFile(t, inner, "aws.md", "key: "+awsKey)
+	assert.NoError(t, git.Sync(desktop))
+
+	files := remoteFiles(t, test_helpers.Repos{Local: inner, Remote: team.Remote})
+	assert.Contains(t, files, "standup.md")
+	assert.NotContains(t, files, "aws.md")
+}
+
+func TestSubmodules_QuietHours(t *testing.T) {
+	personal, team := setupSubmodule(t)
+	defer test_helpers.CleanupMachines(personal)
+	defer test_helpers.CleanupMachines(team)
+	desktop := personal.Clones[0]
+	inner := filepath.Join(desktop, "team")
+	branch := test_helpers.GetLocalBranch(desktop)
+	pointer := remotePointer(t, personal.Remote, branch)
+	clock := test_helpers.NewFakeClock(at(7, "12:30"))
+	git := gitWithSettings(RepoConfig{Submodules: true, Schedule: ScheduleConfig{QuietHours: []string{"12:00-13:00"}}},
+		desktop)
+	git.clock = clock
+
+	// The submodule waits for the quiet hours to end, like the repo.
+	test_helpers.WriteFile(t, inner, "standup.md", "Ship it")
+	assert.NoError(t, git.Sync(desktop))
+	assert.Equal(t, "?? standup.md\n", gitOutput(t, inner, "status", "--porcelain"))
+	assert.Equal(t, pointer, remotePointer(t, personal.Remote, branch))
+
+	clock.Advance(30 * time.Minute)
+	assert.NoError(t, git.Sync(desktop))
+	assert.Contains(t, remoteFiles(t, test_helpers.Repos{Local: inner, Remote: team.Remote}), "standup.md")
+	assert.Equal(t, head(context.Background(), inner), remotePointer(t, personal.Remote, branch))
+}
+
+func TestSubmodules_AddedOnAnotherMachine(t *testing.T) {
+	personal := test_helpers.SetupMachines(2, 1)
+	defer test_helpers.CleanupMachines(personal)
+	team := test_helpers.SetupMachines(0, 1)
+	defer test_helpers.CleanupMachines(team)
+	desktop, laptop := personal.Clones[0], personal.Clones[1]
+	git := gitWithSettings(RepoConfig{Submodules: true}, desktop, laptop)
+	// The submodules are cloned from the local remotes.
+	for key, value := range map[string]string{"GIT_CONFIG_COUNT": "1", "GIT_CONFIG_KEY_0": "protocol.file.allow",
+		"GIT_CONFIG_VALUE_0": "always"} {
+		assert.NoError(t, os.Setenv(key, value))
+		defer os.Unsetenv(key)
+	}
+
+	test_helpers.PerformCmd(t, desktop, "git", "submodule", "add", "-q", team.Remote, "team")
+	assert.NoError(t, git.Sync(desktop))
+
+	assert.NoError(t, git.Sync(laptop))
+	inner := filepath.Join(laptop, "team")
+	assert.Equal(t, "# Shared note 0\n", readNote(t, inner, team.Shared[0]))
+	assert.Equal(t, test_helpers.GetLocalBranch(filepath.Join(desktop, "team")), test_helpers.GetLocalBranch(inner))
+	assert.Equal(t, "", gitOutput(t, laptop, "status", "--porcelain"))
+	assertState(t, laptop, Sync)
+
+	// The submodule is locked with the repo.
+	other := NewLocks()
+	defer other.Release()
+	assert.NoError(t, other.LockRepo(inner))
+	test_helpers.WriteFile(t, inner, "standup.md", "Ship it")
+	git.locks = NewLocks()
+	assert.IsType(t, &LockedError{}, git.Sync(laptop))
+}
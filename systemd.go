@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends the state to systemd, e.g. `READY=1`. It does nothing when git-notes isn't run by a unit with
+// `Type=notify`.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		// An abstract socket.
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns the `WatchdogSec=` of the unit, or 0 when the watchdog is off.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// startWatchdog updates the status every half of the watchdog interval, and pings the watchdog only while every
+// sync loop makes progress. systemd restarts git-notes once the pings stop.
+func startWatchdog(health *Health, clock Clock) {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+
+	var ping func()
+	ping = func() {
+		healthy, _ := health.Report()
+		state := "STATUS=" + health.Status()
+		if healthy {
+			state = "WATCHDOG=1\n" + state
+		} else {
+			log.Printf("Not pinging the watchdog. %s", health.Status())
+		}
+
+		err := sdNotify(state)
+		if err != nil {
+			log.Printf("Unable to notify systemd. Err: %v", err)
+		}
+		orRealClock(clock).AfterFunc(interval/2, ping)
+	}
+	ping()
+}
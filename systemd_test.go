@@ -0,0 +1,84 @@
+package main
+
+import (
+	"git-notes/internal/test_helpers"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// notifySocket listens like systemd does, and points NOTIFY_SOCKET to it.
+func notifySocket(t *testing.T) (*net.UnixConn, func()) {
+	dir, err := ioutil.TempDir("", "git-notes-notify")
+	assert.NoError(t, err)
+	socket := filepath.Join(dir, "notify")
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	assert.NoError(t, err)
+	assert.NoError(t, os.Setenv("NOTIFY_SOCKET", socket))
+
+	return conn, func() {
+		_ = os.Unsetenv("NOTIFY_SOCKET")
+		_ = conn.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func readNotification(t *testing.T, conn *net.UnixConn) string {
+	buffer := make([]byte, 4096)
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, err := conn.Read(buffer)
+	assert.NoError(t, err)
+	return string(buffer[:n])
+}
+
+func TestSdNotify(t *testing.T) {
+	assert.NoError(t, sdNotify("READY=1"))
+
+	conn, cleanup := notifySocket(t)
+	defer cleanup()
+
+	assert.NoError(t, sdNotify("READY=1"))
+	assert.Equal(t, "READY=1", readNotification(t, conn))
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	assert.Equal(t, time.Duration(0), watchdogInterval())
+
+	assert.NoError(t, os.Setenv("WATCHDOG_USEC", "600000000"))
+	assert.Equal(t, 10*time.Minute, watchdogInterval())
+
+	assert.NoError(t, os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1)))
+	assert.Equal(t, time.Duration(0), watchdogInterval())
+}
+
+func TestStartWatchdog(t *testing.T) {
+	conn, cleanup := notifySocket(t)
+	defer cleanup()
+	assert.NoError(t, os.Setenv("WATCHDOG_USEC", "600000000"))
+	defer os.Unsetenv("WATCHDOG_USEC")
+
+	clock := test_helpers.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	health := NewHealth(clock)
+	health.Watch("/notes")
+
+	startWatchdog(health, clock)
+	assert.Equal(t, "WATCHDOG=1\nSTATUS=1 repos: 1 synced, 0 failing, 0 stalled", readNotification(t, conn))
+
+	// The pings stop once the sync loop is stuck past the threshold.
+	clock.Advance(15 * time.Minute)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "WATCHDOG=1\nSTATUS=1 repos: 1 synced, 0 failing, 0 stalled", readNotification(t, conn))
+	}
+	clock.Advance(5 * time.Minute)
+	assert.Equal(t, "STATUS=1 repos: 0 synced, 0 failing, 1 stalled (/notes)", readNotification(t, conn))
+}
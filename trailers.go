@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Version is set when building a release with `go build -ldflags "-X main.Version=1.2.3"`.
+var Version = "dev"
+
+// Every commit of git-notes ends with these trailers, so the commits of different machines can be told apart.
+const (
+	hostTrailer      = "Git-Notes-Host"
+	versionTrailer   = "Git-Notes-Version"
+	filesTrailer     = "Git-Notes-Files"
+	moreFilesTrailer = "Git-Notes-More-Files"
+)
+
+// There's one files trailer for each of at most this many files. The more files trailer counts the others.
+const maxTrailerFiles = 20
+
+// CommitInfo is what the trailers of a commit tell. Commits made outside git-notes have none of them.
+type CommitInfo struct {
+	Sha     string
+	Host    string
+	Version string
+	Files   []string
+	// More is the number of files that didn't fit in the files trailer.
+	More int
+}
+
+func (c CommitInfo) String() string {
+	if c.Host == "" {
+		return fmt.Sprintf("%s (not made by git-notes)", shortSha(c.Sha))
+	}
+
+	files := strings.Join(c.Files, ", ")
+	if c.More > 0 {
+		files = fmt.Sprintf("%s and %d more", files, c.More)
+	}
+	return fmt.Sprintf("%s by %s (git-notes %s): %s", shortSha(c.Sha), c.Host, c.Version, files)
+}
+
+func shortSha(sha string) string {
+	if len(sha) > 8 {
+		return sha[:8]
+	}
+	return sha
+}
+
+func commitTrailers(files []string) string {
+	listed := files
+	if len(listed) > maxTrailerFiles {
+		listed = listed[:maxTrailerFiles]
+	}
+
+	trailers := []string{fmt.Sprintf("%s: %s", hostTrailer, hostname()), fmt.Sprintf("%s: %s", versionTrailer, Version)}
+	for _, file := range listed {
+		trailers = append(trailers, fmt.Sprintf("%s: %s", filesTrailer, quoteTrailerFile(file)))
+	}
+	if len(files) > len(listed) {
+		trailers = append(trailers, fmt.Sprintf("%s: %d", moreFilesTrailer, len(files)-len(listed)))
+	}
+	return strings.Join(trailers, "\n")
+}
+
+// quoteTrailerFile quotes the names that a trailer wouldn't keep as they are, like the ones with a line break or
+// with spaces around them, and the ones that could be read as the list of the older versions.
+func quoteTrailerFile(file string) string {
+	quote := file == "" || strings.HasPrefix(file, `"`) || strings.TrimSpace(file) != file ||
+		strings.Contains(file, ", ") || strings.Contains(file, " (+")
+	for _, r := range file {
+		quote = quote || !unicode.IsPrint(r)
+	}
+	if quote {
+		return strconv.Quote(file)
+	}
+	return file
+}
+
+// ReadCommitInfo reads the trailers of the commit.
+func ReadCommitInfo(ctx context.Context, path string, rev string) (CommitInfo, error) {
+	format := "--format=%H"
+	for _, key := range []string{hostTrailer, versionTrailer, filesTrailer, moreFilesTrailer} {
+		format += fmt.Sprintf("%%x1f%%(trailers:key=%s,valueonly,separator=%%x00)", key)
+	}
+
+	out, err := runCmdStdout(ctx, path, "git", "-c", "core.quotePath=false", "log", "-1", format, rev, "--")
+	if err != nil {
+		return CommitInfo{}, fmt.Errorf("unable to read the commit %s. Err: %v", rev, err)
+	}
+
+	fields := strings.Split(strings.TrimSuffix(out, "\n"), "\x1f")
+	if len(fields) != 5 {
+		return CommitInfo{}, fmt.Errorf("unable to parse the commit %s: %s", rev, out)
+	}
+
+	info := CommitInfo{Sha: fields[0], Host: fields[1], Version: fields[2]}
+	if fields[4] != "" {
+		_, _ = fmt.Sscanf(fields[4], "%d", &info.More)
+	}
+	if fields[3] == "" {
+		return info, nil
+	}
+	for _, file := range strings.Split(fields[3], "\x00") {
+		if unquoted, err := strconv.Unquote(file); err == nil {
+			info.Files = append(info.Files, unquoted)
+		} else if strings.Contains(file, ", ") || strings.Contains(file, " (+") {
+			legacyFiles(&info, file)
+		} else {
+			info.Files = append(info.Files, file)
+		}
+	}
+	return info, nil
+}
+
+// legacyFiles reads the files trailer of the older versions, which listed every file in one trailer, e.g.
+// `a.md, b.md (+3 more)`.
+func legacyFiles(info *CommitInfo, files string) {
+	if i := strings.LastIndex(files, " (+"); i >= 0 && strings.HasSuffix(files, " more)") {
+		_, _ = fmt.Sscanf(files[i:], " (+%d more)", &info.More)
+		files = files[:i]
+	}
+	if files != "" {
+		info.Files = append(info.Files, strings.Split(files, ", ")...)
+	}
+}
+
+// lastChangedBy returns the host of the newest commit in the range that changed the file.
+func lastChangedBy(ctx context.Context, path string, file string, revs ...string) string {
+	args := append(append([]string{"log", "-1", "--format=%H"}, revs...), "--", file)
+	out, err := runCmdStdout(ctx, path, "git", args...)
+	if err != nil || strings.TrimSpace(out) == "" {
+		return "an unknown machine"
+	}
+
+	info, err := ReadCommitInfo(ctx, path, strings.TrimSpace(out))
+	if err != nil || info.Host == "" {
+		return "an unknown machine"
+	}
+	return info.Host
+}
+
+// ConflictReport tells which machines made the conflicting changes, e.g. `notes.md: laptop and desktop`.
+func ConflictReport(ctx context.Context, path string, merged string, conflicts []string) string {
+	var reports []string
+	for _, file := range conflicts {
+		local := lastChangedBy(ctx, path, file, "HEAD", "^"+merged)
+		remote := lastChangedBy(ctx, path, file, merged, "^HEAD")
+		reports = append(reports, fmt.Sprintf("%s: %s and %s", file, local, remote))
+	}
+	return strings.Join(reports, "; ")
+}
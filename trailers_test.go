@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"git-notes/internal/test_helpers"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommitInfo(t *testing.T) {
+	path := test_helpers.SetupGitRepo("trailers", false)
+	defer test_helpers.CleanupRepo(path)
+
+	test_helpers.WriteFile(t, path, "a.md", "A")
+	test_helpers.WriteFile(t, path, "b.md", "B")
+	assert.NoError(t, Add(context.Background(), path))
+	assert.NoError(t, Commit(context.Background(), path, time.Now()))
+
+	info, err := ReadCommitInfo(context.Background(), path, "HEAD")
+	assert.NoError(t, err)
+	assert.Equal(t, hostname(), info.Host)
+	assert.Equal(t, Version, info.Version)
+	assert.Equal(t, []string{"a.md", "b.md"}, info.Files)
+	assert.Equal(t, 0, info.More)
+
+	for i := 0; i < maxTrailerFiles+3; i++ {
+		test_helpers.WriteFile(t, path, fmt.Sprintf("note-%02d.md", i), "Note")
+	}
+	assert.NoError(t, Add(context.Background(), path))
+	assert.NoError(t, Commit(context.Background(), path, time.Now()))
+
+	info, err = ReadCommitInfo(context.Background(), path, "HEAD")
+	assert.NoError(t, err)
+	assert.Len(t, info.Files, maxTrailerFiles)
+	assert.Equal(t, "note-00.md", info.Files[0])
+	assert.Equal(t, 3, info.More)
+
+	// Each name has its own trailer, so the names with commas or line breaks are kept.
+	odd := []string{"a, b.md", " spaced.md", "line\nbreak.md", `"quoted".md`, "notes (+1 more).md", "été.md"}
+	for _, file := range odd {
+		test_helpers.WriteFile(t, path, file, "Odd")
+	}
+	assert.NoError(t, Add(context.Background(), path))
+	assert.NoError(t, Commit(context.Background(), path, time.Now()))
+
+	info, err = ReadCommitInfo(context.Background(), path, "HEAD")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, odd, info.Files)
+	assert.Equal(t, 0, info.More)
+	assert.Contains(t, gitOutput(t, path, "log", "-1", "--format=%B"), filesTrailer+": été.md\n")
+
+	// The older versions listed the files in one trailer.
+	test_helpers.WriteFile(t, path, "a.md", "A1")
+	message := fmt.Sprintf("Old\n\n%s: laptop\n%s: 1.0.0\n%s: a.md, b.md (+2 more)", hostTrailer, versionTrailer, filesTrailer)
+	test_helpers.PerformCmd(t, path, "git", "commit", "-am", message)
+
+	info, err = ReadCommitInfo(context.Background(), path, "HEAD")
+	assert.NoError(t, err)
+	assert.Equal(t, "laptop", info.Host)
+	assert.Equal(t, []string{"a.md", "b.md"}, info.Files)
+	assert.Equal(t, 2, info.More)
+
+	// A commit made by hand has no trailers.
+	test_helpers.WriteFile(t, path, "a.md", "A2")
+	test_helpers.PerformCmd(t, path, "git", "commit", "-am", "By hand")
+
+	info, err = ReadCommitInfo(context.Background(), path, "HEAD")
+	assert.NoError(t, err)
+	assert.Equal(t, "", info.Host)
+	assert.Empty(t, info.Files)
+}
+
+func TestConflictReport(t *testing.T) {
+	repos := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(repos)
+	git := GitCmd{}
+
+	test_helpers.WriteFile(t, repos.Local, "test.md", "TestContent")
+	assert.NoError(t, git.Sync(repos.Local))
+
+	makeConflict(t, repos.Remote)
+	test_helpers.WriteFile(t, repos.Local, "test.md", "TestContent2")
+	assert.NoError(t, git.Sync(repos.Local))
+
+	entries, err := ReadJournal(context.Background(), repos.Local, time.Time{}, time.Time{})
+	assert.NoError(t, err)
+	var reports []string
+	for _, entry := range entries {
+		if entry.Event == JournalConflict {
+			reports = append(reports, entry.Message)
+		}
+	}
+	assert.Equal(t, []string{fmt.Sprintf("test.md: %s and an unknown machine", hostname())}, reports)
+}
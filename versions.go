@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FileVersion is a commit that changed a file.
+type FileVersion struct {
+	Sha  string
+	Time time.Time
+	// Host is the machine that made the commit. Commits without the host trailer fall back to the author.
+	Host string
+	// Status is `A`, `M`, `D` or `R` like in `git log --name-status`. A merge that changed the file is `M`.
+	Status string
+	// Path is the path of the file in the commit, which differs from the current one before a rename.
+	Path string
+}
+
+func (v FileVersion) String() string {
+	status := map[string]string{"A": "added", "M": "modified", "D": "deleted", "R": "renamed"}[v.Status]
+	if status == "" {
+		status = v.Status
+	}
+	return fmt.Sprintf("%s %s %s %s %s", v.Time.Local().Format("2006-01-02 15:04:05"), v.Sha[:8], v.Host, status, v.Path)
+}
+
+// relativePath returns the path of the file relative to the repo. It can be given relative to the repo or absolute.
+func relativePath(path string, file string) (string, error) {
+	if !filepath.IsAbs(file) {
+		return filepath.ToSlash(filepath.Clean(file)), nil
+	}
+
+	relative, err := filepath.Rel(path, file)
+	if err != nil || strings.HasPrefix(relative, "..") {
+		return "", fmt.Errorf("%s is not in %s", file, path)
+	}
+	return filepath.ToSlash(relative), nil
+}
+
+// FileLog lists the versions of the file from the newest to the oldest, following renames.
+func FileLog(ctx context.Context, path string, file string) ([]FileVersion, error) {
+	file, err := relativePath(path, file)
+	if err != nil {
+		return nil, err
+	}
+
+	format := fmt.Sprintf("--format=%%x1e%%H%%x1f%%cI%%x1f%%an%%x1f%%(trailers:key=%s,valueonly,separator=%%x2C)", hostTrailer)
+	out, err := runCmdStdout(ctx, path, "git", "-c", "core.quotePath=false", "log", "--follow", "--name-status", format, "--", file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the log of %s. Err: %v", file, err)
+	}
+
+	var versions []FileVersion
+	current := file
+	for _, chunk := range strings.Split(out, "\x1e") {
+		lines := strings.Split(strings.TrimSpace(chunk), "\n")
+		fields := strings.Split(lines[0], "\x1f")
+		if len(fields) != 4 {
+			continue
+		}
+
+		at, err := time.Parse(time.RFC3339, fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse the time of %s. Err: %v", fields[0], err)
+		}
+		version := FileVersion{Sha: fields[0], Time: at, Host: strings.TrimSpace(fields[3]), Status: "M", Path: current}
+		if version.Host == "" {
+			version.Host = fields[2]
+		}
+
+		// Merges have no name status.
+		for _, line := range lines[1:] {
+			parts := strings.Split(line, "\t")
+			if len(parts) < 2 {
+				continue
+			}
+			version.Status = parts[0][:1]
+			version.Path = parts[len(parts)-1]
+			if version.Status == "R" || version.Status == "C" {
+				// Older versions are under the original path.
+				current = parts[1]
+			} else {
+				current = version.Path
+			}
+			break
+		}
+
+		versions = append(versions, version)
+	}
+	return versions, nil
+}
+
+// VersionAt returns the version of the file at the time from the versions that FileLog returns.
+func VersionAt(versions []FileVersion, at time.Time) (FileVersion, bool) {
+	for _, version := range versions {
+		if !version.Time.After(at) {
+			return version, true
+		}
+	}
+	return FileVersion{}, false
+}
+
+// RestoreFile writes the version of the file at the time into the working tree, and commits it after the hooks of the
+// repo checked it, like the other commits. It returns the restored version.
+func (g *GitCmd) RestoreFile(ctx context.Context, path string, file string, at time.Time) (FileVersion, error) {
+	file, err := relativePath(path, file)
+	if err != nil {
+		return FileVersion{}, err
+	}
+
+	versions, err := FileLog(ctx, path, file)
+	if err != nil {
+		return FileVersion{}, err
+	}
+	version, ok := VersionAt(versions, at)
+	if !ok || version.Status == "D" {
+		return FileVersion{}, fmt.Errorf("%s didn't exist at %s", file, at.Format(time.RFC3339))
+	}
+
+	// The filters decrypt the encrypted repos and fetch the LFS objects.
+	content, err := runCmdStdout(ctx, path, "git", "cat-file", "--filters", fmt.Sprintf("%s:%s", version.Sha, version.Path))
+	if err != nil {
+		return FileVersion{}, fmt.Errorf("unable to read %s at %s. Err: %v", version.Path, version.Sha, err)
+	}
+
+	target := filepath.Join(path, filepath.FromSlash(file))
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return FileVersion{}, err
+	}
+	err = ioutil.WriteFile(target, []byte(content), 0644)
+	if err != nil {
+		return FileVersion{}, err
+	}
+
+	out, err := runCmd(ctx, path, "git", "add", "--", file)
+	if err != nil {
+		return FileVersion{}, fmt.Errorf("unable to add %s. Err: %v, %s", file, err, out)
+	}
+	_, err = runCmd(ctx, path, "git", "diff", "--cached", "--quiet", "--", file)
+	if err == nil {
+		// The file is already at that version.
+		return version, nil
+	}
+	message := fmt.Sprintf("Restored %s as of %s", file, version.Time.Format(time.RFC3339))
+	committed, err := g.commitChecked(ctx, path, message, file)
+	if err != nil {
+		return version, err
+	}
+	if !committed {
+		return version, fmt.Errorf("the restored version of %s is in the working tree, but the hooks blocked its commit", file)
+	}
+	return version, nil
+}
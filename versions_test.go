@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"git-notes/internal/test_helpers"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// commitAt syncs the repo with the commit dated at the time.
+func commitAt(t *testing.T, path string, at string) {
+	assert.NoError(t, os.Setenv("GIT_COMMITTER_DATE", at))
+	defer os.Unsetenv("GIT_COMMITTER_DATE")
+
+	git := GitCmd{}
+	assert.NoError(t, git.Sync(path))
+}
+
+func setupVersions(t *testing.T) test_helpers.Repos {
+	repos := test_helpers.SetupRepos()
+
+	test_helpers.WriteFile(t, repos.Local, "a.md", "v1")
+	commitAt(t, repos.Local, "2021-06-01T10:00:00Z")
+	test_helpers.WriteFile(t, repos.Local, "a.md", "v2")
+	commitAt(t, repos.Local, "2021-06-02T10:00:00Z")
+	assert.NoError(t, os.Rename(filepath.Join(repos.Local, "a.md"), filepath.Join(repos.Local, "b.md")))
+	commitAt(t, repos.Local, "2021-06-03T10:00:00Z")
+	test_helpers.WriteFile(t, repos.Local, "b.md", "v3")
+	commitAt(t, repos.Local, "2021-06-04T10:00:00Z")
+
+	return repos
+}
+
+func TestFileLog(t *testing.T) {
+	repos := setupVersions(t)
+	defer test_helpers.CleanupRepos(repos)
+
+	// A commit made outside git-notes has no host trailer.
+	test_helpers.WriteFile(t, repos.Local, "b.md", "v4")
+	test_helpers.PerformCmd(t, repos.Local, "git", "commit", "-am", "By hand")
+
+	versions, err := FileLog(context.Background(), repos.Local, filepath.Join(repos.Local, "b.md"))
+	assert.NoError(t, err)
+	if !assert.Len(t, versions, 5) {
+		return
+	}
+
+	var statuses, paths, hosts []string
+	for _, version := range versions {
+		statuses = append(statuses, version.Status)
+		paths = append(paths, version.Path)
+		hosts = append(hosts, version.Host)
+	}
+	assert.Equal(t, []string{"M", "M", "R", "M", "A"}, statuses)
+	assert.Equal(t, []string{"b.md", "b.md", "b.md", "a.md", "a.md"}, paths)
+	author, err := runCmdStdout(context.Background(), repos.Local, "git", "log", "-1", "--format=%an")
+	assert.NoError(t, err)
+	assert.Equal(t, strings.TrimSpace(author), hosts[0])
+	assert.Equal(t, []string{hostname(), hostname(), hostname(), hostname()}, hosts[1:])
+	assert.Equal(t, time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC).Unix(), versions[4].Time.Unix())
+}
+
+func TestRestoreFile(t *testing.T) {
+	repos := setupVersions(t)
+	defer test_helpers.CleanupRepos(repos)
+
+	git := &GitCmd{}
+	version, err := git.RestoreFile(context.Background(), repos.Local, "b.md", time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC))
+	assert.NoError(t, err)
+	assert.Equal(t, "a.md", version.Path)
+
+	content, err := ioutil.ReadFile(filepath.Join(repos.Local, "b.md"))
+	assert.NoError(t, err)
+	assert.Equal(t, "v1", string(content))
+
+	// The restore is committed, and pushed on the next sync.
+	message, err := runCmdStdout(context.Background(), repos.Local, "git", "log", "-1", "--format=%B")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(message, "Restored b.md as of 2021-06-01T10:00:00Z"), message)
+	assertState(t, repos.Local, Ahead)
+
+	_, err = git.RestoreFile(context.Background(), repos.Local, "b.md", time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC))
+	assert.EqualError(t, err, "b.md didn't exist at 2021-05-01T00:00:00Z")
+}
+
+func TestRestoreFile_Hooks(t *testing.T) {
+	repos := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(repos)
+	git := gitWithSettings(RepoConfig{Hooks: HooksConfig{Secrets: true}}, repos.Local)
+
+	// A secret that was committed by hand.
+	test_helpers.WriteFile(t, repos.Local, "aws.md", "key: "+awsKey)
+	test_helpers.PerformCmd(t, repos.Local, "git", "add", "aws.md")
+	assert.NoError(t, os.Setenv("GIT_COMMITTER_DATE", "2021-06-01T10:00:00Z"))
+	test_helpers.PerformCmd(t, repos.Local, "git", "commit", "-q", "-m", "By hand")
+	assert.NoError(t, os.Unsetenv("GIT_COMMITTER_DATE"))
+	test_helpers.PerformCmd(t, repos.Local, "git", "rm", "-q", "aws.md")
+	test_helpers.PerformCmd(t, repos.Local, "git", "commit", "-q", "-m", "Removed")
+	before := head(context.Background(), repos.Local)
+
+	_, err := git.RestoreFile(context.Background(), repos.Local, "aws.md", time.Date(2021, 6, 2, 0, 0, 0, 0, time.UTC))
+	assert.EqualError(t, err, "the restored version of aws.md is in the working tree, but the hooks blocked its commit")
+	assert.Equal(t, before, head(context.Background(), repos.Local))
+	assert.Equal(t, "?? aws.md\n", gitOutput(t, repos.Local, "status", "--porcelain"))
+}
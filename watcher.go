@@ -11,6 +11,7 @@ type Watcher interface {
 
 type GitWatcher struct {
 	git Git
+	clock Clock
 	running bool
 	checkInterval time.Duration
 	delayBeforeFiringEvent time.Duration
@@ -30,9 +31,9 @@ func (f *GitWatcher) Check(path string, channel chan string) {
 
 	if dirty {
 		log.Printf("Changes have been detected.")
-		time.Sleep(f.delayBeforeFiringEvent)
+		orRealClock(f.clock).Sleep(f.delayBeforeFiringEvent)
 		channel <- path
-		time.Sleep(f.delayAfterFiringEvent)
+		orRealClock(f.clock).Sleep(f.delayAfterFiringEvent)
 	}
 }
 
@@ -40,7 +41,7 @@ func (f *GitWatcher) Watch(path string, channel chan string) {
 	f.running = true
 	go func() {
 		for f.running {
-			time.Sleep(f.checkInterval)
+			orRealClock(f.clock).Sleep(f.checkInterval)
 			f.Check(path, channel)
 		}
 	}()
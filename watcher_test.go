@@ -9,33 +9,22 @@ import (
 	"time"
 )
 
-type listener struct {
-	paths []string
-}
-
-func setup() (*GitWatcher, *listener, string, chan string) {
-	var channel chan string = make(chan string)
+func setup() (*GitWatcher, *test_helpers.FakeClock, string, chan string) {
+	var channel chan string = make(chan string, 10)
+	var clock = test_helpers.NewFakeClock(time.Now())
 
 	var watcher = GitWatcher {
 		git: &GitCmd{},
+		clock: clock,
 		running: false,
-		checkInterval: 10 * time.Millisecond,
-		delayBeforeFiringEvent: 0,
-		delayAfterFiringEvent: 1 * time.Second,
+		checkInterval: 10 * time.Second,
+		delayBeforeFiringEvent: 2 * time.Second,
+		delayAfterFiringEvent: 5 * time.Second,
 	}
 
 	var path = test_helpers.SetupGitRepo("watcher", false)
 
-	var listener listener
-
-	go func() {
-		for {
-			path = <- channel
-			listener.paths = append(listener.paths, path)
-		}
-	}()
-
-	return &watcher, &listener, path, channel
+	return &watcher, clock, path, channel
 }
 
 func cleanup(watcher *GitWatcher, path string) {
@@ -53,47 +42,72 @@ func commit(t *testing.T, path string) {
 }
 
 func TestGitWatcher_Watch(t *testing.T) {
-	var watcher, listener, path, channel = setup()
+	var watcher, clock, path, channel = setup()
 	defer cleanup(watcher, path)
 
 	watcher.Watch(path, channel)
-
-	assert.Equal(t, 0, len(listener.paths))
+	clock.BlockUntil(1)
 
 	test_helpers.WriteFile(t, path, "test.md", "Watch")
-	time.Sleep(1 * time.Second)
-	assert.Greater(t, len(listener.paths), 0)
-	assert.Equal(t, path, listener.paths[0])
+
+	// Nothing fires before the check interval.
+	clock.Advance(9 * time.Second)
+	assert.Equal(t, 1, clock.Waiters())
+	assert.Equal(t, 0, len(channel))
+
+	// The change is detected, and the event fires after the delay.
+	clock.Advance(1 * time.Second)
+	clock.BlockUntil(1)
+	assert.Equal(t, 0, len(channel))
+
+	clock.Advance(2 * time.Second)
+	clock.BlockUntil(1)
+	assert.Equal(t, 1, len(channel))
+	assert.Equal(t, path, <-channel)
+
+	// Nothing is checked until the delay after the event and the check interval have passed.
+	clock.Advance(5 * time.Second)
+	clock.BlockUntil(1)
+	clock.Advance(9 * time.Second)
+	assert.Equal(t, 1, clock.Waiters())
+	assert.Equal(t, 0, len(channel))
+
+	clock.Advance(1 * time.Second)
+	clock.BlockUntil(1)
+	clock.Advance(2 * time.Second)
+	clock.BlockUntil(1)
+	assert.Equal(t, 1, len(channel))
+	assert.Equal(t, path, <-channel)
 }
 
 func TestGitWatcher_CreateAndModify(t *testing.T) {
-	var watcher, listener, path, channel = setup()
+	var watcher, _, path, channel = setup()
 	defer cleanup(watcher, path)
+	watcher.delayBeforeFiringEvent = 0
+	watcher.delayAfterFiringEvent = 0
 
 	watcher.Check(path, channel)
-	assert.Equal(t, 0, len(listener.paths))
+	assert.Equal(t, 0, len(channel))
 
 	test_helpers.WriteFile(t, path, "test.md", "Hello")
 	watcher.Check(path, channel)
-	assert.Equal(t, 1, len(listener.paths))
-	assert.Equal(t, path, listener.paths[0])
+	assert.Equal(t, 1, len(channel))
+	assert.Equal(t, path, <-channel)
 
 	commit(t, path)
 
 	watcher.Check(path, channel)
-	assert.Equal(t, 1, len(listener.paths))
-	assert.Equal(t, path, listener.paths[0])
+	assert.Equal(t, 0, len(channel))
 
 	test_helpers.WriteFile(t, path, "test.md", "Hello2")
 	watcher.Check(path, channel)
-	assert.Equal(t, 2, len(listener.paths))
-	assert.Equal(t, path, listener.paths[0])
-	assert.Equal(t, path, listener.paths[1])
+	assert.Equal(t, 1, len(channel))
+	assert.Equal(t, path, <-channel)
 
 	commit(t, path)
 
 	// No change
 	test_helpers.WriteFile(t, path, "test.md", "Hello2")
 	watcher.Check(path, channel)
-	assert.Equal(t, 2, len(listener.paths))
+	assert.Equal(t, 0, len(channel))
 }
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const maxWebFileSize = 1 << 20
+
+var validSha = regexp.MustCompile(`^[0-9a-f]{7,64}$`)
+
+var webTemplates = template.Must(template.New("layout").Funcs(template.FuncMap{
+	"time":  func(entry JournalEntry) string { return entry.Time.Local().Format("2006-01-02 15:04:05") },
+	"short": shortSha,
+	"join":  path.Join,
+	"parent": func(file string) string {
+		if dir := path.Dir(file); dir != "." {
+			return dir
+		}
+		return ""
+	},
+	"diffClass": func(line string) string {
+		switch {
+		case strings.HasPrefix(line, "+++") || strings.HasPrefix(line, "---"):
+			return "file"
+		case strings.HasPrefix(line, "+"):
+			return "add"
+		case strings.HasPrefix(line, "-"):
+			return "del"
+		case strings.HasPrefix(line, "@@"):
+			return "hunk"
+		}
+		return ""
+	},
+}).Parse(`{{define "header"}}<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.Title}} - Git Notes</title>
+<style>
+body { font-family: sans-serif; max-width: 60em; margin: 1em auto; padding: 0 1em; color: #222; }
+table { border-collapse: collapse; width: 100%; }
+td, th { text-align: left; padding: .3em .6em; border-bottom: 1px solid #ddd; vertical-align: top; }
+pre { background: #f6f6f6; padding: .6em; overflow-x: auto; }
+.error, .del { color: #b00; } .add { color: #070; } .hunk { color: #06a; } .file { font-weight: bold; }
+.state { font-weight: bold; } .muted { color: #777; }
+</style></head><body>
+<p><a href="/">Repos</a>{{if .Repo}} / <a href="/repos/{{.Index}}/tree/">{{.Repo}}</a>{{end}}</p>
+<h1>{{.Title}}</h1>
+{{end}}
+{{define "footer"}}</body></html>{{end}}
+
+{{define "index"}}{{template "header" .}}
+<table><tr><th>Repo</th><th>State</th><th>Last sync</th><th>Last commit</th></tr>
+{{range .Repos}}<tr>
+<td><a href="/repos/{{.Index}}/tree/">{{.Path}}</a></td>
+<td>{{if .State.To}}<span class="state">{{.State.To}}</span>{{else}}<span class="muted">no sync is recorded</span>{{end}}
+{{if .Failure.Message}}<div class="error">{{.Failure.Message}}</div>{{end}}</td>
+<td>{{if .State.To}}{{time .State}}{{end}}</td>
+<td>{{.Commit}}</td>
+</tr>{{end}}
+</table>
+{{template "footer"}}{{end}}
+
+{{define "tree"}}{{template "header" .}}
+{{if .File}}<p><a href="/repos/{{.Index}}/tree/{{parent .File}}">Up</a> · <a href="/repos/{{.Index}}/history/{{.File}}">History</a></p>{{end}}
+{{if .Entries}}<table>
+{{if .Dir}}<tr><td><a href="/repos/{{.Index}}/tree/{{parent .Dir}}">..</a></td></tr>{{end}}
+{{range .Entries}}<tr><td><a href="/repos/{{$.Index}}/tree/{{join $.Dir .Name}}">{{.Name}}{{if .IsDir}}/{{end}}</a></td></tr>{{end}}
+</table>{{end}}
+{{if .Markdown}}<div class="markdown">{{.Markdown}}</div>{{end}}
+{{if .Text}}<pre>{{.Text}}</pre>{{end}}
+{{if .Notice}}<p class="muted">{{.Notice}}</p>{{end}}
+{{template "footer"}}{{end}}
+
+{{define "history"}}{{template "header" .}}
+<p><a href="/repos/{{.Index}}/tree/{{.File}}">Current version</a></p>
+<table><tr><th>Time</th><th>Commit</th><th>Machine</th><th>Change</th><th></th></tr>
+{{range $i, $v := .Versions}}<tr>
+<td>{{$v.Time.Local.Format "2006-01-02 15:04:05"}}</td><td>{{short $v.Sha}}</td><td>{{$v.Host}}</td><td>{{$v.Status}} {{$v.Path}}</td>
+<td>{{if ne $v.Status "D"}}<a href="/repos/{{$.Index}}/version/{{$v.Path}}?sha={{$v.Sha}}">View</a>{{end}}
+{{with index $.Previous $i}}· <a href="/repos/{{$.Index}}/diff/{{$v.Path}}?from={{.Sha}}&to={{$v.Sha}}&old={{.Path}}">Diff</a>{{end}}</td>
+</tr>{{end}}
+</table>
+{{template "footer"}}{{end}}
+
+{{define "diff"}}{{template "header" .}}
+<pre>{{range .Lines}}<span class="{{diffClass .}}">{{.}}</span>
+{{end}}</pre>
+{{template "footer"}}{{end}}
+`))
+
+type webPage struct {
+	Title string
+	Repo  string
+	Index int
+}
+
+// webTree is a directory, or the content of a file.
+type webTree struct {
+	webPage
+	Dir      string
+	File     string
+	Entries  []os.DirEntry
+	Markdown template.HTML
+	Text     string
+	Notice   string
+}
+
+type webRepo struct {
+	Index   int
+	Path    string
+	State   JournalEntry
+	Failure JournalEntry
+	Commit  string
+}
+
+// WebServer serves a read-only page of the repos, their state, their notes and the history of the notes.
+type WebServer struct {
+	repos []string
+	// host is the host of the listen address, which the requests may name besides localhost and the IP addresses.
+	host string
+}
+
+func NewWebServer(repos []string) *WebServer {
+	return &WebServer{repos: repos}
+}
+
+func (s *WebServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.allowedHost(r.Host) {
+		http.Error(w, "invalid host", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "the web page is read-only", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.URL.Path == "/" {
+		s.index(r.Context(), w)
+		return
+	}
+
+	// The paths are like `/repos/<index>/<view>/<file>`.
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/repos/"), "/", 3)
+	if !strings.HasPrefix(r.URL.Path, "/repos/") || len(parts) < 2 {
+		http.NotFound(w, r)
+		return
+	}
+	index, err := strconv.Atoi(parts[0])
+	if err != nil || index < 0 || index >= len(s.repos) {
+		http.NotFound(w, r)
+		return
+	}
+	file := ""
+	if len(parts) == 3 {
+		file = strings.Trim(path.Clean("/"+parts[2]), "/")
+	}
+	page := webPage{Title: file, Repo: s.repos[index], Index: index}
+	if page.Title == "" {
+		page.Title = page.Repo
+	}
+
+	switch parts[1] {
+	case "tree":
+		s.tree(w, r, page, file)
+	case "history":
+		s.history(w, r, page, file)
+	case "version":
+		s.version(w, r, page, file)
+	case "diff":
+		s.diff(w, r, page, file)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// allowedHost returns whether the host names this server. This rejects a page that rebinds its own domain name to
+// the address of the server (DNS rebinding) to read the notes. An IP address can't be rebound.
+func (s *WebServer) allowedHost(host string) bool {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	host = strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+	return strings.EqualFold(host, "localhost") || net.ParseIP(host) != nil || (s.host != "" && strings.EqualFold(host, s.host))
+}
+
+func (s *WebServer) render(w http.ResponseWriter, name string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := webTemplates.ExecuteTemplate(w, name, data)
+	if err != nil {
+		log.Printf("Unable to render the %s page. Err: %v", name, err)
+	}
+}
+
+func (s *WebServer) index(ctx context.Context, w http.ResponseWriter) {
+	var repos []webRepo
+	for i, repo := range s.repos {
+		info := webRepo{Index: i, Path: repo}
+		var err error
+		info.State, info.Failure, err = LastSync(ctx, repo)
+		if err != nil {
+			info.Failure.Message = err.Error()
+		}
+		if commit, err := ReadCommitInfo(ctx, repo, "HEAD"); err == nil {
+			info.Commit = commit.String()
+		}
+		repos = append(repos, info)
+	}
+
+	s.render(w, "index", struct {
+		webPage
+		Repos []webRepo
+	}{webPage{Title: "Repos"}, repos})
+}
+
+// workingTreePath returns the path of the file in the working tree, or an error when it's outside of the repo or in
+// `.git`.
+func workingTreePath(repo string, file string) (string, error) {
+	for _, part := range strings.Split(file, "/") {
+		if part == ".git" || part == ".." {
+			return "", fmt.Errorf("%s is not in the working tree", file)
+		}
+	}
+
+	root, err := filepath.EvalSymlinks(repo)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(file)))
+	if err != nil {
+		return "", err
+	}
+	if resolved != root && !strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is not in the working tree", file)
+	}
+	return resolved, nil
+}
+
+func isMarkdown(file string) bool {
+	ext := strings.ToLower(path.Ext(file))
+	return ext == ".md" || ext == ".markdown"
+}
+
+// fileContent returns the content for webTree, rendered when it's Markdown.
+func fileContent(file string, content []byte) (template.HTML, string, string) {
+	if len(content) > maxWebFileSize {
+		return "", "", "The file is too large to show."
+	}
+	if strings.ContainsRune(string(content), 0) {
+		return "", "", "The file is binary."
+	}
+	if isMarkdown(file) {
+		return RenderMarkdown(string(content)), "", ""
+	}
+	return "", string(content), ""
+}
+
+func (s *WebServer) tree(w http.ResponseWriter, r *http.Request, page webPage, file string) {
+	target, err := workingTreePath(page.Repo, file)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	data := webTree{webPage: page}
+
+	if info.IsDir() {
+		data.Dir = file
+		entries, err := os.ReadDir(target)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, entry := range entries {
+			if entry.Name() != ".git" {
+				data.Entries = append(data.Entries, entry)
+			}
+		}
+		sort.SliceStable(data.Entries, func(i, j int) bool {
+			return data.Entries[i].IsDir() && !data.Entries[j].IsDir()
+		})
+		if len(data.Entries) == 0 {
+			data.Notice = "The directory is empty."
+		}
+	} else {
+		data.File = file
+		if info.Size() > maxWebFileSize {
+			data.Notice = "The file is too large to show."
+		} else {
+			content, err := ioutil.ReadFile(target)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			data.Markdown, data.Text, data.Notice = fileContent(file, content)
+		}
+	}
+	s.render(w, "tree", data)
+}
+
+func (s *WebServer) history(w http.ResponseWriter, r *http.Request, page webPage, file string) {
+	versions, err := FileLog(r.Context(), page.Repo, file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(versions) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Each version is compared with the one before it, when there's one.
+	previous := make([]*FileVersion, len(versions))
+	for i := range versions[:len(versions)-1] {
+		if versions[i+1].Status != "D" {
+			previous[i] = &versions[i+1]
+		}
+	}
+	page.Title = "History of " + file
+	s.render(w, "history", struct {
+		webPage
+		File     string
+		Versions []FileVersion
+		Previous []*FileVersion
+	}{page, file, versions, previous})
+}
+
+func (s *WebServer) version(w http.ResponseWriter, r *http.Request, page webPage, file string) {
+	sha := r.URL.Query().Get("sha")
+	if !validSha.MatchString(sha) {
+		http.NotFound(w, r)
+		return
+	}
+
+	// The filters decrypt the encrypted repos and fetch the LFS objects, like for RestoreFile.
+	content, err := runCmdStdout(r.Context(), page.Repo, "git", "cat-file", "--filters", fmt.Sprintf("%s:%s", sha, file))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	data := webTree{webPage: page, File: file}
+	data.Title = fmt.Sprintf("%s at %s", file, shortSha(sha))
+	data.Markdown, data.Text, data.Notice = fileContent(file, []byte(content))
+	s.render(w, "tree", data)
+}
+
+func (s *WebServer) diff(w http.ResponseWriter, r *http.Request, page webPage, file string) {
+	from, to := r.URL.Query().Get("from"), r.URL.Query().Get("to")
+	old := strings.Trim(path.Clean("/"+r.URL.Query().Get("old")), "/")
+	if !validSha.MatchString(from) || !validSha.MatchString(to) {
+		http.NotFound(w, r)
+		return
+	}
+	if old == "" {
+		old = file
+	}
+
+	// The textconv of the encrypted repos shows the plain text.
+	out, err := runCmdStdout(r.Context(), page.Repo, "git", "-c", "core.quotePath=false", "diff", "-M", from, to, "--", old, file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	page.Title = fmt.Sprintf("%s from %s to %s", file, shortSha(from), shortSha(to))
+	s.render(w, "diff", struct {
+		webPage
+		Lines []string
+	}{page, strings.Split(strings.TrimRight(out, "\n"), "\n")})
+}
+
+// ServeWeb serves the web page until the server fails.
+func ServeWeb(listen string, server *WebServer) error {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s. Err: %v", listen, err)
+	}
+	server.host, _, _ = net.SplitHostPort(listen)
+	log.Printf("Serving the web page at http://%s", listener.Addr())
+	return http.Serve(listener, server)
+}
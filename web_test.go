@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"git-notes/internal/test_helpers"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func webGet(t *testing.T, server *WebServer, url string) (int, string) {
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest("GET", "http://localhost:8301"+url, nil))
+	body, err := ioutil.ReadAll(recorder.Body)
+	assert.NoError(t, err)
+	return recorder.Code, string(body)
+}
+
+func TestWebServer(t *testing.T) {
+	repos := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(repos)
+	git := &GitCmd{}
+	assert.NoError(t, os.Mkdir(filepath.Join(repos.Local, "notes"), 0755))
+
+	test_helpers.WriteFile(t, repos.Local, "notes/todo.md", "# Todo\n\n- [ ] buy **milk**")
+	assert.NoError(t, git.Sync(repos.Local))
+	test_helpers.WriteFile(t, repos.Local, "notes/todo.md", "# Todo\n\n- [x] buy **milk**")
+	assert.NoError(t, git.Sync(repos.Local))
+	versions, err := FileLog(context.Background(), repos.Local, "notes/todo.md")
+	assert.NoError(t, err)
+	server := NewWebServer([]string{repos.Local})
+
+	code, body := webGet(t, server, "/")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, repos.Local)
+	assert.Contains(t, body, `<span class="state">sync</span>`)
+
+	code, body = webGet(t, server, "/repos/0/tree/")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `<a href="/repos/0/tree/notes">notes/</a>`)
+	assert.NotContains(t, body, ".git")
+
+	code, body = webGet(t, server, "/repos/0/tree/notes/todo.md")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "<h1>Todo</h1>")
+	assert.Contains(t, body, "<input type=\"checkbox\" disabled checked> buy <strong>milk</strong>")
+
+	code, body = webGet(t, server, "/repos/0/history/notes/todo.md")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "/repos/0/version/notes/todo.md?sha="+versions[1].Sha)
+	assert.Contains(t, body, "/repos/0/diff/notes/todo.md?from="+versions[1].Sha+"&to="+versions[0].Sha)
+
+	code, body = webGet(t, server, "/repos/0/version/notes/todo.md?sha="+versions[1].Sha)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "<input type=\"checkbox\" disabled> buy")
+
+	code, body = webGet(t, server, "/repos/0/diff/notes/todo.md?from="+versions[1].Sha+"&to="+versions[0].Sha)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `<span class="del">-- [ ] buy **milk**</span>`)
+	assert.Contains(t, body, `<span class="add">&#43;- [x] buy **milk**</span>`)
+}
+
+func TestWebServer_OutsideOfTheWorkingTree(t *testing.T) {
+	repos := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(repos)
+	assert.NoError(t, os.Symlink(repos.Remote, filepath.Join(repos.Local, "escape")))
+	server := NewWebServer([]string{repos.Local})
+
+	// The paths are cleaned, so `..` stays in the repo.
+	code, body := webGet(t, server, "/repos/0/tree/../../")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `<a href="/repos/0/tree/escape">escape</a>`)
+
+	for _, url := range []string{"/repos/0/tree/.git/config", "/repos/0/tree/escape/config", "/repos/1/tree/", "/other"} {
+		code, _ := webGet(t, server, url)
+		assert.Equal(t, http.StatusNotFound, code, url)
+	}
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest("POST", "http://localhost/", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+}
+
+func TestWebServer_Host(t *testing.T) {
+	repos := test_helpers.SetupRepos()
+	defer test_helpers.CleanupRepos(repos)
+	server := NewWebServer([]string{repos.Local})
+	server.host = "notes.local"
+
+	for host, code := range map[string]int{
+		"localhost:8301":         http.StatusOK,
+		"127.0.0.1:8301":         http.StatusOK,
+		"[::1]:8301":             http.StatusOK,
+		"192.168.1.20":           http.StatusOK,
+		"notes.local:8301":       http.StatusOK,
+		"attacker.example:8301":  http.StatusForbidden,
+		"localhost.example:8301": http.StatusForbidden,
+	} {
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest("GET", "http://"+host+"/", nil))
+		assert.Equal(t, code, recorder.Code, host)
+	}
+}
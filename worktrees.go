@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The linked worktrees inside the working tree are listed in `info/exclude`, which is never committed, so they
+// aren't committed as embedded repos.
+const worktreeExcludeMarker = "# git-notes: linked worktrees"
+
+// commonGitDir returns the git dir that the linked worktrees share. It has the objects and the refs, unlike the git
+// dir of a linked worktree.
+func commonGitDir(ctx context.Context, path string) (string, error) {
+	out, err := runCmdStdout(ctx, path, "git", "rev-parse", "--git-common-dir")
+	if err != nil {
+		return "", fmt.Errorf("unable to find the git dir of %s. Err: %v", path, err)
+	}
+	dir := strings.TrimSpace(out)
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(path, dir)
+	}
+	return filepath.Clean(dir), nil
+}
+
+// nestedWorktrees returns the other worktrees of the repo that are inside its working tree, relative to it.
+func nestedWorktrees(ctx context.Context, path string) ([]string, error) {
+	out, err := runCmdStdout(ctx, path, "git", "worktree", "list", "--porcelain")
+	if err != nil {
+		return nil, fmt.Errorf("unable to list the worktrees of %s. Err: %v", path, err)
+	}
+	top, err := runCmdStdout(ctx, path, "git", "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, fmt.Errorf("unable to find the working tree of %s. Err: %v", path, err)
+	}
+	root := resolvePath(strings.TrimSpace(top))
+
+	var nested []string
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.HasPrefix(line, "worktree ") {
+			continue
+		}
+		worktree := resolvePath(strings.TrimPrefix(line, "worktree "))
+		relative, err := filepath.Rel(root, worktree)
+		if err != nil || relative == "." || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+			continue
+		}
+		nested = append(nested, filepath.ToSlash(relative))
+	}
+	return nested, nil
+}
+
+// resolvePath resolves the symlinks, e.g. `/tmp` on macOS, so the paths from git can be compared.
+func resolvePath(path string) string {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	return resolved
+}
+
+// ExcludeNestedWorktrees keeps the linked worktrees that are inside the working tree out of the commits.
+func ExcludeNestedWorktrees(ctx context.Context, path string) error {
+	nested, err := nestedWorktrees(ctx, path)
+	if err != nil || len(nested) == 0 {
+		return err
+	}
+
+	file, err := runCmdStdout(ctx, path, "git", "rev-parse", "--git-path", "info/exclude")
+	if err != nil {
+		return err
+	}
+	file = strings.TrimSpace(file)
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(path, file)
+	}
+	existing, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	lines := map[string]bool{}
+	for _, line := range strings.Split(string(existing), "\n") {
+		lines[strings.TrimSpace(line)] = true
+	}
+	var missing []string
+	for _, worktree := range nested {
+		pattern := "/" + worktree + "/"
+		if !lines[pattern] {
+			missing = append(missing, pattern)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	content := string(existing)
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	content += worktreeExcludeMarker + "\n" + strings.Join(missing, "\n") + "\n"
+	err = os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, []byte(content), 0644)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"git-notes/internal/test_helpers"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNestedWorktree(t *testing.T) {
+	machines := test_helpers.SetupMachines(1, 1)
+	defer test_helpers.CleanupMachines(machines)
+	local := machines.Clones[0]
+	worktree := filepath.Join(local, "drafts")
+	test_helpers.PerformCmd(t, local, "git", "worktree", "add", "-q", "-b", "drafts", worktree)
+	test_helpers.PerformCmd(t, worktree, "git", "push", "-q", "-u", "origin", "drafts")
+	git := GitCmd{}
+
+	test_helpers.WriteFile(t, local, "a.md", "a")
+	assert.NoError(t, git.Sync(local))
+	assertState(t, local, Sync)
+	assert.Equal(t, []string{"a.md", machines.Shared[0]}, remoteFiles(t, test_helpers.Repos{Local: local, Remote: machines.Remote}))
+
+	// The worktree syncs its own branch.
+	test_helpers.WriteFile(t, worktree, "draft.md", "draft")
+	assert.NoError(t, git.Sync(worktree))
+	assertState(t, worktree, Sync)
+	assert.Contains(t, gitOutput(t, machines.Remote, "ls-tree", "--name-only", "drafts"), "draft.md")
+	assertState(t, local, Sync)
+
+	// The exclusion is added once.
+	assert.NoError(t, ExcludeNestedWorktrees(context.Background(), local))
+	exclude, err := ioutil.ReadFile(filepath.Join(local, ".git", "info", "exclude"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(exclude), worktreeExcludeMarker+"\n/drafts/\n")
+	assert.Equal(t, 1, strings.Count(string(exclude), "/drafts/"))
+}
+
+func TestCommonGitDir(t *testing.T) {
+	machines := test_helpers.SetupMachines(1, 1)
+	defer test_helpers.CleanupMachines(machines)
+	local := machines.Clones[0]
+	worktree := filepath.Join(filepath.Dir(local), "drafts")
+	test_helpers.PerformCmd(t, local, "git", "worktree", "add", "-q", "-b", "drafts", worktree)
+
+	dir, err := commonGitDir(context.Background(), worktree)
+	assert.NoError(t, err)
+	assert.Equal(t, resolvePath(filepath.Join(local, ".git")), resolvePath(dir))
+
+	// It's outside, so it's nothing to exclude.
+	nested, err := nestedWorktrees(context.Background(), local)
+	assert.NoError(t, err)
+	assert.Empty(t, nested)
+}